@@ -0,0 +1,208 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/CruGlobal/mirage-server/internal/cache"
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+var (
+	// Interface guards.
+	_ caddy.Module      = (*AdminAPI)(nil)
+	_ caddy.Provisioner = (*AdminAPI)(nil)
+	_ caddy.AdminRouter = (*AdminAPI)(nil)
+)
+
+const AdminCacheEndpoint = "/mirage/cache"
+
+func init() {
+	caddy.RegisterModule(AdminAPI{})
+}
+
+// AdminAPI serves the mirage cache through the Caddy admin API:
+//
+//	GET    /mirage/cache  lists cache entries and stats
+//	DELETE /mirage/cache  purges cache entries
+//
+// Entries are selected with one of the name, suffix or tag query parameters,
+// or all=true. GET without a selector lists every entry.
+//
+// The app's cache is listed unless the profile or table query parameter
+// selects the cache of a named profile or of handlers overriding the table.
+// Purges apply to every live cache of a table, as during a reload, and
+// without either parameter to every live cache, profiles and tables included.
+type AdminAPI struct {
+	app    *App
+	logger *zap.Logger
+}
+
+func (AdminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.mirage",
+		New: func() caddy.Module { return new(AdminAPI) },
+	}
+}
+
+func (a *AdminAPI) Provision(ctx caddy.Context) error {
+	a.logger = ctx.Logger(a)
+
+	// The admin API is loaded for every config, mirage or not
+	module, err := ctx.AppIfConfigured(AppName)
+	if err != nil {
+		return nil //nolint:nilerr // mirage is not configured
+	}
+	app, ok := module.(*App)
+	if !ok {
+		return fmt.Errorf("unexpected module type: %T", module)
+	}
+	a.app = app
+	return nil
+}
+
+func (a *AdminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: AdminCacheEndpoint,
+			Handler: caddy.AdminHandlerFunc(a.handleCache),
+		},
+	}
+}
+
+type cacheResponse struct {
+	Stats   cache.Stats   `json:"stats"`
+	Entries []cache.Entry `json:"entries"`
+}
+
+type purgeResponse struct {
+	Purged []string `json:"purged"`
+}
+
+func (a *AdminAPI) handleCache(w http.ResponseWriter, r *http.Request) error {
+	if a.app == nil || a.app.Cache == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        errors.New("mirage is not configured"),
+		}
+	}
+
+	selected, err := a.caches(r)
+	if err != nil {
+		return err
+	}
+	match, matched, err := cacheMatcher(r)
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		entries := selected[0].Entries(match)
+		if entries == nil {
+			entries = []cache.Entry{}
+		}
+		return writeJSON(w, cacheResponse{
+			Stats:   selected[0].Stats(),
+			Entries: entries,
+		})
+	case http.MethodDelete:
+		if !matched {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        errors.New("one of name, suffix, tag or all=true is required"),
+			}
+		}
+		purged := []string{}
+		for _, c := range selected {
+			for _, hostname := range c.Purge(match) {
+				if !slices.Contains(purged, hostname) {
+					purged = append(purged, hostname)
+				}
+			}
+		}
+		a.logger.Info("cache purge",
+			zap.String("query", r.URL.RawQuery),
+			zap.String("remote_addr", r.RemoteAddr),
+			zap.Int("purged", len(purged)),
+		)
+		return writeJSON(w, purgeResponse{Purged: purged})
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+}
+
+// caches returns the caches the request's profile or table parameter
+// selects. Otherwise GET reads the app's cache and DELETE purges them all.
+func (a *AdminAPI) caches(r *http.Request) ([]*cache.RedirectCache, error) {
+	query := r.URL.Query()
+	switch {
+	case query.Has("profile") && query.Has("table"):
+		return nil, caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        errors.New("only one of profile or table may be given"),
+		}
+	case query.Has("profile"):
+		profile, err := a.app.Profile(query.Get("profile"))
+		if err != nil {
+			return nil, caddy.APIError{HTTPStatus: http.StatusNotFound, Err: err}
+		}
+		return []*cache.RedirectCache{profile.Cache}, nil
+	case query.Has("table"):
+		selected := namedCaches("table/" + query.Get("table"))
+		if len(selected) == 0 {
+			return nil, caddy.APIError{
+				HTTPStatus: http.StatusNotFound,
+				Err:        fmt.Errorf("no handler caches table %s", query.Get("table")),
+			}
+		}
+		return selected, nil
+	case r.Method == http.MethodDelete:
+		return pooledCaches(), nil
+	}
+	return []*cache.RedirectCache{a.app.Cache}, nil
+}
+
+// cacheMatcher builds a matcher from the request's selector, reporting
+// whether a selector was given.
+func cacheMatcher(r *http.Request) (cache.Matcher, bool, error) {
+	query := r.URL.Query()
+	var matchers []cache.Matcher
+	if query.Has("name") {
+		matchers = append(matchers, cache.MatchName(query.Get("name")))
+	}
+	if query.Has("suffix") {
+		matchers = append(matchers, cache.MatchSuffix(query.Get("suffix")))
+	}
+	if query.Has("tag") {
+		matchers = append(matchers, cache.MatchTag(query.Get("tag")))
+	}
+	if query.Get("all") == "true" {
+		matchers = append(matchers, cache.MatchAll())
+	}
+
+	switch len(matchers) {
+	case 0:
+		return cache.MatchAll(), false, nil
+	case 1:
+		return matchers[0], true, nil
+	}
+	return nil, false, errors.New("only one of name, suffix, tag or all=true may be given")
+}
+
+func writeJSON(w http.ResponseWriter, v any) error {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(encoded)
+	return nil
+}
@@ -0,0 +1,257 @@
+package app_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/CruGlobal/mirage-server/internal/app"
+	"github.com/CruGlobal/mirage-server/internal/redirect"
+	"github.com/CruGlobal/mirage-server/miragetest"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminAPI_CaddyModule(t *testing.T) {
+	module := app.AdminAPI{}.CaddyModule()
+	assert.Equal(t, caddy.ModuleID("admin.api.mirage"), module.ID)
+	assert.IsType(t, &app.AdminAPI{}, module.New())
+}
+
+func TestAdminAPI_Cache(t *testing.T) {
+	ctx := miragetest.NewMirageCaddyContext(t, miragetest.TestConfig{
+		Region:   "us-east-1",
+		Endpoint: miragetest.ClosedEndpoint,
+		Table:    "MirageServerConfigTest",
+		Key:      "Hostname",
+	})
+	module, err := ctx.App(app.AppName)
+	require.NoError(t, err)
+	mirageApp := module.(*app.App) //nolint:errcheck // always *app.App
+
+	a := new(app.AdminAPI)
+	require.NoError(t, a.Provision(ctx))
+	routes := a.Routes()
+	require.Len(t, routes, 1)
+	assert.Equal(t, app.AdminCacheEndpoint, routes[0].Pattern)
+
+	serve := func(method string, target string) (*httptest.ResponseRecorder, error) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, target, nil)
+		return w, routes[0].Handler.ServeHTTP(w, r)
+	}
+
+	seed := func() {
+		mirageApp.Cache.Forget("www.example.org")
+		mirageApp.Cache.Set(redirect.Redirect{Hostname: "example.org", Location: "www.example.org"})
+		mirageApp.Cache.Set(redirect.Redirect{Hostname: "go.example.org", Location: "example.org/go", Tags: []string{"spring"}})
+		mirageApp.Cache.Set(redirect.Redirect{Hostname: "www.example.com", Location: "example.com", Tags: []string{"spring"}})
+	}
+
+	testcases := []struct {
+		name   string
+		method string
+		target string
+		status int
+		purged []string
+	}{
+		{
+			name:   "purge by name",
+			method: http.MethodDelete,
+			target: "/mirage/cache?name=example.org",
+			purged: []string{"example.org"},
+		},
+		{
+			name:   "purge by suffix",
+			method: http.MethodDelete,
+			target: "/mirage/cache?suffix=*.example.org",
+			purged: []string{"example.org", "go.example.org"},
+		},
+		{
+			name:   "purge by tag",
+			method: http.MethodDelete,
+			target: "/mirage/cache?tag=spring",
+			purged: []string{"go.example.org", "www.example.com"},
+		},
+		{
+			name:   "purge all",
+			method: http.MethodDelete,
+			target: "/mirage/cache?all=true",
+			purged: []string{"example.org", "go.example.org", "www.example.com"},
+		},
+		{
+			name:   "purge without selector",
+			method: http.MethodDelete,
+			target: "/mirage/cache",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "purge with several selectors",
+			method: http.MethodDelete,
+			target: "/mirage/cache?name=example.org&tag=spring",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "method not allowed",
+			method: http.MethodPost,
+			target: "/mirage/cache",
+			status: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			seed()
+			w, err := serve(tc.method, tc.target)
+			if tc.status != 0 {
+				var apiErr caddy.APIError
+				require.ErrorAs(t, err, &apiErr)
+				assert.Equal(t, tc.status, apiErr.HTTPStatus)
+				return
+			}
+			require.NoError(t, err)
+
+			var response struct {
+				Purged []string `json:"purged"`
+			}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			assert.ElementsMatch(t, tc.purged, response.Purged)
+		})
+	}
+
+	t.Run("list", func(t *testing.T) {
+		seed()
+		mirageApp.Cache.Delete("example.org")
+
+		w, err := serve(http.MethodGet, "/mirage/cache?suffix=example.org")
+		require.NoError(t, err)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+		var response struct {
+			Stats struct {
+				Fresh int `json:"fresh"`
+			} `json:"stats"`
+			Entries []struct {
+				Hostname string `json:"hostname"`
+				State    string `json:"state"`
+			} `json:"entries"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, 2, response.Stats.Fresh)
+		assert.ElementsMatch(t, []struct {
+			Hostname string `json:"hostname"`
+			State    string `json:"state"`
+		}{
+			{Hostname: "example.org", State: "stale"},
+			{Hostname: "go.example.org", State: "fresh"},
+		}, response.Entries)
+	})
+}
+
+func TestAdminAPI_CacheSelectors(t *testing.T) {
+	ctx := miragetest.NewMirageCaddyContext(t, miragetest.TestConfig{
+		Region:   "us-east-1",
+		Endpoint: miragetest.ClosedEndpoint,
+		Table:    "MirageServerConfigTest",
+		Key:      "Hostname",
+		Profiles: map[string]miragetest.TestProfile{
+			"partner": {Table: "PartnerRedirects", Key: "Domain"},
+		},
+	})
+	module, err := ctx.App(app.AppName)
+	require.NoError(t, err)
+	mirageApp := module.(*app.App) //nolint:errcheck // always *app.App
+
+	partner, err := mirageApp.Profile("partner")
+	require.NoError(t, err)
+	partner.Cache.Set(redirect.Redirect{Hostname: "partner.selectors.example.org", Location: "example.org"})
+	tableCache, release, err := mirageApp.TableCache("HandlerRedirects")
+	require.NoError(t, err)
+	defer release() //nolint:errcheck // test cleanup
+	tableCache.Set(redirect.Redirect{Hostname: "handler.selectors.example.org", Location: "example.org"})
+	mirageApp.Cache.Set(redirect.Redirect{Hostname: "app.selectors.example.org", Location: "example.org"})
+
+	a := new(app.AdminAPI)
+	require.NoError(t, a.Provision(ctx))
+	handler := a.Routes()[0].Handler
+
+	testcases := []struct {
+		name     string
+		method   string
+		target   string
+		status   int
+		expected []string
+	}{
+		{
+			name:     "list profile",
+			method:   http.MethodGet,
+			target:   "/mirage/cache?profile=partner",
+			expected: []string{"partner.selectors.example.org"},
+		},
+		{
+			name:     "list table",
+			method:   http.MethodGet,
+			target:   "/mirage/cache?table=HandlerRedirects",
+			expected: []string{"handler.selectors.example.org"},
+		},
+		{
+			name:     "purge table",
+			method:   http.MethodDelete,
+			target:   "/mirage/cache?table=HandlerRedirects&all=true",
+			expected: []string{"handler.selectors.example.org"},
+		},
+		{
+			name:     "purge every cache",
+			method:   http.MethodDelete,
+			target:   "/mirage/cache?suffix=selectors.example.org",
+			expected: []string{"app.selectors.example.org", "partner.selectors.example.org"},
+		},
+		{
+			name:   "unknown profile",
+			method: http.MethodGet,
+			target: "/mirage/cache?profile=unknown",
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "unknown table",
+			method: http.MethodGet,
+			target: "/mirage/cache?table=UnknownRedirects",
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "profile and table",
+			method: http.MethodGet,
+			target: "/mirage/cache?profile=partner&table=HandlerRedirects",
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			err := handler.ServeHTTP(w, httptest.NewRequest(tc.method, tc.target, nil))
+			if tc.status != 0 {
+				var apiErr caddy.APIError
+				require.ErrorAs(t, err, &apiErr)
+				assert.Equal(t, tc.status, apiErr.HTTPStatus)
+				return
+			}
+			require.NoError(t, err)
+
+			var response struct {
+				Entries []struct {
+					Hostname string `json:"hostname"`
+				} `json:"entries"`
+				Purged []string `json:"purged"`
+			}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			hostnames := response.Purged
+			for _, entry := range response.Entries {
+				hostnames = append(hostnames, entry.Hostname)
+			}
+			assert.ElementsMatch(t, tc.expected, hostnames)
+		})
+	}
+}
@@ -1,6 +1,12 @@
 package app
 
 import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/CruGlobal/mirage-server/internal/dynamo"
+	"github.com/CruGlobal/mirage-server/internal/source"
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
@@ -18,6 +24,43 @@ func init() {
 //	        endpoint <endpoint>
 //	        table <table_name>
 //	        key <key_name>
+//	        auto_create
+//	        aws_profile <name>
+//	        role_arn <arn>
+//	        external_id <id>
+//	        session_name <name>
+//	        web_identity_token_file <path>
+//	        access_key_id <key>
+//	        secret_access_key <secret>
+//	        session_token <token>
+//	        profile <name> {
+//	            region <region>
+//	            endpoint <endpoint>
+//	            table <table_name>
+//	            key <key_name>
+//	            cache_ttl <duration>
+//	            cache_negative_ttl <duration>
+//	        }
+//	        replica <region> [<endpoint>]
+//	        failover_threshold <count>
+//	        failover_latency <duration>
+//	        failover_recovery <duration>
+//	        lookup_timeout <duration>
+//	        retry_max_attempts <count>
+//	        retry_max_backoff <duration>
+//	        breaker_threshold <count>
+//	        breaker_cooldown <duration>
+//	        source <module> {
+//	            ...
+//	        }
+//	        source_errors stop|fall_through
+//	        cache_ttl <duration>
+//	        cache_negative_ttl <duration>
+//	        cache_snapshot <path>
+//	        cache_snapshot_interval <duration>
+//	        purge_secret <secret>
+//	        purge_allow <ranges...>
+//	        purge_interval <duration>
 //	    }
 //	}
 func ParseMirage(d *caddyfile.Dispenser, _ any) (any, error) {
@@ -30,6 +73,53 @@ func ParseMirage(d *caddyfile.Dispenser, _ any) (any, error) {
 
 		for nesting := d.Nesting(); d.NextBlock(nesting); {
 			configKey := d.Val()
+			switch configKey {
+			case "auto_create":
+				if d.NextArg() {
+					return nil, d.ArgErr()
+				}
+				app.AutoCreate = true
+				continue
+			case "purge_allow":
+				ranges := d.RemainingArgs()
+				if len(ranges) == 0 {
+					return nil, d.ArgErr()
+				}
+				app.PurgeAllow = append(app.PurgeAllow, ranges...)
+				continue
+			case "replica":
+				args := d.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return nil, d.ArgErr()
+				}
+				replica := Replica{Region: args[0]}
+				if len(args) == 2 {
+					replica.Endpoint = args[1]
+				}
+				app.Replicas = append(app.Replicas, replica)
+				continue
+			case "profile":
+				name, profile, err := parseProfile(d)
+				if err != nil {
+					return nil, err
+				}
+				if _, exists := app.Profiles[name]; exists {
+					return nil, d.Errf("duplicate profile '%s'", name)
+				}
+				if app.Profiles == nil {
+					app.Profiles = make(map[string]*Profile)
+				}
+				app.Profiles[name] = profile
+				continue
+			case "source":
+				raw, err := parseSource(d)
+				if err != nil {
+					return nil, err
+				}
+				app.SourcesRaw = append(app.SourcesRaw, raw)
+				continue
+			}
+
 			var configVal string
 
 			if !d.Args(&configVal) {
@@ -45,8 +135,93 @@ func ParseMirage(d *caddyfile.Dispenser, _ any) (any, error) {
 				app.Table = configVal
 			case "key":
 				app.Key = configVal
+			case "failover_threshold":
+				threshold, err := strconv.Atoi(configVal)
+				if err != nil || threshold < 1 {
+					return nil, d.Errf("invalid value for 'failover_threshold': %s", configVal)
+				}
+				app.FailoverThreshold = threshold
+			case "failover_latency":
+				dur, err := caddy.ParseDuration(configVal)
+				if err != nil {
+					return nil, d.Errf("invalid duration for 'failover_latency': %v", err)
+				}
+				app.FailoverLatency = caddy.Duration(dur)
+			case "failover_recovery":
+				dur, err := caddy.ParseDuration(configVal)
+				if err != nil {
+					return nil, d.Errf("invalid duration for 'failover_recovery': %v", err)
+				}
+				app.FailoverRecovery = caddy.Duration(dur)
+			case "lookup_timeout":
+				dur, err := caddy.ParseDuration(configVal)
+				if err != nil {
+					return nil, d.Errf("invalid duration for 'lookup_timeout': %v", err)
+				}
+				app.LookupTimeout = caddy.Duration(dur)
+			case "retry_max_attempts":
+				attempts, err := strconv.Atoi(configVal)
+				if err != nil || attempts < 1 {
+					return nil, d.Errf("invalid value for 'retry_max_attempts': %s", configVal)
+				}
+				app.RetryMaxAttempts = attempts
+			case "retry_max_backoff":
+				dur, err := caddy.ParseDuration(configVal)
+				if err != nil {
+					return nil, d.Errf("invalid duration for 'retry_max_backoff': %v", err)
+				}
+				app.RetryMaxBackoff = caddy.Duration(dur)
+			case "breaker_threshold":
+				threshold, err := strconv.Atoi(configVal)
+				if err != nil || threshold < 1 {
+					return nil, d.Errf("invalid value for 'breaker_threshold': %s", configVal)
+				}
+				app.BreakerThreshold = threshold
+			case "breaker_cooldown":
+				dur, err := caddy.ParseDuration(configVal)
+				if err != nil {
+					return nil, d.Errf("invalid duration for 'breaker_cooldown': %v", err)
+				}
+				app.BreakerCooldown = caddy.Duration(dur)
+			case "cache_ttl":
+				dur, err := caddy.ParseDuration(configVal)
+				if err != nil {
+					return nil, d.Errf("invalid duration for 'cache_ttl': %v", err)
+				}
+				app.CacheTTL = caddy.Duration(dur)
+			case "cache_negative_ttl":
+				dur, err := caddy.ParseDuration(configVal)
+				if err != nil {
+					return nil, d.Errf("invalid duration for 'cache_negative_ttl': %v", err)
+				}
+				app.CacheNegativeTTL = caddy.Duration(dur)
+			case "cache_snapshot":
+				app.CacheSnapshot = configVal
+			case "cache_snapshot_interval":
+				dur, err := caddy.ParseDuration(configVal)
+				if err != nil {
+					return nil, d.Errf("invalid duration for 'cache_snapshot_interval': %v", err)
+				}
+				app.CacheSnapshotInterval = caddy.Duration(dur)
+			case "source_errors":
+				app.SourceErrors = configVal
+			case "purge_secret":
+				app.PurgeSecret = configVal
+			case "purge_interval":
+				dur, err := caddy.ParseDuration(configVal)
+				if err != nil {
+					return nil, d.Errf("invalid duration for 'purge_interval': %v", err)
+				}
+				app.PurgeInterval = caddy.Duration(dur)
 			default:
-				return nil, d.Errf("unknown parameter '%s' for 'mirage'", configKey)
+				creds := app.Credentials
+				if creds == nil {
+					creds = new(dynamo.Credentials)
+				}
+				if !creds.Set(configKey, configVal) {
+					return nil, d.Errf("unknown parameter '%s' for 'mirage'", configKey)
+				}
+				app.Credentials = creds
 			}
 		}
 	}
@@ -56,3 +231,72 @@ func ParseMirage(d *caddyfile.Dispenser, _ any) (any, error) {
 		Value: caddyconfig.JSON(app, nil),
 	}, nil
 }
+
+// parseSource unmarshals a redirect source module, for example:
+//
+//	source dynamodb {
+//	    table <table_name>
+//	}
+func parseSource(d *caddyfile.Dispenser) (json.RawMessage, error) {
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	name := d.Val()
+	unm, err := caddyfile.UnmarshalModule(d, source.Namespace+"."+name)
+	if err != nil {
+		return nil, err
+	}
+	return caddyconfig.JSONModuleObject(unm, "source", name, nil), nil
+}
+
+// parseProfile unmarshals a named profile, for example:
+//
+//	profile partner {
+//	    table <table_name>
+//	    key <key_name>
+//	}
+func parseProfile(d *caddyfile.Dispenser) (string, *Profile, error) {
+	if !d.NextArg() {
+		return "", nil, d.ArgErr()
+	}
+	name := d.Val()
+	if d.NextArg() {
+		return "", nil, d.ArgErr()
+	}
+
+	profile := new(Profile)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		configKey := d.Val()
+		var configVal string
+
+		if !d.Args(&configVal) {
+			return "", nil, d.ArgErr()
+		}
+
+		switch configKey {
+		case "region":
+			profile.Region = configVal
+		case "endpoint":
+			profile.Endpoint = configVal
+		case "table":
+			profile.Table = configVal
+		case "key":
+			profile.Key = configVal
+		case "cache_ttl":
+			dur, err := caddy.ParseDuration(configVal)
+			if err != nil {
+				return "", nil, d.Errf("invalid duration for 'cache_ttl': %v", err)
+			}
+			profile.CacheTTL = caddy.Duration(dur)
+		case "cache_negative_ttl":
+			dur, err := caddy.ParseDuration(configVal)
+			if err != nil {
+				return "", nil, d.Errf("invalid duration for 'cache_negative_ttl': %v", err)
+			}
+			profile.CacheNegativeTTL = caddy.Duration(dur)
+		default:
+			return "", nil, d.Errf("unknown parameter '%s' for profile '%s'", configKey, name)
+		}
+	}
+	return name, profile, nil
+}
@@ -60,6 +60,26 @@ func TestParseMirage(t *testing.T) {
             }`),
 			want: `{"region":"local","endpoint":"example.com","table":"TableName","key":"KeyName"}`,
 		},
+		{
+			name: "auto_create",
+			d: caddyfile.NewTestDispenser(`{
+                mirage {
+                  table TableName
+                  auto_create
+                }
+            }`),
+			want: `{"table":"TableName","auto_create":true}`,
+		},
+		{
+			name: "auto_create argument",
+			d: caddyfile.NewTestDispenser(`{
+                mirage {
+                  auto_create true
+                }
+            }`),
+			shouldErr: true,
+			err:       "wrong argument count or unexpected line ending after 'true'",
+		},
 		{
 			name: "valid2",
 			d: caddyfile.NewTestDispenser(`{
@@ -69,6 +89,209 @@ func TestParseMirage(t *testing.T) {
             }`),
 			want: `{"region":"us-west-2"}`,
 		},
+		{
+			name: "cache",
+			d: caddyfile.NewTestDispenser(`{
+                mirage {
+                  cache_ttl 5m
+                  cache_negative_ttl 30s
+                  cache_snapshot /var/lib/mirage/snapshot.json
+                  cache_snapshot_interval 1m
+                }
+            }`),
+			want: `{"cache_ttl":300000000000,"cache_negative_ttl":30000000000,"cache_snapshot":"/var/lib/mirage/snapshot.json","cache_snapshot_interval":60000000000}`,
+		},
+		{
+			name: "purge",
+			d: caddyfile.NewTestDispenser(`{
+                mirage {
+                  purge_secret s3cr3t
+                  purge_allow 10.16.0.0/16 192.168.1.1
+                  purge_allow ::1
+                  purge_interval 30s
+                }
+            }`),
+			want: `{"purge_secret":"s3cr3t","purge_allow":["10.16.0.0/16","192.168.1.1","::1"],"purge_interval":30000000000}`,
+		},
+		{
+			name: "replicas",
+			d: caddyfile.NewTestDispenser(`{
+                mirage {
+                  region us-east-1
+                  replica us-west-2
+                  replica eu-west-1 https://dynamodb.eu-west-1.amazonaws.com
+                  failover_threshold 5
+                  failover_latency 250ms
+                  failover_recovery 1m
+                }
+            }`),
+			want: `{"region":"us-east-1","replicas":[{"region":"us-west-2"},{"region":"eu-west-1","endpoint":"https://dynamodb.eu-west-1.amazonaws.com"}],"failover_threshold":5,"failover_latency":250000000,"failover_recovery":60000000000}`,
+		},
+		{
+			name: "credentials",
+			d: caddyfile.NewTestDispenser(`{
+                mirage {
+                  role_arn arn:aws:iam::123456789012:role/mirage-config
+                  external_id {env.MIRAGE_EXTERNAL_ID}
+                  session_name mirage-prod
+                  web_identity_token_file /var/run/secrets/token
+                }
+            }`),
+			want: `{"credentials":{"role_arn":"arn:aws:iam::123456789012:role/mirage-config","external_id":"{env.MIRAGE_EXTERNAL_ID}","session_name":"mirage-prod","web_identity_token_file":"/var/run/secrets/token"}}`,
+		},
+		{
+			name: "static credentials",
+			d: caddyfile.NewTestDispenser(`{
+                mirage {
+                  endpoint http://localhost:8000
+                  access_key_id local
+                  secret_access_key local
+                }
+            }`),
+			want: `{"endpoint":"http://localhost:8000","credentials":{"access_key_id":"local","secret_access_key":"local"}}`,
+		},
+		{
+			name: "profiles",
+			d: caddyfile.NewTestDispenser(`{
+                mirage {
+                  table MirageServerConfigProd
+                  profile partner {
+                    region us-west-2
+                    table PartnerRedirects
+                    key Domain
+                    cache_ttl 1m
+                  }
+                  profile staging {
+                    table StagingRedirects
+                  }
+                }
+            }`),
+			want: `{"table":"MirageServerConfigProd","profiles":{"partner":{"region":"us-west-2","table":"PartnerRedirects","key":"Domain","cache_ttl":60000000000},"staging":{"table":"StagingRedirects"}}}`,
+		},
+		{
+			name: "duplicate profile",
+			d: caddyfile.NewTestDispenser(`{
+                mirage {
+                  profile partner {
+                    table PartnerRedirects
+                  }
+                  profile partner {
+                    table OtherRedirects
+                  }
+                }
+            }`),
+			shouldErr: true,
+			err:       "duplicate profile 'partner'",
+		},
+		{
+			name: "invalid profile",
+			d: caddyfile.NewTestDispenser(`{
+                mirage {
+                  profile partner {
+                    replica us-west-2
+                  }
+                }
+            }`),
+			shouldErr: true,
+			err:       "unknown parameter 'replica' for profile 'partner'",
+		},
+		{
+			name: "invalid failover_threshold",
+			d: caddyfile.NewTestDispenser(`{
+                mirage {
+                  failover_threshold 0
+                }
+            }`),
+			shouldErr: true,
+			err:       "invalid value for 'failover_threshold': 0",
+		},
+		{
+			name: "invalid replica",
+			d: caddyfile.NewTestDispenser(`{
+                mirage {
+                  replica us-west-2 http://localhost:8000 extra
+                }
+            }`),
+			shouldErr: true,
+			err:       "wrong argument count or unexpected line ending after 'extra'",
+		},
+		{
+			name: "resilience",
+			d: caddyfile.NewTestDispenser(`{
+                mirage {
+                  lookup_timeout 500ms
+                  retry_max_attempts 2
+                  retry_max_backoff 100ms
+                  breaker_threshold 10
+                  breaker_cooldown 1m
+                }
+            }`),
+			want: `{"lookup_timeout":500000000,"retry_max_attempts":2,"retry_max_backoff":100000000,"breaker_threshold":10,"breaker_cooldown":60000000000}`,
+		},
+		{
+			name: "invalid retry_max_attempts",
+			d: caddyfile.NewTestDispenser(`{
+                mirage {
+                  retry_max_attempts many
+                }
+            }`),
+			shouldErr: true,
+			err:       "invalid value for 'retry_max_attempts': many",
+		},
+		{
+			name: "source",
+			d: caddyfile.NewTestDispenser(`{
+                mirage {
+                  source dynamodb {
+                    region us-west-2
+                    table Redirects
+                  }
+                }
+            }`),
+			want: `{"sources":[{"region":"us-west-2","source":"dynamodb","table":"Redirects"}]}`,
+		},
+		{
+			name: "layered sources",
+			d: caddyfile.NewTestDispenser(`{
+                mirage {
+                  source file /etc/mirage/overrides.yaml
+                  source dynamodb
+                  source file /etc/mirage/snapshot.json
+                  source_errors fall_through
+                }
+            }`),
+			want: `{"sources":[{"path":"/etc/mirage/overrides.yaml","source":"file"},{"source":"dynamodb"},{"path":"/etc/mirage/snapshot.json","source":"file"}],"source_errors":"fall_through"}`,
+		},
+		{
+			name: "unknown source",
+			d: caddyfile.NewTestDispenser(`{
+                mirage {
+                  source carrier_pigeon
+                }
+            }`),
+			shouldErr: true,
+			err:       "getting module named 'mirage.sources.carrier_pigeon'",
+		},
+		{
+			name: "invalid purge_allow",
+			d: caddyfile.NewTestDispenser(`{
+                mirage {
+                  purge_allow
+                }
+            }`),
+			shouldErr: true,
+			err:       "wrong argument count or unexpected line ending after 'purge_allow'",
+		},
+		{
+			name: "invalid duration",
+			d: caddyfile.NewTestDispenser(`{
+                mirage {
+                  cache_ttl forever
+                }
+            }`),
+			shouldErr: true,
+			err:       "invalid duration for 'cache_ttl'",
+		},
 		{
 			name: "invalid1",
 			d: caddyfile.NewTestDispenser(`{
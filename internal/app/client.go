@@ -0,0 +1,128 @@
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/CruGlobal/mirage-server/internal/dynamo"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// Replica is a further region or endpoint of a DynamoDB global table.
+type Replica struct {
+	// Region defaults to the app's region.
+	Region   string `json:"region,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+// name identifies the replica in logs and metrics.
+func (r Replica) name() string {
+	if r.Endpoint != "" {
+		return r.Endpoint
+	}
+	return r.Region
+}
+
+// provisionClient creates the DynamoDB client shared by the redirect sources
+// and certificate storage. With replicas configured it fails over between the
+// primary region and the replicas; certificate storage keeps its locks and
+// conditional writes on the primary.
+func (app *App) provisionClient(ctx caddy.Context, repl *caddy.Replacer) error {
+	app.Endpoint = repl.ReplaceAll(app.Endpoint, "")
+	for i, replica := range app.Replicas {
+		replica.Region = repl.ReplaceAll(replica.Region, app.Region)
+		replica.Endpoint = repl.ReplaceAll(replica.Endpoint, "")
+		app.Replicas[i] = replica
+	}
+
+	client, err := app.NewClient(ctx, app.Credentials)
+	if err != nil {
+		return err
+	}
+	app.Client = client
+	if len(app.Replicas) > 0 {
+		app.logger.Info("DynamoDB failover enabled", zap.Int("replicas", len(app.Replicas)+1))
+	}
+	return nil
+}
+
+// NewClient creates a DynamoDB client for the app's region, endpoint and
+// replicas that authenticates with creds instead of the app's credentials.
+// Modules overriding the credentials use it so they keep the app's failover
+// and retry settings; those relying on conditional writes should send them
+// to dynamo.Primary of the client.
+func (app *App) NewClient(ctx context.Context, creds *dynamo.Credentials) (dynamo.Client, error) {
+	if creds != nil {
+		replaceCredentials(creds, caddy.NewReplacer())
+	}
+	primary := Replica{Region: app.Region, Endpoint: app.Endpoint}
+	client, err := app.newClient(ctx, primary, creds)
+	if err != nil {
+		return nil, err
+	}
+	if len(app.Replicas) == 0 {
+		return client, nil
+	}
+
+	replicas := []dynamo.Replica{{Name: primary.name(), Client: client}}
+	for _, replica := range app.Replicas {
+		client, err = app.newClient(ctx, replica, creds)
+		if err != nil {
+			return nil, err
+		}
+		replicas = append(replicas, dynamo.Replica{Name: replica.name(), Client: client})
+	}
+	return dynamo.NewFailover(replicas,
+		dynamo.WithFailureThreshold(app.FailoverThreshold),
+		dynamo.WithLatencyThreshold(time.Duration(app.FailoverLatency)),
+		dynamo.WithRecoveryInterval(time.Duration(app.FailoverRecovery)),
+		dynamo.WithFailoverLogger(app.logger.Named("failover")),
+	), nil
+}
+
+// regionClient creates a DynamoDB client for a source or profile with its own
+// region or endpoint. The region defaults to the app's; the client does not
+// fail over, but keeps the app's credentials and retry settings.
+func (app *App) regionClient(ctx context.Context, region string, endpoint string) (*dynamodb.Client, error) {
+	if region == "" {
+		region = app.Region
+	}
+	return app.newClient(ctx, Replica{Region: region, Endpoint: endpoint}, app.Credentials)
+}
+
+func (app *App) newClient(ctx context.Context, replica Replica, creds *dynamo.Credentials) (*dynamodb.Client, error) {
+	cfg, err := creds.LoadConfig(ctx, replica.Region, replica.Endpoint, config.WithRetryer(app.newRetryer))
+	if err != nil {
+		return nil, err
+	}
+	return dynamodb.NewFromConfig(cfg), nil
+}
+
+// replaceCredentials expands placeholders such as {env.AWS_ROLE_ARN}.
+func replaceCredentials(creds *dynamo.Credentials, repl *caddy.Replacer) {
+	creds.Profile = repl.ReplaceAll(creds.Profile, "")
+	creds.RoleARN = repl.ReplaceAll(creds.RoleARN, "")
+	creds.ExternalID = repl.ReplaceAll(creds.ExternalID, "")
+	creds.SessionName = repl.ReplaceAll(creds.SessionName, "")
+	creds.WebIdentityTokenFile = repl.ReplaceAll(creds.WebIdentityTokenFile, "")
+	creds.AccessKeyID = repl.ReplaceAll(creds.AccessKeyID, "")
+	creds.SecretAccessKey = repl.ReplaceAll(creds.SecretAccessKey, "")
+	creds.SessionToken = repl.ReplaceAll(creds.SessionToken, "")
+}
+
+// newRetryer applies the retry settings to the AWS client's standard retryer.
+func (app *App) newRetryer() aws.Retryer {
+	return retry.NewStandard(func(options *retry.StandardOptions) {
+		if app.RetryMaxAttempts > 0 {
+			options.MaxAttempts = app.RetryMaxAttempts
+		}
+		if app.RetryMaxBackoff > 0 {
+			options.MaxBackoff = time.Duration(app.RetryMaxBackoff)
+		}
+	})
+}
@@ -1,9 +1,18 @@
 package app
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
 	"github.com/CruGlobal/mirage-server/internal/cache"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/CruGlobal/mirage-server/internal/dynamo"
+	"github.com/CruGlobal/mirage-server/internal/metrics"
+	"github.com/CruGlobal/mirage-server/internal/purge"
+	"github.com/CruGlobal/mirage-server/internal/source"
 	"github.com/caddyserver/caddy/v2"
 	"go.uber.org/zap"
 )
@@ -13,13 +22,19 @@ const (
 	DefaultRegion = "us-east-1"
 	DefaultTable  = "MirageServerConfigProd"
 	DefaultKey    = "Hostname"
+
+	DefaultLookupTimeout = 2 * time.Second
+
+	SourceErrorsStop        = "stop"
+	SourceErrorsFallThrough = "fall_through"
 )
 
 var (
 	// Interface guards.
-	_ caddy.Provisioner = (*App)(nil)
-	_ caddy.Module      = (*App)(nil)
-	_ caddy.App         = (*App)(nil)
+	_ caddy.Provisioner  = (*App)(nil)
+	_ caddy.Module       = (*App)(nil)
+	_ caddy.App          = (*App)(nil)
+	_ caddy.CleanerUpper = (*App)(nil)
 )
 
 func init() {
@@ -28,15 +43,94 @@ func init() {
 
 // App implements mirage.
 type App struct {
-	Name   string               `json:"-"`
-	Client *dynamodb.Client     `json:"-"`
-	Cache  *cache.RedirectCache `json:"-"`
-	logger *zap.Logger
+	Name    string                `json:"-"`
+	Client  dynamo.Client         `json:"-"`
+	Breaker *dynamo.Breaker       `json:"-"`
+	Cache   *cache.RedirectCache  `json:"-"`
+	Purge   *purge.Authorizer     `json:"-"`
+	Source  source.RedirectSource `json:"-"`
+	logger  *zap.Logger
+
+	cacheKey   *cacheKey
+	stopWatch  context.CancelFunc
+	watchGroup *sync.WaitGroup
+
+	// LookupTimeout bounds each redirect lookup, including retries. Defaults
+	// to 2s.
+	LookupTimeout caddy.Duration `json:"lookup_timeout,omitempty"`
+	// RetryMaxAttempts is how many times the AWS client attempts a call,
+	// including the first. Defaults to the SDK's 3.
+	RetryMaxAttempts int `json:"retry_max_attempts,omitempty"`
+	// RetryMaxBackoff caps the delay between attempts. Defaults to the SDK's
+	// 20s, so the lookup timeout normally applies first.
+	RetryMaxBackoff caddy.Duration `json:"retry_max_backoff,omitempty"`
+	// BreakerThreshold is how many consecutive failed lookups open the
+	// circuit breaker. Defaults to 5.
+	BreakerThreshold int `json:"breaker_threshold,omitempty"`
+	// BreakerCooldown is how long the breaker stays open before a trial
+	// lookup is let through. Defaults to 30s.
+	BreakerCooldown caddy.Duration `json:"breaker_cooldown,omitempty"`
+
+	// SourcesRaw lists redirect source modules in priority order; the first
+	// source with a record for a hostname answers. It defaults to DynamoDB
+	// using the region, endpoint, table and key below.
+	SourcesRaw []json.RawMessage `json:"sources,omitempty" caddy:"namespace=mirage.sources inline_key=source"`
+	// SourceErrors is "stop" to fail a lookup when a source errors, or
+	// "fall_through" to try the next source instead. Defaults to "stop".
+	SourceErrors string `json:"source_errors,omitempty"`
 
 	Region   string `json:"region,omitempty"`
 	Endpoint string `json:"endpoint,omitempty"`
 	Table    string `json:"table,omitempty"`
 	Key      string `json:"key,omitempty"`
+	// AutoCreate creates the tables of DynamoDB sources and profiles that do
+	// not exist when the app is provisioned. Existing tables are checked to
+	// be keyed by their key either way. Tables are created in the active
+	// region only, so global tables with replicas are still set up
+	// beforehand.
+	AutoCreate bool `json:"auto_create,omitempty"`
+
+	// Credentials configures how the DynamoDB clients authenticate, for
+	// example by assuming a cross-account role, including those of sources
+	// and profiles with their own region or endpoint. Defaults to the SDK's
+	// credential chain.
+	Credentials *dynamo.Credentials `json:"credentials,omitempty"`
+
+	// Profiles are further named tables, each with its own key and cache,
+	// that handlers and the TLS permission can choose instead of the
+	// default sources.
+	Profiles map[string]*Profile `json:"profiles,omitempty"`
+
+	// Replicas lists further regions or endpoints of a global table, in the
+	// order lookups fail over to them when the primary region is unhealthy.
+	Replicas []Replica `json:"replicas,omitempty"`
+	// FailoverThreshold is how many consecutive failed or slow calls switch to
+	// the next replica. Defaults to 3.
+	FailoverThreshold int `json:"failover_threshold,omitempty"`
+	// FailoverLatency counts calls slower than this as failures. Zero only
+	// counts errors.
+	FailoverLatency caddy.Duration `json:"failover_latency,omitempty"`
+	// FailoverRecovery is how often the primary is probed after failing over.
+	// Defaults to 30s.
+	FailoverRecovery caddy.Duration `json:"failover_recovery,omitempty"`
+
+	// CacheTTL is how long a redirect is served from the cache before it is
+	// looked up again. Zero keeps redirects until they are evicted or purged.
+	CacheTTL caddy.Duration `json:"cache_ttl,omitempty"`
+	// CacheNegativeTTL is how long a hostname without a redirect is remembered.
+	// Zero looks up unknown hostnames on every request.
+	CacheNegativeTTL caddy.Duration `json:"cache_negative_ttl,omitempty"`
+	// CacheSnapshot is an optional file the last-known-good redirects are
+	// persisted to and loaded from on startup.
+	CacheSnapshot         string         `json:"cache_snapshot,omitempty"`
+	CacheSnapshotInterval caddy.Duration `json:"cache_snapshot_interval,omitempty"`
+
+	// PurgeSecret signs purge_cache tokens, see purge.Token.
+	PurgeSecret string `json:"purge_secret,omitempty"`
+	// PurgeAllow lists client IPs or CIDR ranges that may purge without a token.
+	PurgeAllow []string `json:"purge_allow,omitempty"`
+	// PurgeInterval is the minimum time between purges of the same hostname.
+	PurgeInterval caddy.Duration `json:"purge_interval,omitempty"`
 }
 
 func NewApp() *App {
@@ -70,35 +164,244 @@ func (app *App) Provision(ctx caddy.Context) error {
 		zap.String("app", app.Name),
 	)
 
-	cfg, err := config.LoadDefaultConfig(
-		ctx,
-		config.WithRegion(app.Region),
-		config.WithBaseEndpoint(app.Endpoint),
-	)
+	if app.LookupTimeout == 0 {
+		app.LookupTimeout = caddy.Duration(DefaultLookupTimeout)
+	}
+	err := app.provisionClient(ctx, repl)
+	if err != nil {
+		return err
+	}
+	app.Breaker = dynamo.NewBreaker(AppName, app.BreakerThreshold, time.Duration(app.BreakerCooldown))
+
+	if err = metrics.Register(ctx.GetMetricsRegistry()); err != nil {
+		return err
+	}
+
+	// Loading the sources clears their raw config
+	sources, err := sourcesID(app.SourcesRaw)
+	if err != nil {
+		return err
+	}
+	if err = app.provisionSources(ctx); err != nil {
+		return err
+	}
+
+	app.PurgeSecret = repl.ReplaceAll(app.PurgeSecret, "")
+	if app.PurgeInterval == 0 {
+		app.PurgeInterval = caddy.Duration(purge.DefaultInterval)
+	}
+	app.Purge, err = purge.NewAuthorizer(app.PurgeSecret, app.PurgeAllow, time.Duration(app.PurgeInterval))
 	if err != nil {
 		return err
 	}
-	app.Client = dynamodb.NewFromConfig(cfg)
 
-	app.Cache = cache.NewRedirectCache()
+	app.CacheSnapshot = repl.ReplaceAll(app.CacheSnapshot, "")
+	key := cacheKey{
+		Table:            app.Table,
+		Key:              app.Key,
+		Sources:          sources,
+		Region:           app.Region,
+		Endpoint:         app.Endpoint,
+		Replicas:         replicasID(app.Replicas),
+		TTL:              time.Duration(app.CacheTTL),
+		NegativeTTL:      time.Duration(app.CacheNegativeTTL),
+		Snapshot:         app.CacheSnapshot,
+		SnapshotInterval: time.Duration(app.CacheSnapshotInterval),
+	}
+	var loaded bool
+	app.Cache, loaded, err = loadCache(key, cache.DefaultName, app.logger)
+	if err != nil {
+		return err
+	}
+	app.cacheKey = &key
+	if loaded {
+		app.logger.Info("reusing redirect cache from previous config")
+	}
+
+	return app.provisionProfiles(ctx, repl)
+}
+
+func (app *App) provisionSources(ctx caddy.Context) error {
+	var fallThrough bool
+	switch app.SourceErrors {
+	case "", SourceErrorsStop:
+	case SourceErrorsFallThrough:
+		fallThrough = true
+	default:
+		return fmt.Errorf("unknown source_errors value: %s", app.SourceErrors)
+	}
+
+	if app.SourcesRaw == nil {
+		ddb := &source.DynamoDB{}
+		app.configureDynamoDB(ddb, "dynamodb")
+		if err := app.ensureTable(ctx, ddb); err != nil {
+			return err
+		}
+		app.Source = source.NewLayered([]source.Layer{{Name: "dynamodb", Source: ddb}}, fallThrough)
+		return nil
+	}
+
+	modules, err := ctx.LoadModule(app, "SourcesRaw")
+	if err != nil {
+		return fmt.Errorf("loading redirect sources: %w", err)
+	}
+
+	names := make(map[string]int)
+	var layers []source.Layer
+	for i, module := range modules.([]any) { //nolint:errcheck // LoadModule returns []any for slices
+		src, ok := module.(source.RedirectSource)
+		if !ok {
+			return fmt.Errorf("unexpected module type: %T", module)
+		}
+
+		// Name layers after their module, numbering repeats by position
+		name := module.(caddy.Module).CaddyModule().ID.Name() //nolint:errcheck // loaded modules are caddy.Module
+		names[name]++
+		if names[name] > 1 {
+			name = fmt.Sprintf("%s#%d", name, i+1)
+		}
+
+		if ddb, isDynamoDB := src.(*source.DynamoDB); isDynamoDB {
+			if ddb.Region != "" || ddb.Endpoint != "" {
+				client, err := app.regionClient(ctx, ddb.Region, ddb.Endpoint)
+				if err != nil {
+					return fmt.Errorf("source %s: %w", name, err)
+				}
+				ddb.Client = client
+			}
+			app.configureDynamoDB(ddb, name)
+			if err = app.ensureTable(ctx, ddb); err != nil {
+				return err
+			}
+		}
+		layers = append(layers, source.Layer{Name: name, Source: src})
+	}
+	app.Source = source.NewLayered(layers, fallThrough)
+	return nil
+}
+
+// TableSource returns a DynamoDB source for table that shares the app's
+// client, key and lookup settings.
+func (app *App) TableSource(table string) source.RedirectSource {
+	ddb := &source.DynamoDB{Table: table}
+	app.configureDynamoDB(ddb, "dynamodb")
+	return source.NewLayered([]source.Layer{{Name: "dynamodb", Source: ddb}}, false)
+}
+
+// ClientSource returns a DynamoDB source for table and key that looks
+// redirects up with client, for modules that override the app's credentials.
+func (app *App) ClientSource(name string, client dynamo.Client, table string, key string) source.RedirectSource {
+	ddb := &source.DynamoDB{Client: client, Table: table, Key: key}
+	app.configureDynamoDB(ddb, name)
+	return source.NewLayered([]source.Layer{{Name: name, Source: ddb}}, false)
+}
+
+// configureDynamoDB fills in a DynamoDB source's unset settings. A source
+// without its own region or endpoint shares the app's client and breaker;
+// one with its own client gets a breaker of its own.
+func (app *App) configureDynamoDB(ddb *source.DynamoDB, name string) {
+	if ddb.Client == nil {
+		ddb.Client = app.Client
+		ddb.Breaker = app.Breaker
+	}
+	if ddb.Breaker == nil {
+		ddb.Breaker = dynamo.NewBreaker(name, app.BreakerThreshold, time.Duration(app.BreakerCooldown))
+	}
+	if ddb.Table == "" {
+		ddb.Table = app.Table
+	}
+	if ddb.Key == "" {
+		ddb.Key = app.Key
+	}
+	if ddb.Timeout == 0 {
+		ddb.Timeout = app.LookupTimeout
+	}
+}
+
+// ensureTable checks that the table of a DynamoDB source is keyed by its
+// key, creating it first if AutoCreate is set, see source.DynamoDB.EnsureTable.
+// Without AutoCreate only a table keyed otherwise fails provisioning; a
+// missing or unreachable table is logged, as lookups report it too.
+func (app *App) ensureTable(ctx context.Context, ddb *source.DynamoDB) error {
+	if app.AutoCreate {
+		created, err := ddb.EnsureTable(ctx)
+		if err != nil {
+			return err
+		}
+		if created {
+			app.logger.Info("created redirect table", zap.String("table", ddb.Table), zap.String("key", ddb.Key))
+		}
+		return nil
+	}
 
+	err := ddb.CheckTable(ctx)
+	switch {
+	case err == nil:
+	case errors.Is(err, dynamo.ErrKeySchema):
+		return err
+	case dynamo.IsTableNotFound(err):
+		app.logger.Warn("redirect table does not exist, set auto_create to create it",
+			zap.String("table", ddb.Table))
+	default:
+		app.logger.Warn("unable to check redirect table", zap.String("table", ddb.Table), zap.Error(err))
+	}
 	return nil
 }
 
-func (app App) Start() error {
+// Cleanup releases the redirect caches, stopping them if no newer config uses
+// them.
+func (app *App) Cleanup() error {
+	if err := app.cleanupProfiles(); err != nil {
+		return err
+	}
+	if app.cacheKey == nil {
+		return nil
+	}
+	_, err := caches.Delete(*app.cacheKey)
+	app.cacheKey = nil
+	return err
+}
+
+func (app *App) Start() error {
+	if app.Source == nil || app.Cache == nil {
+		return errors.New("mirage has not been provisioned")
+	}
+
+	// Invalidate cached redirects as the source reports changes
+	ctx, cancel := context.WithCancel(context.Background())
+	app.stopWatch = cancel
+	app.watchGroup = &sync.WaitGroup{}
+	app.watchGroup.Add(1)
+	go func() {
+		defer app.watchGroup.Done()
+		err := app.Source.Watch(ctx, func(hostnames ...string) {
+			for _, hostname := range hostnames {
+				app.Cache.Delete(hostname)
+			}
+			app.logger.Debug("source changed", zap.Strings("hostnames", hostnames))
+		})
+		if err != nil && !errors.Is(err, context.Canceled) {
+			app.logger.Error("watching redirect source", zap.Error(err))
+		}
+	}()
+
 	app.logger.Debug(
 		"started app instance",
 		zap.String("app", app.Name),
 	)
-	app.Cache.Start()
 	return nil
 }
 
-func (app App) Stop() error {
+func (app *App) Stop() error {
+	if app.stopWatch != nil {
+		app.stopWatch()
+		app.watchGroup.Wait()
+		app.stopWatch = nil
+	}
+
 	app.logger.Debug(
 		"stopped app instance",
 		zap.String("app", app.Name),
 	)
-	app.Cache.Stop()
 	return nil
 }
@@ -0,0 +1,276 @@
+package app_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/CruGlobal/mirage-server/internal/app"
+	"github.com/CruGlobal/mirage-server/internal/dynamo"
+	"github.com/CruGlobal/mirage-server/internal/source"
+	"github.com/CruGlobal/mirage-server/miragetest"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApp_NewApp(t *testing.T) {
+	a := app.NewApp()
+	assert.NotNil(t, a)
+	assert.Equal(t, app.DefaultRegion, a.Region)
+	assert.Equal(t, app.DefaultTable, a.Table)
+	assert.Equal(t, app.DefaultKey, a.Key)
+}
+
+func TestApp_CacheHandover(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+
+	provision := func(ttl caddy.Duration) *app.App {
+		a := app.NewApp()
+		a.Endpoint = miragetest.ClosedEndpoint
+		a.CacheTTL = ttl
+		require.NoError(t, a.Provision(ctx))
+		return a
+	}
+
+	// A reload with compatible settings reuses the running cache
+	previous := provision(caddy.Duration(0))
+	next := provision(caddy.Duration(0))
+	assert.Same(t, previous.Cache, next.Cache)
+
+	// Incompatible settings get a cache of their own
+	other := provision(caddy.Duration(1))
+	assert.NotSame(t, previous.Cache, other.Cache)
+
+	// So do redirects read from another table, other sources or other regions
+	table := app.NewApp()
+	table.Endpoint = miragetest.ClosedEndpoint
+	table.Table = "MirageServerConfigStage"
+	require.NoError(t, table.Provision(ctx))
+	assert.NotSame(t, previous.Cache, table.Cache)
+	sources := app.NewApp()
+	sources.Endpoint = miragetest.ClosedEndpoint
+	sources.SourcesRaw = []json.RawMessage{json.RawMessage(`{"source":"dynamodb","table":"MirageServerConfigStage"}`)}
+	require.NoError(t, sources.Provision(ctx))
+	assert.NotSame(t, previous.Cache, sources.Cache)
+	assert.NotSame(t, table.Cache, sources.Cache)
+	region := app.NewApp()
+	region.Endpoint = miragetest.ClosedEndpoint
+	region.Region = "us-west-2"
+	require.NoError(t, region.Provision(ctx))
+	assert.NotSame(t, previous.Cache, region.Cache)
+	replicas := app.NewApp()
+	replicas.Endpoint = miragetest.ClosedEndpoint
+	replicas.Replicas = []app.Replica{{Region: "us-west-2", Endpoint: miragetest.ClosedEndpoint}}
+	require.NoError(t, replicas.Provision(ctx))
+	assert.NotSame(t, previous.Cache, replicas.Cache)
+	require.NoError(t, table.Cleanup())
+	require.NoError(t, sources.Cleanup())
+	require.NoError(t, region.Cleanup())
+	require.NoError(t, replicas.Cleanup())
+
+	// Cleaning up the previous instance leaves the handed over cache usable
+	require.NoError(t, previous.Cleanup())
+	require.NoError(t, previous.Cleanup())
+	last := provision(caddy.Duration(0))
+	assert.Same(t, next.Cache, last.Cache)
+
+	require.NoError(t, next.Cleanup())
+	require.NoError(t, last.Cleanup())
+	require.NoError(t, other.Cleanup())
+}
+
+func TestApp_Sources(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+
+	dir := t.TempDir()
+	overrides := filepath.Join(dir, "overrides.json")
+	snapshot := filepath.Join(dir, "snapshot.json")
+	require.NoError(t, os.WriteFile(overrides, []byte(`[{"Hostname": "example.org", "Location": "override.example.org"}]`), 0o600))
+	require.NoError(t, os.WriteFile(snapshot, []byte(`[{"Hostname": "example.org", "Location": "www.example.org"}]`), 0o600))
+
+	a := app.NewApp()
+	a.Endpoint = miragetest.ClosedEndpoint
+	a.Table = "Redirects"
+	a.SourceErrors = app.SourceErrorsFallThrough
+	a.SourcesRaw = []json.RawMessage{
+		json.RawMessage(`{"source": "file", "path": "` + overrides + `"}`),
+		json.RawMessage(`{"source": "dynamodb"}`),
+		json.RawMessage(`{"source": "file", "path": "` + snapshot + `"}`),
+	}
+	require.NoError(t, a.Provision(ctx))
+	defer a.Cleanup() //nolint:errcheck // test cleanup
+
+	require.IsType(t, &source.Layered{}, a.Source)
+	layers := a.Source.(*source.Layered).Layers()
+	require.Len(t, layers, 3)
+	assert.Equal(t, "file", layers[0].Name)
+	assert.Equal(t, "dynamodb", layers[1].Name)
+	assert.Equal(t, "file#3", layers[2].Name)
+
+	// DynamoDB sources share the app's client and settings
+	ddb := layers[1].Source.(*source.DynamoDB)
+	assert.Same(t, a.Client, ddb.Client)
+	assert.Equal(t, "Redirects", ddb.Table)
+	assert.Equal(t, app.DefaultKey, ddb.Key)
+
+	r, err := a.Source.Lookup(t.Context(), "example.org")
+	require.NoError(t, err)
+	assert.Equal(t, "override.example.org", r.Location)
+	assert.Equal(t, "file", r.Source)
+}
+
+func TestApp_SourceClient(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+
+	a := app.NewApp()
+	a.Endpoint = miragetest.ClosedEndpoint
+	a.RetryMaxAttempts = 7
+	a.LookupTimeout = caddy.Duration(time.Second)
+	a.SourcesRaw = []json.RawMessage{
+		json.RawMessage(`{"source": "dynamodb", "region": "us-west-2", "endpoint": "` + miragetest.ClosedEndpoint + `"}`),
+	}
+	require.NoError(t, a.Provision(ctx))
+	defer a.Cleanup() //nolint:errcheck // test cleanup
+
+	// A source with its own region gets a client of its own, with the app's
+	// retry and lookup settings
+	ddb := a.Source.(*source.Layered).Layers()[0].Source.(*source.DynamoDB)
+	require.IsType(t, &dynamodb.Client{}, ddb.Client)
+	assert.NotSame(t, a.Client, ddb.Client)
+	options := ddb.Client.(*dynamodb.Client).Options()
+	assert.Equal(t, "us-west-2", options.Region)
+	assert.Equal(t, 7, options.Retryer.MaxAttempts())
+	assert.NotNil(t, ddb.Breaker)
+	assert.NotSame(t, a.Breaker, ddb.Breaker)
+	assert.Equal(t, a.LookupTimeout, ddb.Timeout)
+}
+
+func TestApp_SourceErrors(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+
+	a := app.NewApp()
+	a.SourceErrors = "ignore"
+	require.ErrorContains(t, a.Provision(ctx), "unknown source_errors value: ignore")
+}
+
+func TestApp_Replicas(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+
+	a := app.NewApp()
+	a.Replicas = []app.Replica{
+		{Region: "us-west-2"},
+		{Endpoint: "http://localhost:8000"},
+	}
+	require.NoError(t, a.Provision(ctx))
+	defer a.Cleanup() //nolint:errcheck // test cleanup
+
+	require.IsType(t, &dynamo.Failover{}, a.Client)
+	failover := a.Client.(*dynamo.Failover)
+	assert.Equal(t, "us-east-1", failover.Active())
+
+	var names []string
+	for _, replica := range failover.Replicas() {
+		names = append(names, replica.Name)
+	}
+	assert.Equal(t, []string{"us-east-1", "us-west-2", "http://localhost:8000"}, names)
+
+	// The default source looks redirects up through the failover client
+	assert.Same(t, failover, miragetest.DynamoDBSource(t, a.Source).Client)
+}
+
+func TestApp_Profiles(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+
+	a := app.NewApp()
+	a.CacheTTL = caddy.Duration(time.Minute)
+	a.Profiles = map[string]*app.Profile{
+		"partner": {Table: "PartnerRedirects", Key: "Domain"},
+		"staging": {Endpoint: "http://localhost:8000", Table: "StagingRedirects"},
+	}
+	require.NoError(t, a.Provision(ctx))
+	defer a.Cleanup() //nolint:errcheck // test cleanup
+
+	partner, err := a.Profile("partner")
+	require.NoError(t, err)
+	ddb := miragetest.DynamoDBSource(t, partner.Source)
+	assert.Equal(t, "PartnerRedirects", ddb.Table)
+	assert.Equal(t, "Domain", ddb.Key)
+	assert.Same(t, a.Client, ddb.Client, "profiles without a region or endpoint share the app client")
+	assert.Same(t, a.Breaker, ddb.Breaker)
+	assert.Equal(t, caddy.Duration(time.Minute), partner.CacheTTL)
+	assert.NotSame(t, a.Cache, partner.Cache)
+
+	staging, err := a.Profile("staging")
+	require.NoError(t, err)
+	ddb = miragetest.DynamoDBSource(t, staging.Source)
+	assert.Equal(t, "Hostname", ddb.Key)
+	assert.Equal(t, "us-east-1", staging.Region)
+	assert.NotSame(t, a.Client, ddb.Client)
+	assert.NotSame(t, a.Breaker, ddb.Breaker)
+	assert.NotSame(t, partner.Cache, staging.Cache)
+
+	_, err = a.Profile("unknown")
+	require.ErrorContains(t, err, "unknown mirage profile: unknown")
+
+	// A reload pointing the profile at another table gets a cache of its own
+	reload := app.NewApp()
+	reload.CacheTTL = caddy.Duration(time.Minute)
+	reload.Profiles = map[string]*app.Profile{
+		"partner": {Table: "PartnerRedirectsV2", Key: "Domain"},
+	}
+	require.NoError(t, reload.Provision(ctx))
+	defer reload.Cleanup() //nolint:errcheck // test cleanup
+	moved, err := reload.Profile("partner")
+	require.NoError(t, err)
+	assert.NotSame(t, partner.Cache, moved.Cache)
+}
+
+func TestApp_ProfileWithoutTable(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+
+	a := app.NewApp()
+	a.Profiles = map[string]*app.Profile{"partner": {Key: "Domain"}}
+	err := a.Provision(ctx)
+	defer a.Cleanup() //nolint:errcheck // test cleanup
+	require.ErrorContains(t, err, "profile partner: table is required")
+}
+
+func TestApp_Credentials(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	defer cancel()
+
+	t.Setenv("MIRAGE_SECRET_KEY", "local-secret")
+	a := app.NewApp()
+	a.Endpoint = "http://localhost:8000"
+	a.Credentials = &dynamo.Credentials{AccessKeyID: "local", SecretAccessKey: "{env.MIRAGE_SECRET_KEY}"}
+	a.SourcesRaw = []json.RawMessage{
+		json.RawMessage(`{"source": "dynamodb", "region": "us-west-2", "endpoint": "` + miragetest.ClosedEndpoint + `"}`),
+	}
+	require.NoError(t, a.Provision(ctx))
+	defer a.Cleanup() //nolint:errcheck // test cleanup
+	assert.Equal(t, "local-secret", a.Credentials.SecretAccessKey)
+
+	// Sources with their own region authenticate with the app's credentials
+	ddb := a.Source.(*source.Layered).Layers()[0].Source.(*source.DynamoDB)
+	creds, err := ddb.Client.(*dynamodb.Client).Options().Credentials.Retrieve(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, "local", creds.AccessKeyID)
+	assert.Equal(t, "local-secret", creds.SecretAccessKey)
+
+	a = app.NewApp()
+	a.Credentials = &dynamo.Credentials{WebIdentityTokenFile: "/var/run/secrets/token"}
+	err = a.Provision(ctx)
+	defer a.Cleanup() //nolint:errcheck // test cleanup
+	require.ErrorContains(t, err, "web_identity_token_file requires role_arn")
+}
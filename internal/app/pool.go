@@ -0,0 +1,147 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/CruGlobal/mirage-server/internal/cache"
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// caches holds the redirect caches in use by mirage app instances. A config
+// reload provisions the new app before the old one is cleaned up, so a cache
+// with compatible settings is handed over instead of starting cold.
+//
+//nolint:gochecknoglobals // shared across config reloads by design
+var caches = caddy.NewUsagePool()
+
+// cacheKey identifies caches with compatible settings.
+type cacheKey struct {
+	// Profile is set for the caches of named profiles.
+	Profile string
+	// Table and Key are those the cached redirects were looked up by, and
+	// Sources identifies the configured sources, see sourcesID, so a reload
+	// that reads redirects from elsewhere starts with a cache of its own.
+	Table   string
+	Key     string
+	Sources string
+	// Region, Endpoint and Replicas, see replicasID, are those of the table,
+	// as tables in different regions or accounts may share a name.
+	Region           string
+	Endpoint         string
+	Replicas         string
+	TTL              time.Duration
+	NegativeTTL      time.Duration
+	Snapshot         string
+	SnapshotInterval time.Duration
+}
+
+// sourcesID identifies the configuration of redirect sources by its hash.
+func sourcesID(sources []json.RawMessage) (string, error) {
+	if sources == nil {
+		return "", nil
+	}
+	config, err := json.Marshal(sources)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(config)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// replicasID identifies replicas by their names, in priority order.
+func replicasID(replicas []Replica) string {
+	names := make([]string, 0, len(replicas))
+	for _, replica := range replicas {
+		names = append(names, replica.name())
+	}
+	return strings.Join(names, ",")
+}
+
+// pooledCache starts the cache once when it enters the pool and stops it,
+// along with its snapshot goroutine, when the last app using it is cleaned up.
+type pooledCache struct {
+	*cache.RedirectCache
+
+	name string
+}
+
+func (pc pooledCache) Destruct() error {
+	pc.RedirectCache.Stop()
+	return nil
+}
+
+// loadCache returns the cache for key, creating it under name, which labels
+// its metrics, if no app uses one yet.
+func loadCache(key cacheKey, name string, logger *zap.Logger) (*cache.RedirectCache, bool, error) {
+	value, loaded, err := caches.LoadOrNew(key, func() (caddy.Destructor, error) {
+		c := cache.NewRedirectCache(
+			cache.WithTTL(key.TTL),
+			cache.WithNegativeTTL(key.NegativeTTL),
+			cache.WithSnapshot(key.Snapshot, key.SnapshotInterval),
+			cache.WithName(name),
+			cache.WithLogger(logger),
+		)
+		c.Start()
+		return pooledCache{RedirectCache: c, name: name}, nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return value.(pooledCache).RedirectCache, loaded, nil //nolint:errcheck // pool only holds pooledCache
+}
+
+// TableCache returns a redirect cache for a handler that looks redirects up in
+// table instead of the app's sources, so records from different tables never
+// mix. It uses the app's cache settings without a snapshot. Call release once
+// the handler is cleaned up.
+func (app *App) TableCache(table string) (*cache.RedirectCache, func() error, error) {
+	if app.cacheKey == nil {
+		return nil, nil, errors.New("mirage has not been provisioned")
+	}
+	key := *app.cacheKey
+	key.Table = table
+	key.Sources = ""
+	key.Snapshot = ""
+	key.SnapshotInterval = 0
+
+	c, _, err := loadCache(key, "table/"+table, app.logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	release := func() error {
+		_, err := caches.Delete(key)
+		return err
+	}
+	return c, release, nil
+}
+
+// namedCaches returns the pooled caches created under name, see loadCache.
+// More than one is live while a reload changes their settings.
+func namedCaches(name string) []*cache.RedirectCache {
+	var named []*cache.RedirectCache
+	caches.Range(func(_, value any) bool {
+		if pc, ok := value.(pooledCache); ok && pc.name == name {
+			named = append(named, pc.RedirectCache)
+		}
+		return true
+	})
+	return named
+}
+
+// pooledCaches returns every live pooled cache.
+func pooledCaches() []*cache.RedirectCache {
+	var pooled []*cache.RedirectCache
+	caches.Range(func(_, value any) bool {
+		if pc, ok := value.(pooledCache); ok {
+			pooled = append(pooled, pc.RedirectCache)
+		}
+		return true
+	})
+	return pooled
+}
@@ -0,0 +1,117 @@
+package app
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/CruGlobal/mirage-server/internal/cache"
+	"github.com/CruGlobal/mirage-server/internal/source"
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Profile is a named redirect table served alongside the app's own sources,
+// for example a partner's domains kept in a table of their own. Handlers and
+// the TLS permission choose a profile by name.
+type Profile struct {
+	Source source.RedirectSource `json:"-"`
+	Cache  *cache.RedirectCache  `json:"-"`
+
+	cacheKey *cacheKey
+
+	// Region and Endpoint default to the app's. A profile setting neither
+	// shares the app's client, including its replicas and breaker.
+	Region   string `json:"region,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+	// Table is required.
+	Table string `json:"table,omitempty"`
+	// Key defaults to Hostname.
+	Key string `json:"key,omitempty"`
+
+	// CacheTTL and CacheNegativeTTL default to the app's.
+	CacheTTL         caddy.Duration `json:"cache_ttl,omitempty"`
+	CacheNegativeTTL caddy.Duration `json:"cache_negative_ttl,omitempty"`
+}
+
+// provisionProfiles gives each profile a DynamoDB source and a cache of its
+// own. It runs once the app's client and breaker are set up.
+func (app *App) provisionProfiles(ctx caddy.Context, repl *caddy.Replacer) error {
+	for name, profile := range app.Profiles {
+		if profile == nil {
+			return fmt.Errorf("profile %s: not configured", name)
+		}
+		profile.Region = repl.ReplaceAll(profile.Region, "")
+		profile.Endpoint = repl.ReplaceAll(profile.Endpoint, "")
+		profile.Table = repl.ReplaceAll(profile.Table, "")
+		profile.Key = repl.ReplaceAll(profile.Key, DefaultKey)
+		if profile.Table == "" {
+			return fmt.Errorf("profile %s: table is required", name)
+		}
+
+		ddb := &source.DynamoDB{Table: profile.Table, Key: profile.Key}
+		if profile.Region != "" || profile.Endpoint != "" {
+			if profile.Region == "" {
+				profile.Region = app.Region
+			}
+			client, err := app.regionClient(ctx, profile.Region, profile.Endpoint)
+			if err != nil {
+				return fmt.Errorf("profile %s: %w", name, err)
+			}
+			ddb.Client = client
+		}
+		app.configureDynamoDB(ddb, name)
+		if err := app.ensureTable(ctx, ddb); err != nil {
+			return fmt.Errorf("profile %s: %w", name, err)
+		}
+		profile.Source = source.NewLayered([]source.Layer{{Name: name, Source: ddb}}, false)
+
+		if profile.CacheTTL == 0 {
+			profile.CacheTTL = app.CacheTTL
+		}
+		if profile.CacheNegativeTTL == 0 {
+			profile.CacheNegativeTTL = app.CacheNegativeTTL
+		}
+		key := cacheKey{
+			Profile:     name,
+			Table:       profile.Table,
+			Key:         profile.Key,
+			Region:      profile.Region,
+			Endpoint:    profile.Endpoint,
+			TTL:         time.Duration(profile.CacheTTL),
+			NegativeTTL: time.Duration(profile.CacheNegativeTTL),
+		}
+		if profile.Region == "" && profile.Endpoint == "" {
+			// The profile shares the app's client
+			key.Region, key.Endpoint, key.Replicas = app.Region, app.Endpoint, replicasID(app.Replicas)
+		}
+		c, _, err := loadCache(key, "profile/"+name, app.logger)
+		if err != nil {
+			return err
+		}
+		profile.Cache = c
+		profile.cacheKey = &key
+	}
+	return nil
+}
+
+// Profile returns the named profile, or an error if it is not configured.
+func (app *App) Profile(name string) (*Profile, error) {
+	profile, ok := app.Profiles[name]
+	if !ok || profile == nil || profile.Source == nil {
+		return nil, fmt.Errorf("unknown mirage profile: %s", name)
+	}
+	return profile, nil
+}
+
+// cleanupProfiles releases the profiles' caches.
+func (app *App) cleanupProfiles() error {
+	for _, profile := range app.Profiles {
+		if profile == nil || profile.cacheKey == nil {
+			continue
+		}
+		if _, err := caches.Delete(*profile.cacheKey); err != nil {
+			return err
+		}
+		profile.cacheKey = nil
+	}
+	return nil
+}
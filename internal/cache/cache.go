@@ -1,58 +1,246 @@
 package cache
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sync"
+	"time"
 
+	"github.com/CruGlobal/mirage-server/internal/metrics"
 	"github.com/CruGlobal/mirage-server/internal/redirect"
 	"github.com/jellydator/ttlcache/v3"
+	"go.uber.org/zap"
 )
 
 const (
-	DefaultCapacity = 10000
+	DefaultName             = "default"
+	DefaultCapacity         = 10000
+	DefaultSnapshotInterval = 5 * time.Minute
 )
 
+// ErrNegative is returned by Get for hostnames recently found to have no redirect.
+var ErrNegative = errors.New("hostname has no redirect")
+
 type Cache interface {
 	Start()
 	Stop()
 	Set(redirect redirect.Redirect)
+	SetMissing(hostname string)
 	Get(hostname string, redirect *redirect.Redirect) error
+	GetStale(hostname string, redirect *redirect.Redirect) error
 	Delete(hostname string)
+	Forget(hostname string)
+}
+
+// Option configures a RedirectCache.
+type Option func(rc *RedirectCache)
+
+// WithTTL sets how long a redirect is served from the cache before it is
+// refreshed. A zero TTL keeps redirects until they are evicted or purged.
+func WithTTL(ttl time.Duration) Option {
+	return func(rc *RedirectCache) {
+		rc.ttl = ttl
+	}
+}
+
+// WithNegativeTTL remembers hostnames without a redirect for ttl, so repeated
+// requests for them are not looked up again. A zero TTL disables this.
+func WithNegativeTTL(ttl time.Duration) Option {
+	return func(rc *RedirectCache) {
+		rc.negativeTTL = ttl
+	}
+}
+
+// WithSnapshot persists the last-known-good redirects to path every interval
+// and when the cache is stopped.
+func WithSnapshot(path string, interval time.Duration) Option {
+	return func(rc *RedirectCache) {
+		rc.snapshotPath = path
+		if interval > 0 {
+			rc.snapshotInterval = interval
+		}
+	}
+}
+
+// WithName names the cache in metrics. Defaults to DefaultName.
+func WithName(name string) Option {
+	return func(rc *RedirectCache) {
+		rc.name = name
+	}
+}
+
+// WithLogger sets the logger used for snapshot errors.
+func WithLogger(logger *zap.Logger) Option {
+	return func(rc *RedirectCache) {
+		rc.logger = logger
+	}
 }
 
+// RedirectCache holds fresh redirects for the configured TTL. Every redirect
+// is also kept as a last-known-good copy, which outlives expiry and purges so
+// it can be served when the backend is unavailable.
 type RedirectCache struct {
-	cache *ttlcache.Cache[string, redirect.Redirect]
+	cache   *ttlcache.Cache[string, redirect.Redirect]
+	stale   *ttlcache.Cache[string, redirect.Redirect]
+	missing *ttlcache.Cache[string, struct{}]
+
+	name             string
+	ttl              time.Duration
+	negativeTTL      time.Duration
+	snapshotPath     string
+	snapshotInterval time.Duration
+	logger           *zap.Logger
+
+	untrack func()
+	done    chan struct{}
+	wg      sync.WaitGroup
 }
 
-func NewRedirectCache() *RedirectCache {
+func NewRedirectCache(options ...Option) *RedirectCache {
 	c := &RedirectCache{
-		cache: ttlcache.New[string, redirect.Redirect](
-			ttlcache.WithCapacity[string, redirect.Redirect](DefaultCapacity),
-		),
+		name:             DefaultName,
+		snapshotInterval: DefaultSnapshotInterval,
+		logger:           zap.NewNop(),
+	}
+	for _, option := range options {
+		option(c)
 	}
+	c.cache = ttlcache.New[string, redirect.Redirect](
+		ttlcache.WithCapacity[string, redirect.Redirect](DefaultCapacity),
+		ttlcache.WithTTL[string, redirect.Redirect](c.ttl),
+		ttlcache.WithDisableTouchOnHit[string, redirect.Redirect](),
+	)
+	c.stale = ttlcache.New[string, redirect.Redirect](
+		ttlcache.WithCapacity[string, redirect.Redirect](DefaultCapacity),
+	)
+	c.missing = ttlcache.New[string, struct{}](
+		ttlcache.WithCapacity[string, struct{}](DefaultCapacity),
+		ttlcache.WithTTL[string, struct{}](c.negativeTTL),
+		ttlcache.WithDisableTouchOnHit[string, struct{}](),
+	)
+
+	c.cache.OnEviction(func(_ context.Context, reason ttlcache.EvictionReason, _ *ttlcache.Item[string, redirect.Redirect]) {
+		metrics.CacheEvictions.WithLabelValues(evictionReason(reason)).Inc()
+	})
 	return c
 }
 
+func evictionReason(reason ttlcache.EvictionReason) string {
+	switch reason {
+	case ttlcache.EvictionReasonExpired:
+		return "expired"
+	case ttlcache.EvictionReasonCapacityReached, ttlcache.EvictionReasonMaxCostExceeded:
+		return "capacity"
+	case ttlcache.EvictionReasonDeleted:
+		return "deleted"
+	}
+	return "unknown"
+}
+
 func (rc *RedirectCache) Start() {
+	rc.untrack = metrics.TrackCacheEntries(rc.name, rc.cache.Len)
 	go rc.cache.Start()
+	go rc.missing.Start()
+
+	if rc.snapshotPath == "" {
+		return
+	}
+	if err := rc.LoadSnapshot(rc.snapshotPath); err != nil {
+		rc.logger.Warn("unable to load cache snapshot", zap.String("path", rc.snapshotPath), zap.Error(err))
+	}
+	rc.done = make(chan struct{})
+	rc.wg.Add(1)
+	go rc.snapshotLoop()
 }
 
 func (rc *RedirectCache) Stop() {
+	if rc.untrack != nil {
+		rc.untrack()
+		rc.untrack = nil
+	}
 	rc.cache.Stop()
+	rc.missing.Stop()
+
+	if rc.done == nil {
+		return
+	}
+	close(rc.done)
+	rc.wg.Wait()
+	rc.done = nil
+	if err := rc.WriteSnapshot(rc.snapshotPath); err != nil {
+		rc.logger.Error("unable to write cache snapshot", zap.String("path", rc.snapshotPath), zap.Error(err))
+	}
 }
 
 func (rc *RedirectCache) Set(redirect redirect.Redirect) {
+	rc.missing.Delete(redirect.Hostname)
 	rc.cache.Set(redirect.Hostname, redirect, ttlcache.DefaultTTL)
+	rc.stale.Set(redirect.Hostname, redirect, ttlcache.NoTTL)
+}
+
+// SetMissing remembers that hostname has no redirect for the negative TTL.
+func (rc *RedirectCache) SetMissing(hostname string) {
+	if rc.negativeTTL <= 0 {
+		return
+	}
+	rc.missing.Set(hostname, struct{}{}, ttlcache.DefaultTTL)
 }
 
 func (rc *RedirectCache) Get(hostname string, redirect *redirect.Redirect) error {
 	item := rc.cache.Get(hostname)
 	if item != nil {
+		metrics.CacheRequests.WithLabelValues(rc.name, metrics.ResultHit).Inc()
 		*redirect = item.Value()
 		return nil
 	}
+	if rc.missing.Get(hostname) != nil {
+		metrics.CacheRequests.WithLabelValues(rc.name, metrics.ResultNegativeHit).Inc()
+		return fmt.Errorf("%w: %s", ErrNegative, hostname)
+	}
+	metrics.CacheRequests.WithLabelValues(rc.name, metrics.ResultMiss).Inc()
 	return fmt.Errorf("redirect not found for hostname: %s", hostname)
 }
 
+// GetStale returns the last-known-good redirect for hostname, even if it has
+// expired or been purged from the cache.
+func (rc *RedirectCache) GetStale(hostname string, redirect *redirect.Redirect) error {
+	item := rc.stale.Get(hostname)
+	if item != nil {
+		metrics.CacheRequests.WithLabelValues(rc.name, metrics.ResultStale).Inc()
+		*redirect = item.Value()
+		return nil
+	}
+	return fmt.Errorf("last-known-good redirect not found for hostname: %s", hostname)
+}
+
+// Delete removes the fresh or missing entry for hostname, keeping its
+// last-known-good copy.
 func (rc *RedirectCache) Delete(hostname string) {
 	rc.cache.Delete(hostname)
+	rc.missing.Delete(hostname)
+}
+
+// Forget removes hostname entirely, including its last-known-good copy.
+func (rc *RedirectCache) Forget(hostname string) {
+	rc.Delete(hostname)
+	rc.stale.Delete(hostname)
+}
+
+func (rc *RedirectCache) snapshotLoop() {
+	defer rc.wg.Done()
+
+	ticker := time.NewTicker(rc.snapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rc.done:
+			return
+		case <-ticker.C:
+			if err := rc.WriteSnapshot(rc.snapshotPath); err != nil {
+				rc.logger.Error("unable to write cache snapshot", zap.String("path", rc.snapshotPath), zap.Error(err))
+			}
+		}
+	}
 }
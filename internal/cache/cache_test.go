@@ -1,10 +1,17 @@
 package cache_test
 
 import (
+	"os"
+	"path/filepath"
+	"regexp"
 	"testing"
+	"time"
 
 	"github.com/CruGlobal/mirage-server/internal/cache"
+	"github.com/CruGlobal/mirage-server/internal/metrics"
 	"github.com/CruGlobal/mirage-server/internal/redirect"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -41,3 +48,186 @@ func TestRedirectCache_CRUD(t *testing.T) {
 
 	c.Stop()
 }
+
+func TestRedirectCache_Stale(t *testing.T) {
+	c := cache.NewRedirectCache(cache.WithTTL(10 * time.Millisecond))
+
+	example := redirect.Redirect{
+		Hostname: "www.example.com",
+		Location: "example.com",
+	}
+
+	c.Start()
+	defer c.Stop()
+
+	var redir redirect.Redirect
+	err := c.GetStale("www.example.com", &redir)
+	require.Error(t, err)
+
+	c.Set(example)
+
+	// Expired redirects are no longer fresh but remain last-known-good
+	time.Sleep(20 * time.Millisecond)
+	err = c.Get("www.example.com", &redir)
+	require.Error(t, err)
+	err = c.GetStale("www.example.com", &redir)
+	require.NoError(t, err)
+	assert.Equal(t, example, redir)
+
+	// Purged redirects remain last-known-good
+	c.Set(example)
+	c.Delete("www.example.com")
+	err = c.Get("www.example.com", &redir)
+	require.Error(t, err)
+	err = c.GetStale("www.example.com", &redir)
+	require.NoError(t, err)
+
+	// Forgotten redirects are gone entirely
+	c.Forget("www.example.com")
+	err = c.GetStale("www.example.com", &redir)
+	require.Error(t, err)
+}
+
+func TestRedirectCache_Snapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+
+	example := redirect.Redirect{
+		Hostname: "www.example.info",
+		Type:     redirect.TypeRedirect,
+		Status:   redirect.StatusPermanent,
+		Location: "example.info",
+		Rewrites: []redirect.Rewrite{
+			{
+				RegExp:  redirect.RewriteRegexp{Regexp: regexp.MustCompile(`^(.*)$`)},
+				Replace: "$1",
+				Final:   true,
+			},
+		},
+		NoIndex: true,
+	}
+
+	c := cache.NewRedirectCache(cache.WithSnapshot(path, time.Hour))
+	c.Start()
+	c.Set(example)
+	c.Stop()
+
+	// A fresh cache only serves the snapshot as last-known-good
+	c = cache.NewRedirectCache(cache.WithSnapshot(path, time.Hour))
+	c.Start()
+	defer c.Stop()
+
+	var redir redirect.Redirect
+	err := c.Get("www.example.info", &redir)
+	require.Error(t, err)
+	err = c.GetStale("www.example.info", &redir)
+	require.NoError(t, err)
+	assert.Equal(t, example, redir)
+}
+
+func TestRedirectCache_LoadSnapshot(t *testing.T) {
+	c := cache.NewRedirectCache()
+
+	err := c.LoadSnapshot(filepath.Join(t.TempDir(), "missing.json"))
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "invalid.json")
+	require.NoError(t, os.WriteFile(path, []byte("{"), 0o600))
+	err = c.LoadSnapshot(path)
+	require.Error(t, err)
+}
+
+func TestRedirectCache_Negative(t *testing.T) {
+	c := cache.NewRedirectCache(cache.WithNegativeTTL(time.Minute))
+	c.Start()
+	defer c.Stop()
+
+	hits := testutil.ToFloat64(metrics.CacheRequests.WithLabelValues(cache.DefaultName, metrics.ResultNegativeHit))
+
+	var redir redirect.Redirect
+	c.SetMissing("example.edu")
+	err := c.Get("example.edu", &redir)
+	require.ErrorIs(t, err, cache.ErrNegative)
+	assert.InDelta(t, hits+1, testutil.ToFloat64(metrics.CacheRequests.WithLabelValues(cache.DefaultName, metrics.ResultNegativeHit)), 0)
+
+	// Purging forgets the negative entry
+	c.Delete("example.edu")
+	err = c.Get("example.edu", &redir)
+	require.Error(t, err)
+	require.NotErrorIs(t, err, cache.ErrNegative)
+
+	// A redirect replaces the negative entry
+	c.SetMissing("example.edu")
+	c.Set(redirect.Redirect{Hostname: "example.edu", Location: "example.com"})
+	err = c.Get("example.edu", &redir)
+	require.NoError(t, err)
+}
+
+func TestRedirectCache_NegativeDisabled(t *testing.T) {
+	c := cache.NewRedirectCache()
+
+	var redir redirect.Redirect
+	c.SetMissing("example.edu")
+	err := c.Get("example.edu", &redir)
+	require.NotErrorIs(t, err, cache.ErrNegative)
+}
+
+func TestRedirectCache_Metrics(t *testing.T) {
+	c := cache.NewRedirectCache()
+
+	hits := testutil.ToFloat64(metrics.CacheRequests.WithLabelValues(cache.DefaultName, metrics.ResultHit))
+	misses := testutil.ToFloat64(metrics.CacheRequests.WithLabelValues(cache.DefaultName, metrics.ResultMiss))
+	deleted := testutil.ToFloat64(metrics.CacheEvictions.WithLabelValues("deleted"))
+
+	var redir redirect.Redirect
+	_ = c.Get("www.example.com", &redir)
+	c.Set(redirect.Redirect{Hostname: "www.example.com", Location: "example.com"})
+	_ = c.Get("www.example.com", &redir)
+	c.Delete("www.example.com")
+
+	assert.InDelta(t, hits+1, testutil.ToFloat64(metrics.CacheRequests.WithLabelValues(cache.DefaultName, metrics.ResultHit)), 0)
+	assert.InDelta(t, misses+1, testutil.ToFloat64(metrics.CacheRequests.WithLabelValues(cache.DefaultName, metrics.ResultMiss)), 0)
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(metrics.CacheEvictions.WithLabelValues("deleted")) == deleted+1
+	}, time.Second, 10*time.Millisecond)
+}
+
+// entries returns the entries metric of each cache by name.
+func entries(t *testing.T) map[string]float64 {
+	t.Helper()
+	registry := prometheus.NewPedanticRegistry()
+	require.NoError(t, registry.Register(metrics.CacheEntries))
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			values[metric.GetLabel()[0].GetValue()] = metric.GetGauge().GetValue()
+		}
+	}
+	return values
+}
+
+func TestRedirectCache_Entries(t *testing.T) {
+	previous := cache.NewRedirectCache(cache.WithName("profile/partner"))
+	next := cache.NewRedirectCache(cache.WithName("profile/partner"))
+	other := cache.NewRedirectCache(cache.WithName("table/Redirects"))
+	for _, c := range []*cache.RedirectCache{previous, next, other} {
+		c.Start()
+	}
+	defer other.Stop()
+
+	previous.Set(redirect.Redirect{Hostname: "www.example.com", Location: "example.com"})
+	next.Set(redirect.Redirect{Hostname: "www.example.org", Location: "example.org"})
+	next.Set(redirect.Redirect{Hostname: "www.example.net", Location: "example.net"})
+
+	// Caches of the same name, as during a reload, are added up
+	values := entries(t)
+	assert.InDelta(t, 3, values["profile/partner"], 0)
+	assert.InDelta(t, 0, values["table/Redirects"], 0)
+
+	// Stopped caches are no longer counted
+	previous.Stop()
+	assert.InDelta(t, 2, entries(t)["profile/partner"], 0)
+	next.Stop()
+	assert.NotContains(t, entries(t), "profile/partner")
+}
@@ -0,0 +1,147 @@
+package cache
+
+import (
+	"strings"
+	"time"
+
+	"github.com/CruGlobal/mirage-server/internal/redirect"
+	"github.com/jellydator/ttlcache/v3"
+)
+
+// Entry states.
+const (
+	StateFresh   = "fresh"
+	StateStale   = "stale"
+	StateMissing = "missing"
+)
+
+// Entry describes a hostname held by the cache.
+type Entry struct {
+	Hostname  string     `json:"hostname"`
+	State     string     `json:"state"`
+	Location  string     `json:"location,omitempty"`
+	Tags      []string   `json:"tags,omitempty"`
+	Source    string     `json:"source,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Stats summarizes the cache.
+type Stats struct {
+	Fresh       int           `json:"fresh"`
+	Stale       int           `json:"stale"`
+	Missing     int           `json:"missing"`
+	Hits        uint64        `json:"hits"`
+	Misses      uint64        `json:"misses"`
+	Insertions  uint64        `json:"insertions"`
+	Evictions   uint64        `json:"evictions"`
+	TTL         time.Duration `json:"ttl"`
+	NegativeTTL time.Duration `json:"negative_ttl"`
+}
+
+// Matcher selects cache entries by hostname and, when the hostname has a
+// redirect, by its record.
+type Matcher func(hostname string, redirect *redirect.Redirect) bool
+
+// MatchAll matches every entry.
+func MatchAll() Matcher {
+	return func(string, *redirect.Redirect) bool { return true }
+}
+
+// MatchName matches a single hostname.
+func MatchName(name string) Matcher {
+	return func(hostname string, _ *redirect.Redirect) bool {
+		return strings.EqualFold(hostname, name)
+	}
+}
+
+// MatchSuffix matches a domain and all of its subdomains, so "example.org"
+// or "*.example.org" match both example.org and www.example.org.
+func MatchSuffix(suffix string) Matcher {
+	suffix = strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(suffix, "*"), "."))
+	return func(hostname string, _ *redirect.Redirect) bool {
+		hostname = strings.ToLower(hostname)
+		return hostname == suffix || strings.HasSuffix(hostname, "."+suffix)
+	}
+}
+
+// MatchTag matches redirects tagged with tag.
+func MatchTag(tag string) Matcher {
+	return func(_ string, redirect *redirect.Redirect) bool {
+		return redirect != nil && redirect.HasTag(tag)
+	}
+}
+
+// Entries lists the fresh, last-known-good and missing hostnames that match.
+func (rc *RedirectCache) Entries(match Matcher) []Entry {
+	var entries []Entry
+	fresh := make(map[string]bool)
+	rc.cache.Range(func(item *ttlcache.Item[string, redirect.Redirect]) bool {
+		value := item.Value()
+		fresh[item.Key()] = true
+		if match(item.Key(), &value) {
+			entries = append(entries, newEntry(item.Key(), StateFresh, &value, item))
+		}
+		return true
+	})
+	rc.stale.Range(func(item *ttlcache.Item[string, redirect.Redirect]) bool {
+		value := item.Value()
+		if !fresh[item.Key()] && match(item.Key(), &value) {
+			entries = append(entries, newEntry(item.Key(), StateStale, &value, nil))
+		}
+		return true
+	})
+	rc.missing.Range(func(item *ttlcache.Item[string, struct{}]) bool {
+		if match(item.Key(), nil) {
+			entry := newEntry(item.Key(), StateMissing, nil, nil)
+			expires := item.ExpiresAt()
+			entry.ExpiresAt = &expires
+			entries = append(entries, entry)
+		}
+		return true
+	})
+	return entries
+}
+
+func newEntry(hostname string, state string, redir *redirect.Redirect, item *ttlcache.Item[string, redirect.Redirect]) Entry {
+	entry := Entry{Hostname: hostname, State: state}
+	if redir != nil {
+		entry.Location = redir.Location
+		entry.Tags = redir.Tags
+		entry.Source = redir.Source
+	}
+	if item != nil && !item.ExpiresAt().IsZero() {
+		expires := item.ExpiresAt()
+		entry.ExpiresAt = &expires
+	}
+	return entry
+}
+
+// Purge deletes the fresh and missing entries that match, keeping their
+// last-known-good copies like Delete. It returns the purged hostnames.
+func (rc *RedirectCache) Purge(match Matcher) []string {
+	var hostnames []string
+	for _, entry := range rc.Entries(match) {
+		if entry.State == StateStale {
+			continue
+		}
+		rc.Delete(entry.Hostname)
+		hostnames = append(hostnames, entry.Hostname)
+	}
+	return hostnames
+}
+
+// Stats returns the size and counters of the cache.
+func (rc *RedirectCache) Stats() Stats {
+	counters := rc.cache.Metrics()
+	return Stats{
+		Fresh:       rc.cache.Len(),
+		Stale:       rc.stale.Len(),
+		Missing:     rc.missing.Len(),
+		Hits:        counters.Hits,
+		Misses:      counters.Misses,
+		Insertions:  counters.Insertions,
+		Evictions:   counters.Evictions,
+		TTL:         rc.ttl,
+		NegativeTTL: rc.negativeTTL,
+	}
+}
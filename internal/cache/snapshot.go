@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/CruGlobal/mirage-server/internal/redirect"
+	"github.com/jellydator/ttlcache/v3"
+)
+
+// WriteSnapshot writes every last-known-good redirect to path as a JSON list.
+// The file is replaced atomically so a crash never leaves a partial snapshot.
+func (rc *RedirectCache) WriteSnapshot(path string) error {
+	redirects := make([]redirect.Redirect, 0, rc.stale.Len())
+	rc.stale.Range(func(item *ttlcache.Item[string, redirect.Redirect]) bool {
+		redirects = append(redirects, item.Value())
+		return true
+	})
+
+	data, err := json.Marshal(redirects)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck // already renamed on success
+
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadSnapshot loads redirects written by WriteSnapshot as last-known-good
+// copies. They are only served when the backend cannot be reached, so a fresh
+// instance still prefers live records. A missing snapshot is not an error.
+func (rc *RedirectCache) LoadSnapshot(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var redirects []redirect.Redirect
+	if err = json.Unmarshal(data, &redirects); err != nil {
+		return err
+	}
+	for _, r := range redirects {
+		if !rc.stale.Has(r.Hostname) {
+			rc.stale.Set(r.Hostname, r, ttlcache.NoTTL)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package dynamo
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/CruGlobal/mirage-server/internal/metrics"
+)
+
+const (
+	DefaultBreakerThreshold = 5
+	DefaultBreakerCooldown  = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned instead of calling DynamoDB while the breaker is
+// open.
+var ErrCircuitOpen = errors.New("DynamoDB circuit breaker is open")
+
+// Breaker stops calls to DynamoDB after consecutive failures, so requests are
+// answered from the cache or the fallback behavior instead of waiting on a
+// backend that is down. After the cooldown a single trial call is let through;
+// if it succeeds the breaker closes, otherwise it stays open for another
+// cooldown.
+type Breaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mutex    *sync.Mutex
+	failures int
+	openedAt time.Time
+	open     bool
+	trial    bool
+}
+
+// NewBreaker creates a Breaker that opens after threshold consecutive failures.
+// name labels the breaker's metric.
+func NewBreaker(name string, threshold int, cooldown time.Duration) *Breaker {
+	if threshold <= 0 {
+		threshold = DefaultBreakerThreshold
+	}
+	if cooldown <= 0 {
+		cooldown = DefaultBreakerCooldown
+	}
+	metrics.BreakerOpen.WithLabelValues(name).Set(0)
+	return &Breaker{
+		name:      name,
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+		mutex:     &sync.Mutex{},
+	}
+}
+
+// Do calls fn unless the breaker is open, and records whether it failed.
+// Errors caused by ctx ending or by the request itself do not count.
+func (b *Breaker) Do(ctx context.Context, fn func() error) error {
+	if b == nil {
+		return fn()
+	}
+	if !b.allow() {
+		return ErrCircuitOpen
+	}
+	err := fn()
+	b.record(err != nil && IsFailure(ctx, err))
+	return err
+}
+
+// Open reports whether calls are currently refused.
+func (b *Breaker) Open() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.open
+}
+
+func (b *Breaker) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !b.open {
+		return true
+	}
+	if b.trial || b.now().Sub(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+func (b *Breaker) record(failed bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.trial = false
+	if !failed {
+		b.failures = 0
+		if b.open {
+			b.open = false
+			metrics.BreakerOpen.WithLabelValues(b.name).Set(0)
+		}
+		return
+	}
+
+	b.failures++
+	if b.open || b.failures >= b.threshold {
+		b.open = true
+		b.openedAt = b.now()
+		metrics.BreakerOpen.WithLabelValues(b.name).Set(1)
+	}
+}
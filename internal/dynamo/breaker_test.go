@@ -0,0 +1,56 @@
+package dynamo_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/CruGlobal/mirage-server/internal/dynamo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBreaker_Do(t *testing.T) {
+	ctx := t.Context()
+	b := dynamo.NewBreaker("test", 2, 20*time.Millisecond)
+	fail := func() error { return errUnavailable }
+	succeed := func() error { return nil }
+
+	require.ErrorIs(t, b.Do(ctx, fail), errUnavailable)
+	assert.False(t, b.Open())
+	require.ErrorIs(t, b.Do(ctx, fail), errUnavailable)
+	assert.True(t, b.Open())
+
+	// Open breakers refuse calls without making them
+	called := false
+	err := b.Do(ctx, func() error {
+		called = true
+		return nil
+	})
+	require.ErrorIs(t, err, dynamo.ErrCircuitOpen)
+	assert.False(t, called)
+
+	// A failed trial keeps the breaker open for another cooldown
+	time.Sleep(30 * time.Millisecond)
+	require.ErrorIs(t, b.Do(ctx, fail), errUnavailable)
+	require.ErrorIs(t, b.Do(ctx, succeed), dynamo.ErrCircuitOpen)
+
+	// A successful trial closes it
+	time.Sleep(30 * time.Millisecond)
+	require.NoError(t, b.Do(ctx, succeed))
+	assert.False(t, b.Open())
+}
+
+func TestBreaker_CallerErrorsDoNotCount(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	b := dynamo.NewBreaker("test", 1, time.Minute)
+	require.ErrorIs(t, b.Do(ctx, func() error { return ctx.Err() }), context.Canceled)
+	assert.False(t, b.Open())
+}
+
+func TestBreaker_Nil(t *testing.T) {
+	var b *dynamo.Breaker
+	require.NoError(t, b.Do(t.Context(), func() error { return nil }))
+}
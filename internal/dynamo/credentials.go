@@ -0,0 +1,152 @@
+package dynamo
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// DefaultSessionName names assumed-role sessions unless one is configured.
+const DefaultSessionName = "mirage-server"
+
+// Credentials selects how DynamoDB clients authenticate. The zero value uses
+// the SDK's default credential chain, reading the environment, shared config
+// files and instance roles.
+type Credentials struct {
+	// Profile is a named profile from the shared AWS config files.
+	Profile string `json:"profile,omitempty"`
+	// RoleARN is a role assumed with the base credentials, or with the web
+	// identity token when WebIdentityTokenFile is set.
+	RoleARN string `json:"role_arn,omitempty"`
+	// ExternalID is passed when assuming RoleARN, as cross-account roles
+	// often require.
+	ExternalID string `json:"external_id,omitempty"`
+	// SessionName names the assumed-role session. Defaults to mirage-server.
+	SessionName string `json:"session_name,omitempty"`
+	// WebIdentityTokenFile is an OIDC token file, such as a Kubernetes
+	// service account token, exchanged for RoleARN.
+	WebIdentityTokenFile string `json:"web_identity_token_file,omitempty"`
+	// AccessKeyID, SecretAccessKey and SessionToken are static keys, meant
+	// for DynamoDB Local.
+	AccessKeyID     string `json:"access_key_id,omitempty"`
+	SecretAccessKey string `json:"secret_access_key,omitempty"`
+	SessionToken    string `json:"session_token,omitempty"`
+}
+
+// Set assigns the option named by its Caddyfile key and reports whether the
+// key is a credentials option.
+func (c *Credentials) Set(key string, value string) bool {
+	switch key {
+	case "aws_profile":
+		c.Profile = value
+	case "role_arn":
+		c.RoleARN = value
+	case "external_id":
+		c.ExternalID = value
+	case "session_name":
+		c.SessionName = value
+	case "web_identity_token_file":
+		c.WebIdentityTokenFile = value
+	case "access_key_id":
+		c.AccessKeyID = value
+	case "secret_access_key":
+		c.SecretAccessKey = value
+	case "session_token":
+		c.SessionToken = value
+	default:
+		return false
+	}
+	return true
+}
+
+// Validate rejects combinations that cannot be used together.
+func (c *Credentials) Validate() error {
+	static := c.AccessKeyID != "" || c.SecretAccessKey != "" || c.SessionToken != ""
+	switch {
+	case static && (c.AccessKeyID == "" || c.SecretAccessKey == ""):
+		return errors.New("credentials: access_key_id and secret_access_key must be set together")
+	case static && c.Profile != "":
+		return errors.New("credentials: static keys cannot be used with a profile")
+	case static && c.WebIdentityTokenFile != "":
+		return errors.New("credentials: static keys cannot be used with a web identity token")
+	case c.WebIdentityTokenFile != "" && c.RoleARN == "":
+		return errors.New("credentials: web_identity_token_file requires role_arn")
+	case c.ExternalID != "" && c.RoleARN == "":
+		return errors.New("credentials: external_id requires role_arn")
+	case c.SessionName != "" && c.RoleARN == "":
+		return errors.New("credentials: session_name requires role_arn")
+	}
+	return nil
+}
+
+// LoadConfig loads the AWS config for region and endpoint using these
+// credentials. A nil Credentials uses the default credential chain.
+func (c *Credentials) LoadConfig(
+	ctx context.Context,
+	region string,
+	endpoint string,
+	optFns ...func(*config.LoadOptions) error,
+) (aws.Config, error) {
+	options := []func(*config.LoadOptions) error{
+		config.WithRegion(region),
+		config.WithBaseEndpoint(endpoint),
+	}
+	if c != nil {
+		if err := c.Validate(); err != nil {
+			return aws.Config{}, err
+		}
+		if c.Profile != "" {
+			options = append(options, config.WithSharedConfigProfile(c.Profile))
+		}
+		if c.AccessKeyID != "" {
+			options = append(options, config.WithCredentialsProvider(
+				credentials.NewStaticCredentialsProvider(c.AccessKeyID, c.SecretAccessKey, c.SessionToken),
+			))
+		}
+	}
+	options = append(options, optFns...)
+
+	cfg, err := config.LoadDefaultConfig(ctx, options...)
+	if err != nil {
+		return aws.Config{}, err
+	}
+	if c == nil || c.RoleARN == "" {
+		return cfg, nil
+	}
+
+	// STS is reached at its own endpoint, not the DynamoDB one
+	stsClient := sts.NewFromConfig(cfg, func(o *sts.Options) {
+		o.BaseEndpoint = nil
+	})
+	sessionName := c.SessionName
+	if sessionName == "" {
+		sessionName = DefaultSessionName
+	}
+	if c.WebIdentityTokenFile != "" {
+		cfg.Credentials = aws.NewCredentialsCache(stscreds.NewWebIdentityRoleProvider(
+			stsClient,
+			c.RoleARN,
+			stscreds.IdentityTokenFile(c.WebIdentityTokenFile),
+			func(o *stscreds.WebIdentityRoleOptions) {
+				o.RoleSessionName = sessionName
+			},
+		))
+		return cfg, nil
+	}
+	cfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(
+		stsClient,
+		c.RoleARN,
+		func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = sessionName
+			if c.ExternalID != "" {
+				o.ExternalID = aws.String(c.ExternalID)
+			}
+		},
+	))
+	return cfg, nil
+}
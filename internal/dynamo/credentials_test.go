@@ -0,0 +1,133 @@
+package dynamo_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CruGlobal/mirage-server/internal/dynamo"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCredentials_Set(t *testing.T) {
+	var creds dynamo.Credentials
+	assert.True(t, creds.Set("aws_profile", "dev"))
+	assert.True(t, creds.Set("role_arn", "arn:aws:iam::123456789012:role/mirage"))
+	assert.True(t, creds.Set("external_id", "partner"))
+	assert.True(t, creds.Set("session_name", "mirage-test"))
+	assert.False(t, creds.Set("region", "us-east-1"))
+	assert.Equal(t, dynamo.Credentials{
+		Profile:     "dev",
+		RoleARN:     "arn:aws:iam::123456789012:role/mirage",
+		ExternalID:  "partner",
+		SessionName: "mirage-test",
+	}, creds)
+}
+
+func TestCredentials_Validate(t *testing.T) {
+	tests := []struct {
+		name  string
+		creds dynamo.Credentials
+		err   string
+	}{
+		{name: "default"},
+		{name: "profile", creds: dynamo.Credentials{Profile: "dev"}},
+		{name: "static", creds: dynamo.Credentials{AccessKeyID: "local", SecretAccessKey: "local"}},
+		{
+			name:  "assume role",
+			creds: dynamo.Credentials{RoleARN: "arn:aws:iam::123456789012:role/mirage", ExternalID: "partner"},
+		},
+		{
+			name: "web identity",
+			creds: dynamo.Credentials{
+				RoleARN:              "arn:aws:iam::123456789012:role/mirage",
+				WebIdentityTokenFile: "/var/run/secrets/token",
+			},
+		},
+		{
+			name:  "static without secret",
+			creds: dynamo.Credentials{AccessKeyID: "local"},
+			err:   "access_key_id and secret_access_key must be set together",
+		},
+		{
+			name:  "static with profile",
+			creds: dynamo.Credentials{Profile: "dev", AccessKeyID: "local", SecretAccessKey: "local"},
+			err:   "static keys cannot be used with a profile",
+		},
+		{
+			name:  "web identity without role",
+			creds: dynamo.Credentials{WebIdentityTokenFile: "/var/run/secrets/token"},
+			err:   "web_identity_token_file requires role_arn",
+		},
+		{
+			name:  "external id without role",
+			creds: dynamo.Credentials{ExternalID: "partner"},
+			err:   "external_id requires role_arn",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.creds.Validate()
+			if tt.err != "" {
+				require.ErrorContains(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestCredentials_LoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	credentialsFile := filepath.Join(dir, "credentials")
+	require.NoError(t, os.WriteFile(credentialsFile, []byte("[dev]\naws_access_key_id = dev-key\naws_secret_access_key = dev-secret\n"), 0o600))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", credentialsFile)
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+
+	tests := []struct {
+		name   string
+		creds  *dynamo.Credentials
+		expect string
+	}{
+		{
+			name:   "static",
+			creds:  &dynamo.Credentials{AccessKeyID: "local", SecretAccessKey: "local-secret"},
+			expect: "local",
+		},
+		{
+			name:   "profile",
+			creds:  &dynamo.Credentials{Profile: "dev"},
+			expect: "dev-key",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := tt.creds.LoadConfig(t.Context(), "us-east-1", "http://localhost:8000")
+			require.NoError(t, err)
+			assert.Equal(t, "us-east-1", cfg.Region)
+			assert.Equal(t, "http://localhost:8000", aws.ToString(cfg.BaseEndpoint))
+
+			value, err := cfg.Credentials.Retrieve(t.Context())
+			require.NoError(t, err)
+			assert.Equal(t, tt.expect, value.AccessKeyID)
+		})
+	}
+
+	// Assumed roles wrap the base credentials
+	creds := &dynamo.Credentials{
+		AccessKeyID:     "local",
+		SecretAccessKey: "local-secret",
+		RoleARN:         "arn:aws:iam::123456789012:role/mirage",
+	}
+	cfg, err := creds.LoadConfig(t.Context(), "us-east-1", "")
+	require.NoError(t, err)
+	require.IsType(t, &aws.CredentialsCache{}, cfg.Credentials)
+	assumeRole := cfg.Credentials.(*aws.CredentialsCache).IsCredentialsProvider(&stscreds.AssumeRoleProvider{})
+	assert.True(t, assumeRole)
+
+	_, err = (&dynamo.Credentials{ExternalID: "partner"}).LoadConfig(t.Context(), "us-east-1", "")
+	require.ErrorContains(t, err, "external_id requires role_arn")
+}
@@ -0,0 +1,323 @@
+package dynamo
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/CruGlobal/mirage-server/internal/metrics"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/smithy-go"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultFailureThreshold = 3
+	DefaultRecoveryInterval = 30 * time.Second
+)
+
+var _ Client = (*Failover)(nil)
+
+// Replica is one region or endpoint of a global table.
+type Replica struct {
+	Name   string
+	Client Client
+}
+
+// FailoverOption configures a Failover.
+type FailoverOption func(f *Failover)
+
+// WithFailureThreshold sets how many consecutive failed or slow calls switch
+// away from the active replica.
+func WithFailureThreshold(threshold int) FailoverOption {
+	return func(f *Failover) {
+		if threshold > 0 {
+			f.failureThreshold = threshold
+		}
+	}
+}
+
+// WithLatencyThreshold counts calls slower than threshold as failures. A zero
+// threshold only counts errors.
+func WithLatencyThreshold(threshold time.Duration) FailoverOption {
+	return func(f *Failover) {
+		f.latencyThreshold = threshold
+	}
+}
+
+// WithRecoveryInterval sets how often the primary is probed after failing
+// over, so traffic can switch back once it is healthy.
+func WithRecoveryInterval(interval time.Duration) FailoverOption {
+	return func(f *Failover) {
+		if interval > 0 {
+			f.recoveryInterval = interval
+		}
+	}
+}
+
+// WithFailoverLogger sets the logger used to report replica switches.
+func WithFailoverLogger(logger *zap.Logger) FailoverOption {
+	return func(f *Failover) {
+		f.logger = logger
+	}
+}
+
+// Failover sends calls to the active replica of a DynamoDB global table,
+// starting with the first (primary) replica. After consecutive failures the
+// next replica becomes active. Reads that fail are retried on the remaining
+// replicas straight away; writes are not, so they are never applied twice.
+// Calls that run out of time count as failures, unless the caller canceled
+// them.
+//
+// While a replica other than the primary is active, one read per recovery
+// interval is sent to the primary first. If it succeeds the primary becomes
+// active again, otherwise the read is served by the active replica.
+type Failover struct {
+	replicas         []Replica
+	failureThreshold int
+	latencyThreshold time.Duration
+	recoveryInterval time.Duration
+	logger           *zap.Logger
+	now              func() time.Time
+
+	mutex      *sync.Mutex
+	active     int
+	failures   int
+	switchedAt time.Time
+	probing    bool
+}
+
+func NewFailover(replicas []Replica, options ...FailoverOption) *Failover {
+	f := &Failover{
+		replicas:         replicas,
+		failureThreshold: DefaultFailureThreshold,
+		recoveryInterval: DefaultRecoveryInterval,
+		logger:           zap.NewNop(),
+		now:              time.Now,
+		mutex:            &sync.Mutex{},
+	}
+	for _, option := range options {
+		option(f)
+	}
+	return f
+}
+
+// Active returns the name of the replica calls are currently sent to.
+func (f *Failover) Active() string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.replicas[f.active].Name
+}
+
+// Replicas returns the replicas in priority order.
+func (f *Failover) Replicas() []Replica {
+	return f.replicas
+}
+
+// Primary returns the client of the primary replica when client fails over,
+// otherwise client itself. Conditional writes and locks use it: global tables
+// replicate asynchronously, so a condition checked on a replica may no longer
+// hold once the primary's writes arrive.
+func Primary(client Client) Client {
+	if f, ok := client.(*Failover); ok {
+		return f.replicas[0].Client
+	}
+	return client
+}
+
+func call[T any](ctx context.Context, f *Failover, read bool, fn func(context.Context, Client) (T, error)) (T, error) {
+	active, probe := f.route(read)
+	tries := 1
+	if read {
+		tries = len(f.replicas)
+	}
+	if probe {
+		out, failed, err := attempt(ctx, f, 0, tries+1, fn)
+		if !failed || ctx.Err() != nil {
+			return out, err
+		}
+	}
+
+	var out T
+	var err error
+	for n := range tries {
+		var failed bool
+		out, failed, err = attempt(ctx, f, (active+n)%len(f.replicas), tries-n, fn)
+		if err == nil || !failed || ctx.Err() != nil {
+			return out, err
+		}
+	}
+	return out, err
+}
+
+// route returns the active replica, and whether the primary should be probed.
+func (f *Failover) route(read bool) (int, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	probe := read && f.active != 0 && !f.probing && f.now().Sub(f.switchedAt) >= f.recoveryInterval
+	if probe {
+		f.probing = true
+	}
+	return f.active, probe
+}
+
+// attempt calls the replica at index and records the outcome. When the caller
+// has a deadline the attempt gets an even share of the time left across the
+// remaining attempts, so a hung replica leaves time to retry on the others.
+func attempt[T any](ctx context.Context, f *Failover, index int, remaining int, fn func(context.Context, Client) (T, error)) (T, bool, error) {
+	attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+	if deadline, ok := ctx.Deadline(); ok && remaining > 1 {
+		attemptCtx, cancel = context.WithTimeout(ctx, time.Until(deadline)/time.Duration(remaining))
+	}
+	defer cancel()
+
+	start := f.now()
+	out, err := fn(attemptCtx, f.replicas[index].Client)
+	failed := (err != nil && (IsFailure(ctx, err) || timedOut(ctx, attemptCtx))) ||
+		(f.latencyThreshold > 0 && f.now().Sub(start) > f.latencyThreshold)
+	f.record(index, err == nil && !failed, failed)
+	return out, failed, err
+}
+
+// timedOut reports whether an attempt ran out of time, rather than the caller
+// canceling it.
+func timedOut(ctx context.Context, attemptCtx context.Context) bool {
+	return errors.Is(attemptCtx.Err(), context.DeadlineExceeded) && !errors.Is(ctx.Err(), context.Canceled)
+}
+
+// record updates the health of the replica at index after a call. Only a
+// probe that succeeded switches back to the primary.
+func (f *Failover) record(index int, succeeded bool, failed bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if index != f.active {
+		if index == 0 && f.probing {
+			f.probing = false
+			if !succeeded {
+				f.switchedAt = f.now()
+				return
+			}
+			f.switchTo(0, "primary recovered")
+		}
+		return
+	}
+
+	if !failed {
+		f.failures = 0
+		return
+	}
+	f.failures++
+	if f.failures >= f.failureThreshold && len(f.replicas) > 1 {
+		f.switchTo((f.active+1)%len(f.replicas), "replica unhealthy")
+	}
+}
+
+func (f *Failover) switchTo(index int, reason string) {
+	from := f.replicas[f.active].Name
+	to := f.replicas[index].Name
+	f.active = index
+	f.failures = 0
+	f.switchedAt = f.now()
+
+	metrics.Failovers.WithLabelValues(from, to).Inc()
+	f.logger.Warn("switching DynamoDB replica",
+		zap.String("from", from),
+		zap.String("to", to),
+		zap.String("reason", reason),
+	)
+}
+
+// IsFailure reports whether err reflects on the health of DynamoDB rather
+// than on the request or the caller giving up.
+func IsFailure(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "ConditionalCheckFailedException", "TransactionCanceledException", "ValidationException",
+			"ResourceNotFoundException", "ResourceInUseException":
+			return false
+		}
+	}
+	return true
+}
+
+func (f *Failover) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	return call(ctx, f, true, func(ctx context.Context, c Client) (*dynamodb.GetItemOutput, error) {
+		return c.GetItem(ctx, params, optFns...)
+	})
+}
+
+func (f *Failover) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	return call(ctx, f, false, func(ctx context.Context, c Client) (*dynamodb.PutItemOutput, error) {
+		return c.PutItem(ctx, params, optFns...)
+	})
+}
+
+func (f *Failover) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	return call(ctx, f, false, func(ctx context.Context, c Client) (*dynamodb.UpdateItemOutput, error) {
+		return c.UpdateItem(ctx, params, optFns...)
+	})
+}
+
+func (f *Failover) DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	return call(ctx, f, false, func(ctx context.Context, c Client) (*dynamodb.DeleteItemOutput, error) {
+		return c.DeleteItem(ctx, params, optFns...)
+	})
+}
+
+func (f *Failover) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	return call(ctx, f, true, func(ctx context.Context, c Client) (*dynamodb.QueryOutput, error) {
+		return c.Query(ctx, params, optFns...)
+	})
+}
+
+func (f *Failover) Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	return call(ctx, f, true, func(ctx context.Context, c Client) (*dynamodb.ScanOutput, error) {
+		return c.Scan(ctx, params, optFns...)
+	})
+}
+
+func (f *Failover) TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+	return call(ctx, f, false, func(ctx context.Context, c Client) (*dynamodb.TransactWriteItemsOutput, error) {
+		return c.TransactWriteItems(ctx, params, optFns...)
+	})
+}
+
+// CreateTable, DeleteTable, DescribeTable, DescribeTimeToLive and
+// UpdateTimeToLive act on the replica that is active.
+
+func (f *Failover) CreateTable(ctx context.Context, params *dynamodb.CreateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.CreateTableOutput, error) {
+	return call(ctx, f, false, func(ctx context.Context, c Client) (*dynamodb.CreateTableOutput, error) {
+		return c.CreateTable(ctx, params, optFns...)
+	})
+}
+
+func (f *Failover) DeleteTable(ctx context.Context, params *dynamodb.DeleteTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteTableOutput, error) {
+	return call(ctx, f, false, func(ctx context.Context, c Client) (*dynamodb.DeleteTableOutput, error) {
+		return c.DeleteTable(ctx, params, optFns...)
+	})
+}
+
+func (f *Failover) DescribeTable(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error) {
+	return call(ctx, f, false, func(ctx context.Context, c Client) (*dynamodb.DescribeTableOutput, error) {
+		return c.DescribeTable(ctx, params, optFns...)
+	})
+}
+
+func (f *Failover) DescribeTimeToLive(ctx context.Context, params *dynamodb.DescribeTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTimeToLiveOutput, error) {
+	return call(ctx, f, false, func(ctx context.Context, c Client) (*dynamodb.DescribeTimeToLiveOutput, error) {
+		return c.DescribeTimeToLive(ctx, params, optFns...)
+	})
+}
+
+func (f *Failover) UpdateTimeToLive(ctx context.Context, params *dynamodb.UpdateTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTimeToLiveOutput, error) {
+	return call(ctx, f, false, func(ctx context.Context, c Client) (*dynamodb.UpdateTimeToLiveOutput, error) {
+		return c.UpdateTimeToLive(ctx, params, optFns...)
+	})
+}
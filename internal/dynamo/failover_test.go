@@ -0,0 +1,238 @@
+package dynamo_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CruGlobal/mirage-server/internal/dynamo"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errUnavailable = errors.New("service unavailable")
+
+// fakeClient answers GetItem and PutItem, failing or delaying on demand.
+type fakeClient struct {
+	dynamo.Client
+
+	mutex *sync.Mutex
+	err   error
+	delay time.Duration
+	gets  int
+	puts  int
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{mutex: &sync.Mutex{}}
+}
+
+func (c *fakeClient) set(err error, delay time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.err = err
+	c.delay = delay
+}
+
+func (c *fakeClient) calls() (int, int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.gets, c.puts
+}
+
+// wait sleeps for delay, returning early with the context's error like an
+// SDK call would.
+func wait(ctx context.Context, delay time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+func (c *fakeClient) GetItem(ctx context.Context, _ *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	c.mutex.Lock()
+	c.gets++
+	err, delay := c.err, c.delay
+	c.mutex.Unlock()
+
+	if waitErr := wait(ctx, delay); waitErr != nil {
+		return nil, waitErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.GetItemOutput{}, nil
+}
+
+func (c *fakeClient) PutItem(ctx context.Context, _ *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	c.mutex.Lock()
+	c.puts++
+	err, delay := c.err, c.delay
+	c.mutex.Unlock()
+
+	if waitErr := wait(ctx, delay); waitErr != nil {
+		return nil, waitErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func newFailover(options ...dynamo.FailoverOption) (*dynamo.Failover, *fakeClient, *fakeClient) {
+	primary, replica := newFakeClient(), newFakeClient()
+	f := dynamo.NewFailover([]dynamo.Replica{
+		{Name: "us-east-1", Client: primary},
+		{Name: "us-west-2", Client: replica},
+	}, options...)
+	return f, primary, replica
+}
+
+func TestFailover_ReadsFailOver(t *testing.T) {
+	ctx := t.Context()
+	f, primary, replica := newFailover(dynamo.WithFailureThreshold(2), dynamo.WithRecoveryInterval(time.Hour))
+	primary.set(errUnavailable, 0)
+
+	// Failed reads are served by the replica straight away
+	_, err := f.GetItem(ctx, &dynamodb.GetItemInput{})
+	require.NoError(t, err)
+	assert.Equal(t, "us-east-1", f.Active())
+
+	// The threshold switches the active replica
+	_, err = f.GetItem(ctx, &dynamodb.GetItemInput{})
+	require.NoError(t, err)
+	assert.Equal(t, "us-west-2", f.Active())
+
+	primaryGets, _ := primary.calls()
+	_, err = f.GetItem(ctx, &dynamodb.GetItemInput{})
+	require.NoError(t, err)
+	gets, _ := primary.calls()
+	assert.Equal(t, primaryGets, gets, "primary is not called once failed over")
+
+	replicaGets, _ := replica.calls()
+	assert.Equal(t, 3, replicaGets)
+}
+
+func TestFailover_WritesAreNotRetried(t *testing.T) {
+	ctx := t.Context()
+	f, primary, replica := newFailover(dynamo.WithFailureThreshold(1))
+	primary.set(errUnavailable, 0)
+
+	_, err := f.PutItem(ctx, &dynamodb.PutItemInput{})
+	require.ErrorIs(t, err, errUnavailable)
+	_, puts := replica.calls()
+	assert.Zero(t, puts)
+
+	// Later writes go to the new active replica
+	assert.Equal(t, "us-west-2", f.Active())
+	_, err = f.PutItem(ctx, &dynamodb.PutItemInput{})
+	require.NoError(t, err)
+}
+
+func TestFailover_RequestErrorsDoNotCount(t *testing.T) {
+	ctx := t.Context()
+	f, primary, _ := newFailover(dynamo.WithFailureThreshold(1))
+	primary.set(&types.ConditionalCheckFailedException{Message: new(string)}, 0)
+
+	_, err := f.PutItem(ctx, &dynamodb.PutItemInput{})
+	var conditionErr *types.ConditionalCheckFailedException
+	require.ErrorAs(t, err, &conditionErr)
+	assert.Equal(t, "us-east-1", f.Active())
+}
+
+func TestFailover_HungReplica(t *testing.T) {
+	f, primary, _ := newFailover(dynamo.WithFailureThreshold(1))
+	primary.set(nil, time.Hour)
+
+	// A hung read gives up on its share of the deadline and is retried
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second)
+	defer cancel()
+	_, err := f.GetItem(ctx, &dynamodb.GetItemInput{})
+	require.NoError(t, err)
+	assert.Equal(t, "us-west-2", f.Active())
+}
+
+func TestFailover_HungWrite(t *testing.T) {
+	f, primary, replica := newFailover(dynamo.WithFailureThreshold(1))
+	primary.set(nil, time.Hour)
+
+	// A write running out the caller's deadline counts against the replica
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	_, err := f.PutItem(ctx, &dynamodb.PutItemInput{})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	_, puts := replica.calls()
+	assert.Zero(t, puts)
+	assert.Equal(t, "us-west-2", f.Active())
+}
+
+func TestFailover_CanceledCallsDoNotCount(t *testing.T) {
+	f, primary, _ := newFailover(dynamo.WithFailureThreshold(1))
+	primary.set(nil, time.Hour)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	_, err := f.GetItem(ctx, &dynamodb.GetItemInput{})
+	require.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, "us-east-1", f.Active())
+}
+
+func TestFailover_Latency(t *testing.T) {
+	ctx := t.Context()
+	f, primary, _ := newFailover(
+		dynamo.WithFailureThreshold(1),
+		dynamo.WithLatencyThreshold(5*time.Millisecond),
+	)
+	primary.set(nil, 20*time.Millisecond)
+
+	// Slow calls still return their result, but count against the replica
+	_, err := f.GetItem(ctx, &dynamodb.GetItemInput{})
+	require.NoError(t, err)
+	assert.Equal(t, "us-west-2", f.Active())
+}
+
+func TestFailover_SwitchBack(t *testing.T) {
+	ctx := t.Context()
+	f, primary, _ := newFailover(
+		dynamo.WithFailureThreshold(1),
+		dynamo.WithRecoveryInterval(20*time.Millisecond),
+	)
+	primary.set(errUnavailable, 0)
+	_, err := f.GetItem(ctx, &dynamodb.GetItemInput{})
+	require.NoError(t, err)
+	require.Equal(t, "us-west-2", f.Active())
+
+	// A failed probe keeps the replica active
+	time.Sleep(30 * time.Millisecond)
+	_, err = f.GetItem(ctx, &dynamodb.GetItemInput{})
+	require.NoError(t, err)
+	assert.Equal(t, "us-west-2", f.Active())
+
+	// So does a probe that times out
+	primary.set(nil, time.Hour)
+	time.Sleep(30 * time.Millisecond)
+	timeout, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	_, err = f.GetItem(timeout, &dynamodb.GetItemInput{})
+	require.NoError(t, err)
+	assert.Equal(t, "us-west-2", f.Active())
+
+	// Once the primary is healthy the next probe switches back
+	primary.set(nil, 0)
+	time.Sleep(30 * time.Millisecond)
+	_, err = f.GetItem(ctx, &dynamodb.GetItemInput{})
+	require.NoError(t, err)
+	assert.Equal(t, "us-east-1", f.Active())
+}
+
+func TestPrimary(t *testing.T) {
+	f, primary, _ := newFailover()
+	assert.Same(t, primary, dynamo.Primary(f))
+	assert.Same(t, primary, dynamo.Primary(primary))
+}
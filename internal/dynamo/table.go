@@ -0,0 +1,107 @@
+package dynamo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	// TableActiveTimeout bounds how long EnsureTable waits for a table it
+	// created to become active.
+	TableActiveTimeout = 2 * time.Minute
+	// TableCheckTimeout bounds how long CheckTable waits on DynamoDB, so an
+	// unreachable endpoint does not hold up provisioning.
+	TableCheckTimeout = 5 * time.Second
+)
+
+// ErrKeySchema is returned for tables keyed differently than configured.
+var ErrKeySchema = errors.New("table key schema does not match")
+
+// CheckTable describes the table input names. It must be keyed as input
+// describes, otherwise an error wrapping ErrKeySchema is returned. A missing
+// table fails with a ResourceNotFoundException, see IsTableNotFound.
+func CheckTable(ctx context.Context, client Client, input *dynamodb.CreateTableInput) (*types.TableDescription, error) {
+	ctx, cancel := context.WithTimeout(ctx, TableCheckTimeout)
+	defer cancel()
+
+	table := aws.ToString(input.TableName)
+	// A single attempt, as callers carry on without the check if DynamoDB
+	// cannot be reached
+	output, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: input.TableName},
+		func(options *dynamodb.Options) { options.RetryMaxAttempts = 1 })
+	if err != nil {
+		return nil, fmt.Errorf("describing table %s: %w", table, err)
+	}
+	return output.Table, checkKeySchema(table, input, output.Table)
+}
+
+// IsTableNotFound reports whether err is DynamoDB's answer for a missing
+// table.
+func IsTableNotFound(err error) bool {
+	var notFoundErr *types.ResourceNotFoundException
+	return errors.As(err, &notFoundErr)
+}
+
+// EnsureTable creates the table input describes unless it exists, waiting
+// until it is active, and reports whether it did. An existing table is
+// checked with CheckTable.
+func EnsureTable(ctx context.Context, client Client, input *dynamodb.CreateTableInput) (bool, error) {
+	table := aws.ToString(input.TableName)
+	_, err := CheckTable(ctx, client, input)
+	if !IsTableNotFound(err) {
+		return false, err
+	}
+
+	created := true
+	_, err = client.CreateTable(ctx, input)
+	// Another instance may be creating it too
+	var inUseErr *types.ResourceInUseException
+	if errors.As(err, &inUseErr) {
+		created = false
+	} else if err != nil {
+		return false, fmt.Errorf("creating table %s: %w", table, err)
+	}
+	waiter := dynamodb.NewTableExistsWaiter(client)
+	if err = waiter.Wait(ctx, &dynamodb.DescribeTableInput{TableName: input.TableName}, TableActiveTimeout); err != nil {
+		return created, fmt.Errorf("waiting for table %s: %w", table, err)
+	}
+	return created, nil
+}
+
+// checkKeySchema returns an error unless table is keyed as input describes.
+func checkKeySchema(name string, input *dynamodb.CreateTableInput, table *types.TableDescription) error {
+	if table == nil {
+		return fmt.Errorf("table %s: %w: no description", name, ErrKeySchema)
+	}
+	want := describeKeys(input.KeySchema, input.AttributeDefinitions)
+	got := describeKeys(table.KeySchema, table.AttributeDefinitions)
+	if !slices.Equal(want, got) {
+		return fmt.Errorf("table %s: %w: keyed by %s, expected %s",
+			name, ErrKeySchema, strings.Join(got, ", "), strings.Join(want, ", "))
+	}
+	return nil
+}
+
+// describeKeys describes each key of a schema by its name, key type and
+// attribute type, as in "Hostname (HASH, S)".
+func describeKeys(schema []types.KeySchemaElement, attributes []types.AttributeDefinition) []string {
+	keys := make([]string, 0, len(schema))
+	for _, key := range schema {
+		var attributeType types.ScalarAttributeType
+		for _, attribute := range attributes {
+			if aws.ToString(attribute.AttributeName) == aws.ToString(key.AttributeName) {
+				attributeType = attribute.AttributeType
+			}
+		}
+		keys = append(keys, fmt.Sprintf("%s (%s, %s)", aws.ToString(key.AttributeName), key.KeyType, attributeType))
+	}
+	return keys
+}
@@ -0,0 +1,135 @@
+package dynamo_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/CruGlobal/mirage-server/internal/dynamo"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tableClient describes a single table, creating it on demand.
+type tableClient struct {
+	dynamo.Client
+
+	table   *types.TableDescription
+	inUse   bool
+	creates int
+}
+
+func (c *tableClient) DescribeTable(_ context.Context, params *dynamodb.DescribeTableInput, _ ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error) {
+	if c.table == nil {
+		return nil, &types.ResourceNotFoundException{Message: params.TableName}
+	}
+	return &dynamodb.DescribeTableOutput{Table: c.table}, nil
+}
+
+func (c *tableClient) CreateTable(_ context.Context, params *dynamodb.CreateTableInput, _ ...func(*dynamodb.Options)) (*dynamodb.CreateTableOutput, error) {
+	c.creates++
+	c.table = &types.TableDescription{
+		TableName:            params.TableName,
+		TableStatus:          types.TableStatusActive,
+		KeySchema:            params.KeySchema,
+		AttributeDefinitions: params.AttributeDefinitions,
+	}
+	if c.inUse {
+		return nil, &types.ResourceInUseException{}
+	}
+	return &dynamodb.CreateTableOutput{TableDescription: c.table}, nil
+}
+
+func keyedBy(key string, attributeType types.ScalarAttributeType) *dynamodb.CreateTableInput {
+	return &dynamodb.CreateTableInput{
+		TableName: aws.String("Redirects"),
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String(key), KeyType: types.KeyTypeHash},
+		},
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String(key), AttributeType: attributeType},
+		},
+	}
+}
+
+func TestEnsureTable(t *testing.T) {
+	testcases := []struct {
+		name     string
+		existing *dynamodb.CreateTableInput
+		inUse    bool
+		created  bool
+		creates  int
+		err      error
+	}{
+		{
+			name:    "missing",
+			created: true,
+			creates: 1,
+		},
+		{
+			name:    "created by another instance",
+			inUse:   true,
+			creates: 1,
+		},
+		{
+			name:     "existing",
+			existing: keyedBy("Hostname", types.ScalarAttributeTypeS),
+		},
+		{
+			name:     "other key",
+			existing: keyedBy("Domain", types.ScalarAttributeTypeS),
+			err:      dynamo.ErrKeySchema,
+		},
+		{
+			name:     "other key type",
+			existing: keyedBy("Hostname", types.ScalarAttributeTypeN),
+			err:      dynamo.ErrKeySchema,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &tableClient{inUse: tc.inUse}
+			if tc.existing != nil {
+				client.table = &types.TableDescription{
+					TableName:            tc.existing.TableName,
+					TableStatus:          types.TableStatusActive,
+					KeySchema:            tc.existing.KeySchema,
+					AttributeDefinitions: tc.existing.AttributeDefinitions,
+				}
+			}
+
+			created, err := dynamo.EnsureTable(t.Context(), client, keyedBy("Hostname", types.ScalarAttributeTypeS))
+			if tc.err != nil {
+				require.ErrorIs(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.created, created)
+			assert.Equal(t, tc.creates, client.creates)
+		})
+	}
+}
+
+func TestCheckTable(t *testing.T) {
+	client := &tableClient{}
+	_, err := dynamo.CheckTable(t.Context(), client, keyedBy("Hostname", types.ScalarAttributeTypeS))
+	assert.True(t, dynamo.IsTableNotFound(err))
+
+	existing := keyedBy("Domain", types.ScalarAttributeTypeS)
+	client.table = &types.TableDescription{
+		TableName:            existing.TableName,
+		KeySchema:            existing.KeySchema,
+		AttributeDefinitions: existing.AttributeDefinitions,
+	}
+	_, err = dynamo.CheckTable(t.Context(), client, keyedBy("Hostname", types.ScalarAttributeTypeS))
+	require.ErrorIs(t, err, dynamo.ErrKeySchema)
+	assert.False(t, dynamo.IsTableNotFound(err))
+	assert.Zero(t, client.creates, "checking never creates the table")
+
+	table, err := dynamo.CheckTable(t.Context(), client, existing)
+	require.NoError(t, err)
+	assert.Same(t, client.table, table)
+}
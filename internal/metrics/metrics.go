@@ -0,0 +1,228 @@
+package metrics
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "mirage"
+
+// Lookup outcomes.
+const (
+	OutcomeFound    = "found"
+	OutcomeNotFound = "not_found"
+	OutcomeError    = "error"
+	OutcomeInvalid  = "invalid"
+)
+
+// SourceNone labels lookups no source layer had a record for.
+const SourceNone = "none"
+
+// Lookup operations.
+const (
+	OperationGetRedirect        = "get_redirect"
+	OperationCertificateAllowed = "certificate_allowed"
+)
+
+// Cache request results.
+const (
+	ResultHit         = "hit"
+	ResultMiss        = "miss"
+	ResultNegativeHit = "negative_hit"
+	ResultStale       = "stale"
+)
+
+// Certificate storage operations served by its read cache.
+const (
+	StorageLoad   = "load"
+	StorageStat   = "stat"
+	StorageExists = "exists"
+)
+
+// The collectors outlive a single config, like the redirect cache they
+// observe, and are registered with the metrics registry of every config that
+// loads the mirage app so they appear alongside caddy_http_*.
+//
+//nolint:gochecknoglobals // shared across config reloads by design
+var (
+	CacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "requests_total",
+		Help:      "Redirect cache lookups by cache (default, profile/<name> or table/<table>) and result (hit, miss, negative_hit, stale).",
+	}, []string{"cache", "result"})
+
+	CacheEvictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "evictions_total",
+		Help:      "Redirects removed from the cache by reason (expired, capacity, deleted).",
+	}, []string{"reason"})
+
+	CacheEntries = &cacheEntries{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "cache", "entries"),
+			"Fresh redirects held in the redirect caches by cache (default, profile/<name> or table/<table>).",
+			[]string{"cache"}, nil,
+		),
+		lengths: make(map[int]cacheLength),
+	}
+
+	LookupDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "lookup",
+		Name:      "duration_seconds",
+		Help:      "Latency of redirect lookups by operation, source layer that answered (none when no layer had a record) and outcome (found, not_found, error, invalid).",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation", "source", "outcome"})
+
+	Failovers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "dynamodb",
+		Name:      "failovers_total",
+		Help:      "Switches of the active DynamoDB replica by replica switched from and to.",
+	}, []string{"from", "to"})
+
+	UnknownHosts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "unknown_hosts_total",
+		Help:      "Requests for hostnames without a redirect record, by hostname.",
+	}, []string{"host"})
+
+	StorageCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "storage_cache",
+		Name:      "requests_total",
+		Help:      "Certificate storage cache lookups by operation (load, stat, exists) and result (hit, miss, negative_hit).",
+	}, []string{"operation", "result"})
+
+	StorageCacheReadsSaved = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "storage_cache",
+		Name:      "reads_saved_total",
+		Help:      "DynamoDB reads the certificate storage cache answered, counting every chunk of a value.",
+	})
+
+	BreakerOpen = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "dynamodb",
+		Name:      "circuit_open",
+		Help:      "Whether the DynamoDB circuit breaker is open (1) and refusing lookups.",
+	}, []string{"breaker"})
+)
+
+// Register adds the mirage collectors to registry. Collectors that are
+// already registered are skipped.
+func Register(registry *prometheus.Registry) error {
+	if registry == nil {
+		return nil
+	}
+	collectors := []prometheus.Collector{
+		CacheRequests,
+		CacheEvictions,
+		CacheEntries,
+		LookupDuration,
+		Failovers,
+		BreakerOpen,
+		UnknownHosts,
+		StorageCacheRequests,
+		StorageCacheReadsSaved,
+	}
+	for _, collector := range collectors {
+		err := registry.Register(collector)
+		if err != nil && !errors.As(err, &prometheus.AlreadyRegisteredError{}) {
+			return err
+		}
+	}
+	return nil
+}
+
+// cacheEntries collects the size of every live redirect cache. Caches are
+// tracked by name, and those of the same name are added up, as an old and a
+// new cache are both live during a config reload.
+type cacheEntries struct {
+	desc *prometheus.Desc
+
+	mutex   sync.Mutex
+	next    int
+	lengths map[int]cacheLength
+}
+
+type cacheLength struct {
+	name   string
+	length func() int
+}
+
+func (c *cacheEntries) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *cacheEntries) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	entries := make(map[string]int)
+	for _, cache := range c.lengths {
+		entries[cache.name] += cache.length()
+	}
+	c.mutex.Unlock()
+	for name, count := range entries {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(count), name)
+	}
+}
+
+// TrackCacheEntries reports the entries of the named cache, as returned by
+// length, until the returned function is called.
+func TrackCacheEntries(name string, length func() int) func() {
+	CacheEntries.mutex.Lock()
+	defer CacheEntries.mutex.Unlock()
+	id := CacheEntries.next
+	CacheEntries.next++
+	CacheEntries.lengths[id] = cacheLength{name: name, length: length}
+	return func() {
+		CacheEntries.mutex.Lock()
+		defer CacheEntries.mutex.Unlock()
+		delete(CacheEntries.lengths, id)
+	}
+}
+
+// MaxUnknownHosts caps the distinct host labels of UnknownHosts. Further
+// hostnames are counted under HostOther, so clients sending random Host
+// headers cannot grow the series without bound.
+const (
+	MaxUnknownHosts = 1000
+	HostOther       = "other"
+)
+
+//nolint:gochecknoglobals // tracks the labels of UnknownHosts
+var unknownHosts = struct {
+	sync.Mutex
+	seen map[string]bool
+}{seen: make(map[string]bool)}
+
+// ObserveUnknownHost counts a request for a hostname without a redirect.
+func ObserveUnknownHost(hostname string) {
+	hostname = strings.ToLower(hostname)
+	unknownHosts.Lock()
+	if !unknownHosts.seen[hostname] {
+		if len(unknownHosts.seen) >= MaxUnknownHosts {
+			hostname = HostOther
+		} else {
+			unknownHosts.seen[hostname] = true
+		}
+	}
+	unknownHosts.Unlock()
+	UnknownHosts.WithLabelValues(hostname).Inc()
+}
+
+// ObserveLookup records a redirect lookup that started at start, answered by
+// the named source layer, or none if source is empty.
+func ObserveLookup(operation string, source string, outcome string, start time.Time) {
+	if source == "" {
+		source = SourceNone
+	}
+	LookupDuration.WithLabelValues(operation, source, outcome).Observe(time.Since(start).Seconds())
+}
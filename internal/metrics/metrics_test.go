@@ -0,0 +1,76 @@
+package metrics_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/CruGlobal/mirage-server/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics_Register(t *testing.T) {
+	require.NoError(t, metrics.Register(nil))
+
+	registry := prometheus.NewPedanticRegistry()
+	require.NoError(t, metrics.Register(registry))
+
+	// Registering again, as a reused app does, is not an error
+	require.NoError(t, metrics.Register(registry))
+
+	// Every config gets its own registry
+	require.NoError(t, metrics.Register(prometheus.NewPedanticRegistry()))
+}
+
+func TestMetrics_ObserveLookup(t *testing.T) {
+	registry := prometheus.NewPedanticRegistry()
+	require.NoError(t, metrics.Register(registry))
+
+	metrics.ObserveLookup(metrics.OperationGetRedirect, "file", metrics.OutcomeError, time.Now())
+	metrics.ObserveLookup(metrics.OperationGetRedirect, "", metrics.OutcomeNotFound, time.Now())
+
+	count, err := testutil.GatherAndCount(registry, "mirage_lookup_duration_seconds")
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, count, 2)
+
+	// Lookups no source had a record for are labeled none
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	var sources []string
+	for _, family := range families {
+		if family.GetName() != "mirage_lookup_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "source" {
+					sources = append(sources, label.GetValue())
+				}
+			}
+		}
+	}
+	assert.Contains(t, sources, "file")
+	assert.Contains(t, sources, metrics.SourceNone)
+}
+
+func TestMetrics_ObserveUnknownHost(t *testing.T) {
+	before := testutil.ToFloat64(metrics.UnknownHosts.WithLabelValues("unknown.example.org"))
+	metrics.ObserveUnknownHost("Unknown.Example.org")
+	assert.InDelta(t, before+1, testutil.ToFloat64(metrics.UnknownHosts.WithLabelValues("unknown.example.org")), 0)
+
+	// Past the cap new hostnames share one series
+	for i := range metrics.MaxUnknownHosts {
+		metrics.ObserveUnknownHost(fmt.Sprintf("host%d.example.org", i))
+	}
+	other := testutil.ToFloat64(metrics.UnknownHosts.WithLabelValues(metrics.HostOther))
+	metrics.ObserveUnknownHost("late.example.org")
+	assert.InDelta(t, other+1, testutil.ToFloat64(metrics.UnknownHosts.WithLabelValues(metrics.HostOther)), 0)
+	assert.LessOrEqual(t, testutil.CollectAndCount(metrics.UnknownHosts), metrics.MaxUnknownHosts+1)
+
+	// Hosts seen before the cap keep their own series
+	metrics.ObserveUnknownHost("unknown.example.org")
+	assert.InDelta(t, before+2, testutil.ToFloat64(metrics.UnknownHosts.WithLabelValues("unknown.example.org")), 0)
+}
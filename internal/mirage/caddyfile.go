@@ -0,0 +1,116 @@
+package mirage
+
+import (
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	r := NewMirage()
+	err := r.UnmarshalCaddyfile(h.Dispenser)
+	return r, err
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	mirage {
+//	    profile <name>
+//	    table <table_name>
+//	    fallback <url> [<status>] {
+//	        host_param <name>
+//	    }
+//	    on_not_found next|<status>|<url>
+//	    purge_secret <secret>
+//	    on_backend_error next|<status>|<url>
+//	    on_invalid next|<status>|<url>
+//	    debug_headers
+//	}
+func (r *Mirage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			configKey := d.Val()
+			args := d.RemainingArgs()
+
+			switch configKey {
+			case "profile":
+				if len(args) != 1 {
+					return d.ArgErr()
+				}
+				r.Profile = args[0]
+			case "table":
+				if len(args) != 1 {
+					return d.ArgErr()
+				}
+				r.Table = args[0]
+			case "fallback":
+				if len(args) == 0 || len(args) > 2 {
+					return d.ArgErr()
+				}
+				r.OnNotFound = &Response{Location: args[0]}
+				if len(args) == 2 {
+					status, err := strconv.Atoi(args[1])
+					if err != nil {
+						return d.Errf("invalid value for 'fallback': %s", args[1])
+					}
+					r.OnNotFound.Status = status
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "host_param":
+						if !d.Args(&r.OnNotFound.HostParam) || d.NextArg() {
+							return d.ArgErr()
+						}
+					default:
+						return d.Errf("unknown parameter '%s' for 'fallback'", d.Val())
+					}
+				}
+			case "on_not_found":
+				if len(args) != 1 {
+					return d.ArgErr()
+				}
+				r.OnNotFound = parseResponse(args[0])
+			case "purge_secret":
+				if len(args) != 1 {
+					return d.ArgErr()
+				}
+				r.PurgeSecret = args[0]
+			case "on_backend_error":
+				if len(args) != 1 {
+					return d.ArgErr()
+				}
+				r.OnBackendError = parseResponse(args[0])
+			case "on_invalid":
+				if len(args) != 1 {
+					return d.ArgErr()
+				}
+				r.OnInvalid = parseResponse(args[0])
+			case "debug_headers":
+				if len(args) != 0 {
+					return d.ArgErr()
+				}
+				r.DebugHeaders = true
+			default:
+				return d.Errf("unknown parameter '%s' for 'mirage'", configKey)
+			}
+		}
+	}
+	return nil
+}
+
+// parseResponse reads "next", a status code or a redirect URL.
+func parseResponse(value string) *Response {
+	if value == "next" {
+		return &Response{}
+	}
+	if status, err := strconv.Atoi(value); err == nil {
+		return &Response{Status: status}
+	}
+	return &Response{Location: value}
+}
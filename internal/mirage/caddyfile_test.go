@@ -0,0 +1,191 @@
+package mirage_test
+
+import (
+	"testing"
+
+	"github.com/CruGlobal/mirage-server/internal/mirage"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMirage_UnmarshalCaddyfile(t *testing.T) {
+	testcases := []struct {
+		name      string
+		caddyfile string
+		want      mirage.Mirage
+		shouldErr bool
+		err       string
+	}{
+		{
+			name:      "blank",
+			caddyfile: `mirage`,
+		},
+		{
+			name: "empty",
+			caddyfile: `mirage {
+			}`,
+		},
+		{
+			name:      "unexpected",
+			caddyfile: `mirage something`,
+			shouldErr: true,
+			err:       "wrong argument count or unexpected line ending after 'something'",
+		},
+		{
+			name: "valid",
+			caddyfile: `mirage {
+				table SiteRedirects
+				fallback https://www.example.com/?from={http.request.host} 301
+				purge_secret s3cr3t
+				on_backend_error next
+				debug_headers
+			}`,
+			want: mirage.Mirage{
+				Table:          "SiteRedirects",
+				PurgeSecret:    "s3cr3t",
+				DebugHeaders:   true,
+				OnNotFound:     &mirage.Response{Location: "https://www.example.com/?from={http.request.host}", Status: 301},
+				OnBackendError: &mirage.Response{},
+			},
+		},
+		{
+			name: "profile",
+			caddyfile: `mirage {
+				profile partner
+			}`,
+			want: mirage.Mirage{Profile: "partner"},
+		},
+		{
+			name: "fallback without status",
+			caddyfile: `mirage {
+				fallback https://www.example.com
+			}`,
+			want: mirage.Mirage{OnNotFound: &mirage.Response{Location: "https://www.example.com"}},
+		},
+		{
+			name: "fallback with host_param",
+			caddyfile: `mirage {
+				fallback https://www.example.com/welcome 301 {
+					host_param from
+				}
+			}`,
+			want: mirage.Mirage{OnNotFound: &mirage.Response{Location: "https://www.example.com/welcome", Status: 301, HostParam: "from"}},
+		},
+		{
+			name: "on_not_found status",
+			caddyfile: `mirage {
+				on_not_found 404
+			}`,
+			want: mirage.Mirage{OnNotFound: &mirage.Response{Status: 404}},
+		},
+		{
+			name: "on_not_found next",
+			caddyfile: `mirage {
+				on_not_found next
+			}`,
+			want: mirage.Mirage{OnNotFound: &mirage.Response{}},
+		},
+		{
+			name: "invalid fallback option",
+			caddyfile: `mirage {
+				fallback https://www.example.com {
+					status 301
+				}
+			}`,
+			shouldErr: true,
+			err:       "unknown parameter 'status' for 'fallback'",
+		},
+		{
+			name: "missing host_param",
+			caddyfile: `mirage {
+				fallback https://www.example.com {
+					host_param
+				}
+			}`,
+			shouldErr: true,
+			err:       "wrong argument count",
+		},
+		{
+			name: "on_backend_error status",
+			caddyfile: `mirage {
+				on_backend_error 502
+			}`,
+			want: mirage.Mirage{OnBackendError: &mirage.Response{Status: 502}},
+		},
+		{
+			name: "on_backend_error location",
+			caddyfile: `mirage {
+				on_backend_error https://status.example.com
+			}`,
+			want: mirage.Mirage{OnBackendError: &mirage.Response{Location: "https://status.example.com"}},
+		},
+		{
+			name: "on_invalid",
+			caddyfile: `mirage {
+				on_invalid 404
+			}`,
+			want: mirage.Mirage{OnInvalid: &mirage.Response{Status: 404}},
+		},
+		{
+			name: "on_invalid next",
+			caddyfile: `mirage {
+				on_invalid next
+			}`,
+			want: mirage.Mirage{OnInvalid: &mirage.Response{}},
+		},
+		{
+			name: "on_invalid without argument",
+			caddyfile: `mirage {
+				on_invalid
+			}`,
+			shouldErr: true,
+			err:       "wrong argument count or unexpected line ending after 'on_invalid'",
+		},
+		{
+			name: "invalid fallback status",
+			caddyfile: `mirage {
+				fallback https://www.example.com moved
+			}`,
+			shouldErr: true,
+			err:       "invalid value for 'fallback': moved",
+		},
+		{
+			name: "missing table",
+			caddyfile: `mirage {
+				table
+			}`,
+			shouldErr: true,
+			err:       "wrong argument count or unexpected line ending after 'table'",
+		},
+		{
+			name: "debug_headers argument",
+			caddyfile: `mirage {
+				debug_headers on
+			}`,
+			shouldErr: true,
+			err:       "wrong argument count or unexpected line ending after 'on'",
+		},
+		{
+			name: "unknown parameter",
+			caddyfile: `mirage {
+				region us-east-1
+			}`,
+			shouldErr: true,
+			err:       "unknown parameter 'region'",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := mirage.Mirage{}
+			err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tc.caddyfile))
+			if tc.shouldErr {
+				require.ErrorContains(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, m)
+		})
+	}
+}
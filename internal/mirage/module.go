@@ -6,15 +6,16 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"time"
 
 	"github.com/CruGlobal/mirage-server/internal/app"
 	"github.com/CruGlobal/mirage-server/internal/cache"
+	"github.com/CruGlobal/mirage-server/internal/metrics"
+	"github.com/CruGlobal/mirage-server/internal/purge"
 	"github.com/CruGlobal/mirage-server/internal/redirect"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/CruGlobal/mirage-server/internal/source"
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"go.uber.org/zap"
@@ -24,6 +25,8 @@ var (
 	// Interface guards.
 	_ caddy.Provisioner           = (*Mirage)(nil)
 	_ caddy.Module                = (*Mirage)(nil)
+	_ caddy.CleanerUpper          = (*Mirage)(nil)
+	_ caddyfile.Unmarshaler       = (*Mirage)(nil)
 	_ caddyhttp.MiddlewareHandler = (*Mirage)(nil)
 )
 
@@ -33,19 +36,38 @@ func init() {
 }
 
 type Mirage struct {
-	Table  string           `json:"-"`
-	Key    string           `json:"-"`
-	Client *dynamodb.Client `json:"-"`
-	Cache  cache.Cache      `json:"-"`
+	Source source.RedirectSource `json:"-"`
+	Cache  cache.Cache           `json:"-"`
+	Purge  *purge.Authorizer     `json:"-"`
 
-	logger *zap.Logger
+	// Profile serves redirects from one of the app's named profiles instead
+	// of its default sources.
+	Profile string `json:"profile,omitempty"`
+	// Table looks redirects up in this DynamoDB table instead of the app's
+	// sources, with a cache of its own.
+	Table string `json:"table,omitempty"`
+	// PurgeSecret signs purge_cache tokens for this site instead of the
+	// app's secret. The app's allowlist and interval still apply.
+	PurgeSecret string `json:"purge_secret,omitempty"`
+	// DebugHeaders adds X-Mirage-Outcome and X-Mirage-Source response headers.
+	DebugHeaders bool `json:"debug_headers,omitempty"`
+
+	// OnNotFound answers hostnames without a redirect. By default the
+	// request is handed to the next handler.
+	OnNotFound *Response `json:"on_not_found,omitempty"`
+	// OnBackendError answers lookups that failed with no cached copy to
+	// fall back on. Defaults to a 503 error.
+	OnBackendError *Response `json:"on_backend_error,omitempty"`
+	// OnInvalid answers hostnames whose record could not be read. Defaults
+	// to a 500 error.
+	OnInvalid *Response `json:"on_invalid,omitempty"`
+
+	logger       *zap.Logger
+	releaseCache func() error
 }
 
 func NewMirage() *Mirage {
-	return &Mirage{
-		Table: app.DefaultTable,
-		Key:   app.DefaultKey,
-	}
+	return &Mirage{}
 }
 
 func (r Mirage) CaddyModule() caddy.ModuleInfo {
@@ -73,20 +95,71 @@ func (r *Mirage) Provision(ctx caddy.Context) error {
 		return errors.New("mirage has not been initialized")
 	}
 
-	if m.Client == nil {
-		return errors.New("DynamoDB client has not been initialized")
+	if m.Source == nil {
+		return errors.New("redirect source has not been initialized")
 	}
 
-	r.Client = m.Client
-	r.Table = m.Table
+	r.Source = m.Source
 	r.Cache = m.Cache
+	r.Purge = m.Purge
+
+	repl := caddy.NewReplacer()
+	r.Profile = repl.ReplaceAll(r.Profile, "")
+	r.Table = repl.ReplaceAll(r.Table, "")
+	if r.Profile != "" && r.Table != "" {
+		return errors.New("profile and table cannot both be set")
+	}
+	if r.Profile != "" {
+		profile, err := m.Profile(r.Profile)
+		if err != nil {
+			return err
+		}
+		r.Source = profile.Source
+		r.Cache = profile.Cache
+	}
+	if r.Table != "" {
+		r.Source = m.TableSource(r.Table)
+		r.Cache, r.releaseCache, err = m.TableCache(r.Table)
+		if err != nil {
+			return err
+		}
+	}
+
+	r.PurgeSecret = repl.ReplaceAll(r.PurgeSecret, "")
+	if r.PurgeSecret != "" {
+		r.Purge, err = purge.NewAuthorizer(r.PurgeSecret, m.PurgeAllow, time.Duration(m.PurgeInterval))
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.OnBackendError == nil {
+		r.OnBackendError = &Response{Status: http.StatusServiceUnavailable}
+	}
+	if r.OnInvalid == nil {
+		r.OnInvalid = &Response{Status: http.StatusInternalServerError}
+	}
+	for outcome, resp := range map[Outcome]*Response{
+		OutcomeNotFound:     r.OnNotFound,
+		OutcomeBackendError: r.OnBackendError,
+		OutcomeInvalid:      r.OnInvalid,
+	} {
+		if err = resp.validate(outcome); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
-func parseCaddyfile(_ httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
-	// Mirage has no configuration, so we just return a new instance
-	return NewMirage(), nil
+// Cleanup releases the handler's own cache when it overrides the table.
+func (r *Mirage) Cleanup() error {
+	if r.releaseCache == nil {
+		return nil
+	}
+	err := r.releaseCache()
+	r.releaseCache = nil
+	return err
 }
 
 func (r Mirage) ServeHTTP(writer http.ResponseWriter, request *http.Request, next caddyhttp.Handler) error {
@@ -101,25 +174,53 @@ func (r Mirage) ServeHTTP(writer http.ResponseWriter, request *http.Request, nex
 		hostname = request.Host // Probably OK, host just didn't have a port
 	}
 
-	// Get redirect either from cache or DynamoDB
-	redir := r.GetRedirect(request.Context(), hostname, request.URL.Query().Has("purge_cache"))
-	if redir != nil {
-		// If we have a redirect, process it
-		err = redir.Process(request, repl)
-		if err != nil {
-			return caddyhttp.Error(http.StatusGone, err)
-		}
+	// Only honor authorized purges, and strip the parameter so it is never
+	// forwarded to the redirect location
+	purgeCache := false
+	if request.URL.Query().Has(purge.Param) {
+		purgeCache = r.authorizePurge(request, hostname)
+		request.URL.RawQuery = purge.StripParam(request.URL.RawQuery)
+	}
 
-		// Tell search engines not to index redirects flagged NoIndex
-		if redir.NoIndex {
-			writer.Header().Set("X-Robots-Tag", "noindex")
+	// Get redirect either from cache or the redirect source
+	redir, outcome, err := r.GetRedirect(request.Context(), hostname, purgeCache)
+	repl.Set("http.mirage.outcome", outcome.String())
+	if r.DebugHeaders {
+		writer.Header().Set("X-Mirage-Outcome", outcome.String())
+		if redir != nil && redir.Source != "" {
+			writer.Header().Set("X-Mirage-Source", redir.Source)
 		}
 	}
+	switch outcome {
+	case OutcomeNotFound:
+		metrics.ObserveUnknownHost(hostname)
+		return r.OnNotFound.respond(writer, request, next, fmt.Errorf("no redirect for hostname: %s", hostname))
+	case OutcomeBackendError:
+		return r.OnBackendError.respond(writer, request, next, err)
+	case OutcomeInvalid:
+		return r.OnInvalid.respond(writer, request, next, err)
+	case OutcomeFound:
+	}
+
+	// If we have a redirect, process it
+	err = redir.Process(request, repl)
+	if err != nil {
+		return caddyhttp.Error(http.StatusGone, err)
+	}
+
+	// Tell search engines not to index redirects flagged NoIndex
+	if redir.NoIndex {
+		writer.Header().Set("X-Robots-Tag", "noindex")
+	}
+
 	// Pass control to the next handler
 	return next.ServeHTTP(writer, request)
 }
 
-func (r *Mirage) GetRedirect(ctx context.Context, hostname string, purgeCache bool) *redirect.Redirect {
+// GetRedirect returns the redirect for hostname from the cache or the redirect
+// source, and how the lookup turned out. Backend errors and invalid records
+// are logged and returned with their error.
+func (r *Mirage) GetRedirect(ctx context.Context, hostname string, purgeCache bool) (*redirect.Redirect, Outcome, error) {
 	if purgeCache {
 		r.logger.Debug("purging cache", zap.String("hostname", hostname))
 		r.Cache.Delete(hostname)
@@ -127,29 +228,46 @@ func (r *Mirage) GetRedirect(ctx context.Context, hostname string, purgeCache bo
 
 	var redir redirect.Redirect
 	err := r.Cache.Get(hostname, &redir)
-	if err != nil {
-		var item *dynamodb.GetItemOutput
-		item, err = r.Client.GetItem(ctx, &dynamodb.GetItemInput{
-			TableName: aws.String(r.Table),
-			Key: map[string]types.AttributeValue{
-				r.Key: &types.AttributeValueMemberS{Value: hostname},
-			},
-		})
-		if err != nil {
-			return nil
-		}
-		if item.Item == nil {
-			return nil
-		}
+	if errors.Is(err, cache.ErrNegative) {
+		r.logger.Debug("negative cache hit", zap.String("hostname", hostname))
+		return nil, OutcomeNotFound, nil
+	}
+	if err == nil {
+		r.logger.Debug("cache hit", zap.String("hostname", hostname), zap.String("source", redir.Source))
+		return &redir, OutcomeFound, nil
+	}
 
-		err = attributevalue.UnmarshalMap(item.Item, &redir)
-		if err != nil {
-			return nil
-		}
-		r.Cache.Set(redir)
-		r.logger.Debug("cache set", zap.String("hostname", hostname))
-		return &redir
+	start := time.Now()
+	found, err := r.Source.Lookup(ctx, hostname)
+	layer := source.LayerOf(found, err)
+	switch {
+	case err == nil:
+		metrics.ObserveLookup(metrics.OperationGetRedirect, layer, metrics.OutcomeFound, start)
+		r.Cache.Set(*found)
+		r.logger.Debug("cache set", zap.String("hostname", hostname), zap.String("source", found.Source))
+		return found, OutcomeFound, nil
+	case errors.Is(err, source.ErrNotFound):
+		metrics.ObserveLookup(metrics.OperationGetRedirect, layer, metrics.OutcomeNotFound, start)
+		r.Cache.Forget(hostname)
+		r.Cache.SetMissing(hostname)
+		return nil, OutcomeNotFound, nil
+	case errors.Is(err, source.ErrInvalid):
+		metrics.ObserveLookup(metrics.OperationGetRedirect, layer, metrics.OutcomeInvalid, start)
+		r.logger.Error("invalid redirect record", zap.String("hostname", hostname), zap.Error(err))
+		return nil, OutcomeInvalid, err
+	}
+
+	metrics.ObserveLookup(metrics.OperationGetRedirect, layer, metrics.OutcomeError, start)
+	// Serve the last-known-good copy rather than dropping the redirect while
+	// the source is unavailable or throttling.
+	if staleErr := r.Cache.GetStale(hostname, &redir); staleErr == nil {
+		r.logger.Warn("serving last-known-good redirect",
+			zap.String("hostname", hostname),
+			zap.String("source", redir.Source),
+			zap.Error(err),
+		)
+		return &redir, OutcomeFound, nil
 	}
-	r.logger.Debug("cache hit", zap.String("hostname", hostname))
-	return &redir
+	r.logger.Error("redirect lookup failed", zap.String("hostname", hostname), zap.Error(err))
+	return nil, OutcomeBackendError, err
 }
@@ -7,10 +7,10 @@ import (
 	"regexp"
 	"testing"
 
-	"github.com/CruGlobal/mirage-server/internal/app"
 	"github.com/CruGlobal/mirage-server/internal/cache"
 	"github.com/CruGlobal/mirage-server/internal/mirage"
 	"github.com/CruGlobal/mirage-server/internal/redirect"
+	"github.com/CruGlobal/mirage-server/internal/source"
 	"github.com/CruGlobal/mirage-server/miragetest"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
@@ -27,8 +27,6 @@ func TestMirage_NewMirage(t *testing.T) {
 	r := mirage.NewMirage()
 	assert.NotNil(t, r)
 	assert.IsType(t, &mirage.Mirage{}, r)
-	assert.Equal(t, app.DefaultTable, r.Table)
-	assert.Equal(t, app.DefaultKey, r.Key)
 }
 
 func TestMirage_CaddyModule(t *testing.T) {
@@ -41,7 +39,7 @@ func TestMirage_CaddyModule(t *testing.T) {
 func TestMirage_Provision(t *testing.T) {
 	ctx := miragetest.NewMirageCaddyContext(t, miragetest.TestConfig{
 		Region:   "us-east-1",
-		Endpoint: "http://example.com:8000",
+		Endpoint: miragetest.ClosedEndpoint,
 		Table:    "MirageServerConfigTest",
 		Key:      "Hostname",
 	})
@@ -50,16 +48,18 @@ func TestMirage_Provision(t *testing.T) {
 	err := r.Provision(ctx)
 	require.NoError(t, err)
 
-	assert.NotNil(t, r.Client)
 	assert.IsType(t, &cache.RedirectCache{}, r.Cache)
-	assert.Equal(t, "MirageServerConfigTest", r.Table)
-	assert.Equal(t, "Hostname", r.Key)
+	ddb := miragetest.DynamoDBSource(t, r.Source)
+	assert.NotNil(t, ddb.Client)
+	assert.Equal(t, "MirageServerConfigTest", ddb.Table)
+	assert.Equal(t, "Hostname", ddb.Key)
 }
 
 type MirageTestSuite struct {
 	suite.Suite
 
 	mirage *mirage.Mirage
+	source *source.DynamoDB
 	ddbc   *tcddb.DynamoDBContainer
 }
 
@@ -79,6 +79,7 @@ func (ts *MirageTestSuite) SetupSuite() {
 	ts.Require().NoError(err)
 
 	ts.mirage = r
+	ts.source = miragetest.DynamoDBSource(ts.T(), r.Source)
 }
 
 func (ts *MirageTestSuite) TearDownSuite() {
@@ -138,13 +139,13 @@ var redirects = []redirect.Redirect{
 
 // SetupTest creates the table before each test.
 func (ts *MirageTestSuite) SetupTest() {
-	miragetest.CreateDynamoDBTable(ts.T(), ts.mirage.Client, ts.mirage.Table, ts.mirage.Key)
+	miragetest.CreateDynamoDBTable(ts.T(), ts.source.Client, ts.source.Table, ts.source.Key)
 
 	for _, r := range redirects {
 		item, err := attributevalue.MarshalMap(r)
 		ts.Require().NoError(err)
-		_, err = ts.mirage.Client.PutItem(ts.T().Context(), &dynamodb.PutItemInput{
-			TableName: aws.String(ts.mirage.Table),
+		_, err = ts.source.Client.PutItem(ts.T().Context(), &dynamodb.PutItemInput{
+			TableName: aws.String(ts.source.Table),
 			Item:      item,
 		})
 		ts.Require().NoError(err)
@@ -153,7 +154,7 @@ func (ts *MirageTestSuite) SetupTest() {
 
 // TearDownTest deletes the table after each test.
 func (ts *MirageTestSuite) TearDownTest() {
-	miragetest.DeleteDynamoDBTable(ts.T(), ts.mirage.Client, ts.mirage.Table)
+	miragetest.DeleteDynamoDBTable(ts.T(), ts.source.Client, ts.source.Table)
 }
 
 // TestMirageTestSuite runs the test suite.
@@ -210,16 +211,46 @@ func (ts *MirageTestSuite) TestMirage_GetRedirect() {
 	}
 	for _, tc := range tests {
 		ts.Run(tc.name, func() {
-			r := ts.mirage.GetRedirect(ts.T().Context(), tc.hostname, tc.purgeCache)
+			r, outcome, err := ts.mirage.GetRedirect(ts.T().Context(), tc.hostname, tc.purgeCache)
+			ts.Require().NoError(err)
 			if tc.expectErr {
 				ts.Require().Nil(r)
+				ts.Equal(mirage.OutcomeNotFound, outcome)
 			} else {
-				ts.Equal(tc.expect, *r)
+				ts.Equal(mirage.OutcomeFound, outcome)
+				expect := tc.expect
+				expect.Source = "dynamodb"
+				ts.Equal(expect, *r)
 			}
 		})
 	}
 }
 
+func (ts *MirageTestSuite) TestMirage_GetRedirectLastKnownGood() {
+	ctx := ts.T().Context()
+
+	r, _, err := ts.mirage.GetRedirect(ctx, "www.example.com", true)
+	ts.Require().NoError(err)
+	ts.Require().NotNil(r)
+
+	// Point at a missing table so every lookup fails
+	table := ts.source.Table
+	ts.source.Table = "MirageServerConfigMissing"
+	defer func() { ts.source.Table = table }()
+
+	r, outcome, err := ts.mirage.GetRedirect(ctx, "www.example.com", true)
+	ts.Require().NoError(err)
+	ts.Equal(mirage.OutcomeFound, outcome)
+	ts.Require().NotNil(r)
+	ts.Equal(redirects[0].Location, r.Location)
+	ts.Equal("dynamodb", r.Source)
+
+	r, outcome, err = ts.mirage.GetRedirect(ctx, "example.edu", true)
+	ts.Require().Error(err)
+	ts.Equal(mirage.OutcomeBackendError, outcome)
+	ts.Nil(r)
+}
+
 type MockCaddyHandler struct {
 	mock.Mock
 }
@@ -278,6 +309,15 @@ func (ts *MirageTestSuite) TestMirage_ServeHTTP() {
 				"http.mirage.redirect.status":   redirect.StatusTemporary.StatusCode(),
 			},
 		},
+		{
+			name: "purge parameter is not forwarded",
+			url:  "https://forward-qs.example.com/page?utm_source=google&purge_cache=1.abc&utm_medium=cpc",
+			expect: map[string]any{
+				"http.mirage.type":              redirect.TypeRedirect.String(),
+				"http.mirage.redirect.location": "https://target.example.com/page?utm_source=google&utm_medium=cpc",
+				"http.mirage.redirect.status":   redirect.StatusTemporary.StatusCode(),
+			},
+		},
 		{
 			name: "noindex redirect sets X-Robots-Tag",
 			url:  "https://noindex.example.com",
@@ -0,0 +1,29 @@
+package mirage
+
+// Outcome is the result of looking up a hostname's redirect.
+type Outcome int
+
+const (
+	// OutcomeFound means a redirect was found, possibly a last-known-good copy.
+	OutcomeFound Outcome = iota
+	// OutcomeNotFound means the hostname has no redirect.
+	OutcomeNotFound
+	// OutcomeBackendError means the source failed and no copy was cached.
+	OutcomeBackendError
+	// OutcomeInvalid means the hostname's record could not be read.
+	OutcomeInvalid
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case OutcomeFound:
+		return "found"
+	case OutcomeNotFound:
+		return "not_found"
+	case OutcomeBackendError:
+		return "backend_error"
+	case OutcomeInvalid:
+		return "invalid"
+	}
+	return "unknown"
+}
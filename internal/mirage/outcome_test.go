@@ -0,0 +1,357 @@
+package mirage_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/CruGlobal/mirage-server/internal/dynamo"
+	"github.com/CruGlobal/mirage-server/internal/mirage"
+	"github.com/CruGlobal/mirage-server/internal/redirect"
+	"github.com/CruGlobal/mirage-server/internal/source"
+	"github.com/CruGlobal/mirage-server/miragetest"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+var errUnavailable = errors.New("service unavailable")
+
+// fakeSource answers lookups from memory, failing for hostnames in errs.
+type fakeSource struct {
+	redirects map[string]redirect.Redirect
+	errs      map[string]error
+}
+
+func (f *fakeSource) Lookup(_ context.Context, hostname string) (*redirect.Redirect, error) {
+	if err, ok := f.errs[hostname]; ok {
+		return nil, err
+	}
+	redir, ok := f.redirects[hostname]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", hostname, source.ErrNotFound)
+	}
+	return &redir, nil
+}
+
+func (f *fakeSource) List(_ context.Context) ([]redirect.Redirect, error) {
+	return nil, nil
+}
+
+func (f *fakeSource) Watch(_ context.Context, _ func(hostnames ...string)) error {
+	return nil
+}
+
+func newOutcomeMirage(t *testing.T, configure func(m *mirage.Mirage)) *mirage.Mirage {
+	t.Helper()
+	ctx := miragetest.NewMirageCaddyContext(t, miragetest.TestConfig{
+		Region:   "us-east-1",
+		Endpoint: miragetest.ClosedEndpoint,
+		Table:    "MirageServerConfigTest",
+		Key:      "Hostname",
+	})
+
+	m := mirage.NewMirage()
+	if configure != nil {
+		configure(m)
+	}
+	require.NoError(t, m.Provision(ctx))
+	m.Source = &fakeSource{
+		redirects: map[string]redirect.Redirect{
+			"found.outcome.test": {Hostname: "found.outcome.test", Location: "example.com"},
+		},
+		errs: map[string]error{
+			"down.outcome.test":    errUnavailable,
+			"invalid.outcome.test": fmt.Errorf("invalid.outcome.test: %w: bad Status", source.ErrInvalid),
+		},
+	}
+	return m
+}
+
+func TestMirage_GetRedirectOutcome(t *testing.T) {
+	m := newOutcomeMirage(t, nil)
+
+	tests := []struct {
+		hostname string
+		outcome  mirage.Outcome
+		err      error
+	}{
+		{hostname: "found.outcome.test", outcome: mirage.OutcomeFound},
+		{hostname: "missing.outcome.test", outcome: mirage.OutcomeNotFound},
+		{hostname: "down.outcome.test", outcome: mirage.OutcomeBackendError, err: errUnavailable},
+		{hostname: "invalid.outcome.test", outcome: mirage.OutcomeInvalid, err: source.ErrInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.outcome.String(), func(t *testing.T) {
+			r, outcome, err := m.GetRedirect(t.Context(), tt.hostname, true)
+			assert.Equal(t, tt.outcome, outcome)
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				assert.Nil(t, r)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+// recordClient answers GetItem with a single record.
+type recordClient struct {
+	dynamo.Client
+
+	item map[string]types.AttributeValue
+}
+
+func (c *recordClient) GetItem(_ context.Context, _ *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: c.item}, nil
+}
+
+func TestMirage_InvalidRecord(t *testing.T) {
+	m := newOutcomeMirage(t, nil)
+	client := &recordClient{item: map[string]types.AttributeValue{
+		"Hostname": &types.AttributeValueMemberS{Value: "broken.outcome.test"},
+		"Location": &types.AttributeValueMemberS{Value: "www.example.com"},
+		"Rewrites": &types.AttributeValueMemberS{Value: "not a list"},
+	}}
+	m.Source = &source.DynamoDB{Client: client, Table: "MirageServerConfigTest", Key: "Hostname"}
+
+	// A record that cannot be read is answered by OnInvalid
+	r, outcome, err := m.GetRedirect(t.Context(), "broken.outcome.test", true)
+	require.ErrorIs(t, err, source.ErrInvalid)
+	assert.Nil(t, r)
+	assert.Equal(t, mirage.OutcomeInvalid, outcome)
+
+	// One with a rewrite that does not compile is still found
+	client.item = map[string]types.AttributeValue{
+		"Hostname": &types.AttributeValueMemberS{Value: "regexp.outcome.test"},
+		"Location": &types.AttributeValueMemberS{Value: "www.example.com"},
+		"Rewrites": &types.AttributeValueMemberL{Value: []types.AttributeValue{
+			&types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+				"RegExp": &types.AttributeValueMemberS{Value: "(unclosed"},
+			}},
+		}},
+	}
+	r, outcome, err = m.GetRedirect(t.Context(), "regexp.outcome.test", true)
+	require.NoError(t, err)
+	assert.Equal(t, mirage.OutcomeFound, outcome)
+	assert.Equal(t, "www.example.com", r.Location)
+}
+
+func TestMirage_ProvisionResponses(t *testing.T) {
+	ctx := miragetest.NewMirageCaddyContext(t, miragetest.TestConfig{
+		Region:   "us-east-1",
+		Endpoint: miragetest.ClosedEndpoint,
+		Table:    "MirageServerConfigTest",
+		Key:      "Hostname",
+	})
+
+	m := mirage.NewMirage()
+	require.NoError(t, m.Provision(ctx))
+	assert.Nil(t, m.OnNotFound)
+	assert.Equal(t, &mirage.Response{Status: http.StatusServiceUnavailable}, m.OnBackendError)
+	assert.Equal(t, &mirage.Response{Status: http.StatusInternalServerError}, m.OnInvalid)
+
+	m = mirage.NewMirage()
+	m.OnNotFound = &mirage.Response{Location: "https://example.com", Status: http.StatusOK}
+	require.ErrorContains(t, m.Provision(ctx), "not_found: redirect status must be 3xx, got 200")
+
+	m = mirage.NewMirage()
+	m.OnBackendError = &mirage.Response{Status: 999}
+	require.ErrorContains(t, m.Provision(ctx), "backend_error: invalid status 999")
+
+	m = mirage.NewMirage()
+	m.OnNotFound = &mirage.Response{Status: http.StatusNotFound, HostParam: "from"}
+	require.ErrorContains(t, m.Provision(ctx), "not_found: host_param requires a location")
+}
+
+func TestMirage_ServeHTTPOutcome(t *testing.T) {
+	tests := []struct {
+		name       string
+		configure  func(m *mirage.Mirage)
+		host       string
+		status     int
+		location   string
+		nextCalled bool
+	}{
+		{
+			name:       "not found hands off to next",
+			host:       "missing.outcome.test",
+			nextCalled: true,
+		},
+		{
+			name: "not found redirects to fallback",
+			configure: func(m *mirage.Mirage) {
+				m.OnNotFound = &mirage.Response{Location: "https://www.example.com/?from={http.request.host}"}
+			},
+			host:       "missing.outcome.test",
+			location:   "https://www.example.com/?from=missing.outcome.test",
+			status:     http.StatusFound,
+			nextCalled: true,
+		},
+		{
+			name: "not found passes the host to the fallback",
+			configure: func(m *mirage.Mirage) {
+				m.OnNotFound = &mirage.Response{Location: "https://www.example.com/?utm_source=mirage", HostParam: "from"}
+			},
+			host:       "missing.outcome.test",
+			location:   "https://www.example.com/?from=missing.outcome.test&utm_source=mirage",
+			status:     http.StatusFound,
+			nextCalled: true,
+		},
+		{
+			name: "not found status page",
+			configure: func(m *mirage.Mirage) {
+				m.OnNotFound = &mirage.Response{Status: http.StatusNotFound}
+			},
+			host:   "missing.outcome.test",
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "backend error defaults to 503",
+			host:   "down.outcome.test",
+			status: http.StatusServiceUnavailable,
+		},
+		{
+			name: "backend error hands off to next",
+			configure: func(m *mirage.Mirage) {
+				m.OnBackendError = &mirage.Response{}
+			},
+			host:       "down.outcome.test",
+			nextCalled: true,
+		},
+		{
+			name:   "invalid record defaults to 500",
+			host:   "invalid.outcome.test",
+			status: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newOutcomeMirage(t, tt.configure)
+
+			w := httptest.NewRecorder()
+			repl := caddy.NewReplacer()
+			ctx := context.WithValue(t.Context(), caddy.ReplacerCtxKey, repl)
+			r, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+tt.host, nil)
+			require.NoError(t, err)
+			repl.Set("http.request.host", tt.host)
+
+			next := new(MockCaddyHandler)
+			next.On("ServeHTTP", mock.Anything, mock.Anything).Return(nil)
+
+			err = m.ServeHTTP(w, r, next)
+			if tt.nextCalled {
+				require.NoError(t, err)
+				next.AssertNumberOfCalls(t, "ServeHTTP", 1)
+			} else {
+				var handlerErr caddyhttp.HandlerError
+				require.ErrorAs(t, err, &handlerErr)
+				assert.Equal(t, tt.status, handlerErr.StatusCode)
+				next.AssertNotCalled(t, "ServeHTTP", mock.Anything, mock.Anything)
+			}
+
+			if tt.location != "" {
+				location, _ := repl.Get("http.mirage.redirect.location")
+				assert.Equal(t, tt.location, location)
+				status, _ := repl.Get("http.mirage.redirect.status")
+				assert.Equal(t, tt.status, status)
+			}
+		})
+	}
+}
+
+func TestMirage_ProvisionOverrides(t *testing.T) {
+	ctx := miragetest.NewMirageCaddyContext(t, miragetest.TestConfig{
+		Region:   "us-east-1",
+		Endpoint: miragetest.ClosedEndpoint,
+		Table:    "MirageServerConfigTest",
+		Key:      "Hostname",
+	})
+
+	shared := mirage.NewMirage()
+	require.NoError(t, shared.Provision(ctx))
+
+	m := mirage.NewMirage()
+	m.Table = "SiteRedirects"
+	m.PurgeSecret = "s3cr3t"
+	require.NoError(t, m.Provision(ctx))
+	t.Cleanup(func() { require.NoError(t, m.Cleanup()) })
+
+	assert.NotSame(t, shared.Cache, m.Cache)
+	assert.NotSame(t, shared.Purge, m.Purge)
+	src := miragetest.DynamoDBSource(t, m.Source)
+	assert.Equal(t, "SiteRedirects", src.Table)
+	assert.Equal(t, "Hostname", src.Key)
+}
+
+func TestMirage_DebugHeaders(t *testing.T) {
+	m := newOutcomeMirage(t, func(m *mirage.Mirage) {
+		m.DebugHeaders = true
+	})
+	m.Source.(*fakeSource).redirects["debug.outcome.test"] = redirect.Redirect{
+		Hostname: "debug.outcome.test",
+		Location: "example.com",
+		Source:   "dynamodb",
+	}
+
+	tests := []struct {
+		host    string
+		outcome string
+		source  string
+	}{
+		{host: "debug.outcome.test", outcome: "found", source: "dynamodb"},
+		{host: "missing.debug.outcome.test", outcome: "not_found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.outcome, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			repl := caddy.NewReplacer()
+			ctx := context.WithValue(t.Context(), caddy.ReplacerCtxKey, repl)
+			r, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+tt.host, nil)
+			require.NoError(t, err)
+			repl.Set("http.request.host", tt.host)
+
+			next := new(MockCaddyHandler)
+			next.On("ServeHTTP", mock.Anything, mock.Anything).Return(nil)
+
+			require.NoError(t, m.ServeHTTP(w, r, next))
+			assert.Equal(t, tt.outcome, w.Header().Get("X-Mirage-Outcome"))
+			assert.Equal(t, tt.source, w.Header().Get("X-Mirage-Source"))
+		})
+	}
+}
+
+func TestMirage_ProvisionProfile(t *testing.T) {
+	ctx := miragetest.NewMirageCaddyContext(t, miragetest.TestConfig{
+		Region:   "us-east-1",
+		Endpoint: miragetest.ClosedEndpoint,
+		Table:    "MirageServerConfigTest",
+		Key:      "Hostname",
+		Profiles: map[string]miragetest.TestProfile{
+			"partner": {Table: "PartnerRedirects", Key: "Domain"},
+		},
+	})
+
+	m := mirage.NewMirage()
+	m.Profile = "partner"
+	require.NoError(t, m.Provision(ctx))
+	src := miragetest.DynamoDBSource(t, m.Source)
+	assert.Equal(t, "PartnerRedirects", src.Table)
+	assert.Equal(t, "Domain", src.Key)
+
+	m = mirage.NewMirage()
+	m.Profile = "unknown"
+	require.ErrorContains(t, m.Provision(ctx), "unknown mirage profile: unknown")
+
+	m = mirage.NewMirage()
+	m.Profile = "partner"
+	m.Table = "SiteRedirects"
+	require.ErrorContains(t, m.Provision(ctx), "profile and table cannot both be set")
+}
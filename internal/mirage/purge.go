@@ -0,0 +1,39 @@
+package mirage
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/CruGlobal/mirage-server/internal/purge"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// authorizePurge reports whether the purge_cache parameter on request may
+// evict hostname from the cache, logging who purged what.
+func (r *Mirage) authorizePurge(request *http.Request, hostname string) bool {
+	clientIP, _ := caddyhttp.GetVar(request.Context(), caddyhttp.ClientIPVarKey).(string)
+	token := request.URL.Query().Get(purge.Param)
+
+	method, err := r.Purge.Authorize(hostname, clientIP, token)
+	if err != nil {
+		logger := r.logger.Debug
+		if errors.Is(err, purge.ErrRateLimited) {
+			logger = r.logger.Info
+		}
+		logger("cache purge rejected",
+			zap.String("hostname", hostname),
+			zap.String("client_ip", clientIP),
+			zap.Error(err),
+		)
+		return false
+	}
+
+	r.logger.Info("cache purge",
+		zap.String("hostname", hostname),
+		zap.String("client_ip", clientIP),
+		zap.String("method", string(method)),
+		zap.String("user_agent", request.UserAgent()),
+	)
+	return true
+}
@@ -0,0 +1,84 @@
+package mirage
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/CruGlobal/mirage-server/internal/redirect"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Response is how the handler answers a lookup that did not find a redirect.
+// With a location the request is redirected there, with only a status the
+// request fails with that status so handle_errors can render it, and an empty
+// response hands the request to the next handler.
+type Response struct {
+	// Location is a URL to redirect to. Placeholders are replaced.
+	Location string `json:"location,omitempty"`
+	// Status is the HTTP status code. It defaults to 302 for redirects.
+	Status int `json:"status,omitempty"`
+	// HostParam adds the requested hostname to the location as this query
+	// parameter, so the destination can tell where the visitor was headed.
+	HostParam string `json:"host_param,omitempty"`
+}
+
+func (resp *Response) validate(outcome Outcome) error {
+	if resp == nil {
+		return nil
+	}
+	if resp.Location != "" && resp.Status != 0 && (resp.Status < 300 || resp.Status > 399) {
+		return fmt.Errorf("%s: redirect status must be 3xx, got %d", outcome, resp.Status)
+	}
+	if resp.Status != 0 && (resp.Status < 100 || resp.Status > 599) {
+		return fmt.Errorf("%s: invalid status %d", outcome, resp.Status)
+	}
+	if resp.HostParam != "" && resp.Location == "" {
+		return fmt.Errorf("%s: host_param requires a location", outcome)
+	}
+	return nil
+}
+
+// respond answers the request with resp, or passes it to next.
+func (resp *Response) respond(writer http.ResponseWriter, request *http.Request, next caddyhttp.Handler, err error) error {
+	if resp == nil || (resp.Location == "" && resp.Status == 0) {
+		return next.ServeHTTP(writer, request)
+	}
+
+	if resp.Location == "" {
+		return caddyhttp.Error(resp.Status, err)
+	}
+
+	// Redirect through the same placeholders as a found record
+	repl := request.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer) //nolint:errcheck // value is always set
+	status := resp.Status
+	if status == 0 {
+		status = redirect.StatusTemporary.StatusCode()
+	}
+	location := repl.ReplaceAll(resp.Location, "")
+	if resp.HostParam != "" {
+		host, _ := repl.GetString("http.request.host")
+		location, err = addQueryParam(location, resp.HostParam, host)
+		if err != nil {
+			return caddyhttp.Error(http.StatusInternalServerError, err)
+		}
+	}
+	repl.Set("http.mirage.type", redirect.TypeRedirect.String())
+	repl.Set("http.mirage.redirect.location", location)
+	repl.Set("http.mirage.redirect.status", status)
+	return next.ServeHTTP(writer, request)
+}
+
+// addQueryParam sets the query parameter name to value in location, keeping
+// any query the location already has.
+func addQueryParam(location string, name string, value string) (string, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", fmt.Errorf("invalid location %q: %w", location, err)
+	}
+	query := u.Query()
+	query.Set(name, value)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
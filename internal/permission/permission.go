@@ -4,11 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/CruGlobal/mirage-server/internal/app"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/CruGlobal/mirage-server/internal/dynamo"
+	"github.com/CruGlobal/mirage-server/internal/metrics"
+	"github.com/CruGlobal/mirage-server/internal/source"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"go.uber.org/zap"
 
@@ -25,9 +26,14 @@ var (
 )
 
 type Permission struct {
-	Table  string           `json:"-"`
-	Key    string           `json:"-"`
-	Client *dynamodb.Client `json:"-"`
+	Source source.RedirectSource `json:"-"`
+
+	// Profile checks hostnames against one of the mirage app's named
+	// profiles instead of its default sources.
+	Profile string `json:"profile,omitempty"`
+	// Credentials override the mirage app's credentials. The permission then
+	// checks the DynamoDB table of the app, or of its profile, directly.
+	Credentials *dynamo.Credentials `json:"credentials,omitempty"`
 
 	logger *zap.Logger
 }
@@ -37,10 +43,7 @@ func init() {
 }
 
 func NewPermission() *Permission {
-	return &Permission{
-		Table: app.DefaultTable,
-		Key:   app.DefaultKey,
-	}
+	return &Permission{}
 }
 
 func (p Permission) CaddyModule() caddy.ModuleInfo {
@@ -52,11 +55,47 @@ func (p Permission) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
+// UnmarshalCaddyfile sets up the permission from Caddyfile tokens. Syntax:
+//
+//	permission dynamodb {
+//	    profile <name>
+//	    aws_profile <name>
+//	    role_arn <arn>
+//	    external_id <id>
+//	    session_name <name>
+//	    web_identity_token_file <path>
+//	    access_key_id <key>
+//	    secret_access_key <secret>
+//	    session_token <token>
+//	}
 func (p *Permission) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for d.Next() {
-		if d.Next() {
+		if d.NextArg() {
 			return d.ArgErr()
 		}
+
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			configKey := d.Val()
+			var configVal string
+
+			if !d.Args(&configVal) {
+				return d.ArgErr()
+			}
+
+			switch configKey {
+			case "profile":
+				p.Profile = configVal
+			default:
+				creds := p.Credentials
+				if creds == nil {
+					creds = new(dynamo.Credentials)
+				}
+				if !creds.Set(configKey, configVal) {
+					return d.Errf("unknown parameter '%s' for 'permission dynamodb'", configKey)
+				}
+				p.Credentials = creds
+			}
+		}
 	}
 	return nil
 }
@@ -77,29 +116,52 @@ func (p *Permission) Provision(ctx caddy.Context) error {
 		return errors.New("mirage has not been initialized")
 	}
 
-	if mirageApp.Client == nil {
-		return errors.New("DynamoDB client has not been initialized")
+	if mirageApp.Source == nil {
+		return errors.New("redirect source has not been initialized")
 	}
 
-	p.Client = mirageApp.Client
-	p.Table = mirageApp.Table
-	p.Key = mirageApp.Key
+	p.Source = mirageApp.Source
+
+	table, key := mirageApp.Table, mirageApp.Key
+	p.Profile = caddy.NewReplacer().ReplaceAll(p.Profile, "")
+	if p.Profile != "" {
+		profile, err := mirageApp.Profile(p.Profile)
+		if err != nil {
+			return err
+		}
+		p.Source = profile.Source
+		table, key = profile.Table, profile.Key
+	}
+
+	if p.Credentials != nil {
+		client, err := mirageApp.NewClient(ctx, p.Credentials)
+		if err != nil {
+			return err
+		}
+		p.Source = mirageApp.ClientSource("permission", client, table, key)
+	}
 
 	return nil
 }
 
 func (p *Permission) CertificateAllowed(ctx context.Context, name string) error {
-	item, err := p.Client.GetItem(ctx, &dynamodb.GetItemInput{
-		TableName: aws.String(p.Table),
-		Key: map[string]types.AttributeValue{
-			p.Key: &types.AttributeValueMemberS{Value: name},
-		},
-	})
-	if err != nil {
-		return fmt.Errorf("%s: %w (error looking up %w)", name, caddytls.ErrPermissionDenied, err)
+	start := time.Now()
+	found, err := p.Source.Lookup(ctx, name)
+	layer := source.LayerOf(found, err)
+	if errors.Is(err, source.ErrNotFound) {
+		metrics.ObserveLookup(metrics.OperationCertificateAllowed, layer, metrics.OutcomeNotFound, start)
+		return fmt.Errorf("%s: %w", name, caddytls.ErrPermissionDenied)
 	}
-	if item.Item != nil {
+	if errors.Is(err, source.ErrInvalid) {
+		// The hostname has a record, even if the handler cannot serve it
+		metrics.ObserveLookup(metrics.OperationCertificateAllowed, layer, metrics.OutcomeInvalid, start)
+		p.logger.Warn("invalid redirect record", zap.String("hostname", name), zap.Error(err))
 		return nil
 	}
-	return fmt.Errorf("%s: %w", name, caddytls.ErrPermissionDenied)
+	if err != nil {
+		metrics.ObserveLookup(metrics.OperationCertificateAllowed, layer, metrics.OutcomeError, start)
+		return fmt.Errorf("%s: %w (error looking up %w)", name, caddytls.ErrPermissionDenied, err)
+	}
+	metrics.ObserveLookup(metrics.OperationCertificateAllowed, layer, metrics.OutcomeFound, start)
+	return nil
 }
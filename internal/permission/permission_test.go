@@ -4,7 +4,9 @@ import (
 	"testing"
 
 	"github.com/CruGlobal/mirage-server/internal/app"
+	"github.com/CruGlobal/mirage-server/internal/dynamo"
 	"github.com/CruGlobal/mirage-server/internal/permission"
+	"github.com/CruGlobal/mirage-server/internal/source"
 	"github.com/CruGlobal/mirage-server/miragetest"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
@@ -21,8 +23,6 @@ func TestPermission_NewPermission(t *testing.T) {
 	perm := permission.NewPermission()
 	assert.NotNil(t, perm)
 	assert.IsType(t, &permission.Permission{}, perm)
-	assert.Equal(t, app.DefaultTable, perm.Table)
-	assert.Equal(t, app.DefaultKey, perm.Key)
 }
 
 func TestPermission_CaddyModule(t *testing.T) {
@@ -36,6 +36,7 @@ func TestPermission_UnmarshalCaddyfile(t *testing.T) {
 	testcases := []struct {
 		name      string
 		caddyfile string
+		profile   string
 		expectErr bool
 	}{
 		{
@@ -49,9 +50,30 @@ func TestPermission_UnmarshalCaddyfile(t *testing.T) {
 			expectErr: true,
 		},
 		{
-			name: "invalid2",
+			name: "empty block",
 			caddyfile: `dynamodb {
 			}`,
+		},
+		{
+			name: "profile",
+			caddyfile: `dynamodb {
+				profile partner
+			}`,
+			profile: "partner",
+		},
+		{
+			name: "credentials",
+			caddyfile: `dynamodb {
+				profile partner
+				aws_profile partner-account
+			}`,
+			profile: "partner",
+		},
+		{
+			name: "missing profile",
+			caddyfile: `dynamodb {
+				profile
+			}`,
 			expectErr: true,
 		},
 		{
@@ -78,6 +100,7 @@ func TestPermission_UnmarshalCaddyfile(t *testing.T) {
 				return
 			}
 			require.NoError(t, err)
+			assert.Equal(t, tc.profile, p.Profile)
 		})
 	}
 }
@@ -85,7 +108,7 @@ func TestPermission_UnmarshalCaddyfile(t *testing.T) {
 func TestPermission_Provision(t *testing.T) {
 	ctx := miragetest.NewMirageCaddyContext(t, miragetest.TestConfig{
 		Region:   "us-east-1",
-		Endpoint: "http://example.com:8000",
+		Endpoint: miragetest.ClosedEndpoint,
 		Table:    "MirageServerConfigTest",
 		Key:      "Hostname",
 	})
@@ -94,15 +117,66 @@ func TestPermission_Provision(t *testing.T) {
 	err := perm.Provision(ctx)
 	require.NoError(t, err)
 
-	assert.NotNil(t, perm.Client)
-	assert.Equal(t, "MirageServerConfigTest", perm.Table)
-	assert.Equal(t, "Hostname", perm.Key)
+	ddb := miragetest.DynamoDBSource(t, perm.Source)
+	assert.NotNil(t, ddb.Client)
+	assert.Equal(t, "MirageServerConfigTest", ddb.Table)
+	assert.Equal(t, "Hostname", ddb.Key)
+}
+
+func TestPermission_ProvisionCredentials(t *testing.T) {
+	ctx := miragetest.NewMirageCaddyContext(t, miragetest.TestConfig{
+		Region:   "us-east-1",
+		Endpoint: miragetest.ClosedEndpoint,
+		Table:    "MirageServerConfigTest",
+		Key:      "Hostname",
+		Profiles: map[string]miragetest.TestProfile{
+			"partner": {Table: "PartnerRedirects", Key: "Domain"},
+		},
+	})
+	module, err := ctx.App(app.AppName)
+	require.NoError(t, err)
+	mirageApp := module.(*app.App)
+
+	perm := permission.NewPermission()
+	perm.Profile = "partner"
+	perm.Credentials = &dynamo.Credentials{AccessKeyID: "local", SecretAccessKey: "local"}
+	require.NoError(t, perm.Provision(ctx))
+
+	ddb := miragetest.DynamoDBSource(t, perm.Source)
+	assert.Equal(t, "PartnerRedirects", ddb.Table)
+	assert.Equal(t, "Domain", ddb.Key)
+	assert.NotSame(t, mirageApp.Client, ddb.Client)
+	assert.NotSame(t, mirageApp.Breaker, ddb.Breaker)
+}
+
+func TestPermission_ProvisionProfile(t *testing.T) {
+	ctx := miragetest.NewMirageCaddyContext(t, miragetest.TestConfig{
+		Region:   "us-east-1",
+		Endpoint: miragetest.ClosedEndpoint,
+		Table:    "MirageServerConfigTest",
+		Key:      "Hostname",
+		Profiles: map[string]miragetest.TestProfile{
+			"partner": {Table: "PartnerRedirects", Key: "Domain"},
+		},
+	})
+
+	perm := permission.NewPermission()
+	perm.Profile = "partner"
+	require.NoError(t, perm.Provision(ctx))
+	ddb := miragetest.DynamoDBSource(t, perm.Source)
+	assert.Equal(t, "PartnerRedirects", ddb.Table)
+	assert.Equal(t, "Domain", ddb.Key)
+
+	perm = permission.NewPermission()
+	perm.Profile = "unknown"
+	require.ErrorContains(t, perm.Provision(ctx), "unknown mirage profile: unknown")
 }
 
 type PermissionTestSuite struct {
 	suite.Suite
 
 	permission *permission.Permission
+	source     *source.DynamoDB
 	ddbc       *tcddb.DynamoDBContainer
 }
 
@@ -121,6 +195,7 @@ func (ts *PermissionTestSuite) SetupSuite() {
 	err := perm.Provision(ctx)
 	ts.Require().NoError(err)
 	ts.permission = perm
+	ts.source = miragetest.DynamoDBSource(ts.T(), perm.Source)
 }
 
 func (ts *PermissionTestSuite) TearDownSuite() {
@@ -131,11 +206,11 @@ func (ts *PermissionTestSuite) TearDownSuite() {
 }
 
 func (ts *PermissionTestSuite) SetupTest() {
-	miragetest.CreateDynamoDBTable(ts.T(), ts.permission.Client, ts.permission.Table, ts.permission.Key)
+	miragetest.CreateDynamoDBTable(ts.T(), ts.source.Client, ts.source.Table, ts.source.Key)
 }
 
 func (ts *PermissionTestSuite) TearDownTest() {
-	miragetest.DeleteDynamoDBTable(ts.T(), ts.permission.Client, ts.permission.Table)
+	miragetest.DeleteDynamoDBTable(ts.T(), ts.source.Client, ts.source.Table)
 }
 
 func (ts *PermissionTestSuite) TestPermission_CertificateAllowed() {
@@ -144,10 +219,10 @@ func (ts *PermissionTestSuite) TestPermission_CertificateAllowed() {
 	invalidKeys := []string{"www.starkindustries.com", "ftp.example.com"}
 
 	for _, key := range validKeys {
-		_, err := ts.permission.Client.PutItem(ctx, &dynamodb.PutItemInput{
-			TableName: aws.String(ts.permission.Table),
+		_, err := ts.source.Client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(ts.source.Table),
 			Item: map[string]types.AttributeValue{
-				ts.permission.Key: &types.AttributeValueMemberS{Value: key},
+				ts.source.Key: &types.AttributeValueMemberS{Value: key},
 			},
 		})
 		ts.Require().NoError(err)
@@ -0,0 +1,54 @@
+package purge
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+)
+
+const DefaultTokenTTL = 15 * time.Minute
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "mirage-purge-token",
+		Usage: "--host <hostname> [--secret <secret>] [--ttl <duration>]",
+		Short: "Generates a signed token for purging a cached redirect",
+		Long: `
+Generates a token for the purge_cache query parameter that evicts a hostname
+from the mirage redirect cache. The secret must match purge_secret in the
+mirage global option. It is read from the MIRAGE_PURGE_SECRET environment
+variable when --secret is not given.
+
+Example:
+  https://<hostname>/?purge_cache=<token>
+`,
+		CobraFunc: func(cmd *cobra.Command) {
+			cmd.Flags().String("host", "", "Hostname to purge")
+			cmd.Flags().String("secret", "", "Purge secret (default $MIRAGE_PURGE_SECRET)")
+			cmd.Flags().Duration("ttl", DefaultTokenTTL, "How long the token is valid")
+			cmd.RunE = caddycmd.WrapCommandFuncForCobra(cmdPurgeToken)
+		},
+	})
+}
+
+func cmdPurgeToken(fl caddycmd.Flags) (int, error) {
+	hostname := fl.String("host")
+	if hostname == "" {
+		return caddy.ExitCodeFailedStartup, errors.New("--host is required")
+	}
+	secret := fl.String("secret")
+	if secret == "" {
+		secret = os.Getenv("MIRAGE_PURGE_SECRET")
+	}
+	if secret == "" {
+		return caddy.ExitCodeFailedStartup, errors.New("--secret or MIRAGE_PURGE_SECRET is required")
+	}
+
+	fmt.Println(Token(secret, hostname, time.Now().Add(fl.Duration("ttl")))) //nolint:forbidigo // command output
+	return caddy.ExitCodeSuccess, nil
+}
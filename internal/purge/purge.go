@@ -0,0 +1,191 @@
+package purge
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Param is the query parameter that requests a cache purge.
+	Param           = "purge_cache"
+	DefaultInterval = 10 * time.Second
+)
+
+var (
+	ErrDisabled     = errors.New("cache purging is not configured")
+	ErrUnauthorized = errors.New("purge not authorized")
+	ErrRateLimited  = errors.New("purge rate limited")
+)
+
+// Method describes how a purge was authorized.
+type Method string
+
+const (
+	MethodToken     Method = "token"
+	MethodAllowlist Method = "allowlist"
+)
+
+// Token returns a purge token for hostname that is valid until expires. The
+// token is "<unix expiry>.<hex HMAC-SHA256 of hostname and expiry>".
+func Token(secret string, hostname string, expires time.Time) string {
+	expiry := strconv.FormatInt(expires.Unix(), 10)
+	return expiry + "." + sign(secret, hostname, expiry)
+}
+
+func sign(secret string, hostname string, expiry string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.ToLower(hostname) + "\n" + expiry))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Authorizer decides whether a purge request may evict a hostname. Purges are
+// allowed with a valid token or from an allowlisted client IP, and each
+// hostname may only be purged once per interval.
+type Authorizer struct {
+	secret   string
+	allow    []netip.Prefix
+	interval time.Duration
+
+	mutex *sync.Mutex
+	last  map[string]time.Time
+	now   func() time.Time
+}
+
+// NewAuthorizer creates an Authorizer. allow holds IP addresses or CIDR ranges.
+func NewAuthorizer(secret string, allow []string, interval time.Duration) (*Authorizer, error) {
+	a := &Authorizer{
+		secret:   secret,
+		interval: interval,
+		mutex:    &sync.Mutex{},
+		last:     make(map[string]time.Time),
+		now:      time.Now,
+	}
+	for _, value := range allow {
+		prefix, err := parsePrefix(value)
+		if err != nil {
+			return nil, err
+		}
+		a.allow = append(a.allow, prefix)
+	}
+	return a, nil
+}
+
+func parsePrefix(value string) (netip.Prefix, error) {
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid purge allowlist range %q: %w", value, err)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid purge allowlist address %q: %w", value, err)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Enabled reports whether any purge authorization is configured.
+func (a *Authorizer) Enabled() bool {
+	return a != nil && (a.secret != "" || len(a.allow) > 0)
+}
+
+// Authorize checks a purge of hostname requested by clientIP with token. It
+// returns how the purge was authorized, or an error if it must be ignored.
+func (a *Authorizer) Authorize(hostname string, clientIP string, token string) (Method, error) {
+	if !a.Enabled() {
+		return "", ErrDisabled
+	}
+
+	var method Method
+	switch {
+	case a.validToken(hostname, token):
+		method = MethodToken
+	case a.allowed(clientIP):
+		method = MethodAllowlist
+	default:
+		return "", ErrUnauthorized
+	}
+
+	if !a.take(strings.ToLower(hostname)) {
+		return method, ErrRateLimited
+	}
+	return method, nil
+}
+
+func (a *Authorizer) validToken(hostname string, token string) bool {
+	if a.secret == "" || token == "" {
+		return false
+	}
+	expiry, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	expires, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || a.now().Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(sign(a.secret, hostname, expiry)))
+}
+
+func (a *Authorizer) allowed(clientIP string) bool {
+	addr, err := netip.ParseAddr(clientIP)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range a.allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// take records a purge of hostname unless one happened within the interval.
+func (a *Authorizer) take(hostname string) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := a.now()
+	if last, ok := a.last[hostname]; ok && now.Sub(last) < a.interval {
+		return false
+	}
+	a.last[hostname] = now
+
+	// Forget hostnames whose interval has passed so the map stays small
+	for name, last := range a.last {
+		if now.Sub(last) >= a.interval {
+			delete(a.last, name)
+		}
+	}
+	return true
+}
+
+// StripParam removes the purge parameter from a raw query string, keeping the
+// order of the remaining parameters. Keys are compared decoded, as
+// url.ParseQuery reads them, so an encoded purge parameter is removed too.
+func StripParam(rawQuery string) string {
+	if rawQuery == "" {
+		return rawQuery
+	}
+	params := strings.Split(rawQuery, "&")
+	kept := params[:0]
+	for _, param := range params {
+		key, _, _ := strings.Cut(param, "=")
+		if key, err := url.QueryUnescape(key); err == nil && key == Param {
+			continue
+		}
+		kept = append(kept, param)
+	}
+	return strings.Join(kept, "&")
+}
@@ -0,0 +1,207 @@
+package purge_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CruGlobal/mirage-server/internal/purge"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthorizer_NewAuthorizer(t *testing.T) {
+	a, err := purge.NewAuthorizer("", nil, purge.DefaultInterval)
+	require.NoError(t, err)
+	assert.False(t, a.Enabled())
+
+	a, err = purge.NewAuthorizer("", []string{"10.0.0.0/8", "192.168.1.1", "::1"}, purge.DefaultInterval)
+	require.NoError(t, err)
+	assert.True(t, a.Enabled())
+
+	_, err = purge.NewAuthorizer("", []string{"10.0.0.0/33"}, purge.DefaultInterval)
+	require.Error(t, err)
+
+	_, err = purge.NewAuthorizer("", []string{"localhost"}, purge.DefaultInterval)
+	require.Error(t, err)
+}
+
+func TestAuthorizer_Authorize(t *testing.T) {
+	const secret = "s3cr3t"
+	valid := purge.Token(secret, "www.example.com", time.Now().Add(time.Minute))
+
+	testcases := []struct {
+		name     string
+		secret   string
+		allow    []string
+		hostname string
+		clientIP string
+		token    string
+		method   purge.Method
+		err      error
+	}{
+		{
+			name:     "disabled",
+			hostname: "www.example.com",
+			token:    valid,
+			err:      purge.ErrDisabled,
+		},
+		{
+			name:     "valid token",
+			secret:   secret,
+			hostname: "www.example.com",
+			clientIP: "203.0.113.10",
+			token:    valid,
+			method:   purge.MethodToken,
+		},
+		{
+			name:     "token hostname is case insensitive",
+			secret:   secret,
+			hostname: "WWW.Example.com",
+			token:    valid,
+			method:   purge.MethodToken,
+		},
+		{
+			name:     "token for another hostname",
+			secret:   secret,
+			hostname: "example.org",
+			token:    valid,
+			err:      purge.ErrUnauthorized,
+		},
+		{
+			name:     "token with another secret",
+			secret:   "other",
+			hostname: "www.example.com",
+			token:    valid,
+			err:      purge.ErrUnauthorized,
+		},
+		{
+			name:     "expired token",
+			secret:   secret,
+			hostname: "www.example.com",
+			token:    purge.Token(secret, "www.example.com", time.Now().Add(-time.Minute)),
+			err:      purge.ErrUnauthorized,
+		},
+		{
+			name:     "malformed token",
+			secret:   secret,
+			hostname: "www.example.com",
+			token:    "garbage",
+			err:      purge.ErrUnauthorized,
+		},
+		{
+			name:     "empty token",
+			secret:   secret,
+			hostname: "www.example.com",
+			err:      purge.ErrUnauthorized,
+		},
+		{
+			name:     "allowlisted range",
+			allow:    []string{"10.16.0.0/16"},
+			hostname: "www.example.com",
+			clientIP: "10.16.4.2",
+			method:   purge.MethodAllowlist,
+		},
+		{
+			name:     "allowlisted IPv4-mapped address",
+			allow:    []string{"10.16.0.0/16"},
+			hostname: "www.example.com",
+			clientIP: "::ffff:10.16.4.2",
+			method:   purge.MethodAllowlist,
+		},
+		{
+			name:     "not allowlisted",
+			allow:    []string{"10.16.0.0/16"},
+			hostname: "www.example.com",
+			clientIP: "203.0.113.10",
+			err:      purge.ErrUnauthorized,
+		},
+		{
+			name:     "invalid client IP",
+			allow:    []string{"10.16.0.0/16"},
+			hostname: "www.example.com",
+			clientIP: "unknown",
+			err:      purge.ErrUnauthorized,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			a, err := purge.NewAuthorizer(tc.secret, tc.allow, purge.DefaultInterval)
+			require.NoError(t, err)
+
+			method, err := a.Authorize(tc.hostname, tc.clientIP, tc.token)
+			if tc.err != nil {
+				require.ErrorIs(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.method, method)
+		})
+	}
+}
+
+func TestAuthorizer_RateLimit(t *testing.T) {
+	a, err := purge.NewAuthorizer("", []string{"10.0.0.0/8"}, 50*time.Millisecond)
+	require.NoError(t, err)
+
+	_, err = a.Authorize("www.example.com", "10.0.0.1", "")
+	require.NoError(t, err)
+
+	// Limited per hostname
+	_, err = a.Authorize("www.example.com", "10.0.0.2", "")
+	require.ErrorIs(t, err, purge.ErrRateLimited)
+	_, err = a.Authorize("example.org", "10.0.0.1", "")
+	require.NoError(t, err)
+
+	time.Sleep(60 * time.Millisecond)
+	_, err = a.Authorize("www.example.com", "10.0.0.1", "")
+	require.NoError(t, err)
+}
+
+func TestStripParam(t *testing.T) {
+	testcases := []struct {
+		name     string
+		rawQuery string
+		expected string
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:     "only purge",
+			rawQuery: "purge_cache",
+			expected: "",
+		},
+		{
+			name:     "purge with token",
+			rawQuery: "purge_cache=123.abc",
+			expected: "",
+		},
+		{
+			name:     "keeps order of other params",
+			rawQuery: "utm_source=google&purge_cache=123.abc&utm_medium=cpc&a=1",
+			expected: "utm_source=google&utm_medium=cpc&a=1",
+		},
+		{
+			name:     "encoded purge",
+			rawQuery: "a=1&purge%5Fcache=123.abc&purge%5fcache&b=2",
+			expected: "a=1&b=2",
+		},
+		{
+			name:     "invalid encoding",
+			rawQuery: "a%zz=1&purge_cache",
+			expected: "a%zz=1",
+		},
+		{
+			name:     "no purge",
+			rawQuery: "foo=bar&baz=qux",
+			expected: "foo=bar&baz=qux",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, purge.StripParam(tc.rawQuery))
+		})
+	}
+}
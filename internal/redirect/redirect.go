@@ -1,9 +1,11 @@
 package redirect
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"slices"
 
 	"github.com/caddyserver/caddy/v2"
 )
@@ -16,6 +18,34 @@ type Redirect struct {
 	Rewrites           []Rewrite `dynamodbav:"Rewrites"`
 	ForwardQueryString bool      `dynamodbav:"ForwardQueryString"`
 	NoIndex            bool      `dynamodbav:"NoIndex"`
+	Tags               []string  `dynamodbav:"Tags,omitempty"`
+
+	// Source names the redirect source the record was read from.
+	Source string `dynamodbav:"-" json:",omitempty"`
+}
+
+// HasTag reports whether the redirect is tagged with tag.
+func (r *Redirect) HasTag(tag string) bool {
+	return slices.Contains(r.Tags, tag)
+}
+
+// Validate reports records that could never be served.
+func (r *Redirect) Validate() error {
+	if r.Hostname == "" {
+		return errors.New("hostname is empty")
+	}
+	if r.Type == TypeProxy {
+		return fmt.Errorf("proxy not implemented (hostname: %s)", r.Hostname)
+	}
+	if r.Location == "" {
+		return fmt.Errorf("location is empty (hostname: %s)", r.Hostname)
+	}
+	for i, rewrite := range r.Rewrites {
+		if rewrite.RegExp.Regexp == nil {
+			return fmt.Errorf("rewrite %d has no regexp (hostname: %s)", i, r.Hostname)
+		}
+	}
+	return nil
 }
 
 func (r *Redirect) Process(request *http.Request, repl *caddy.Replacer) error {
@@ -33,6 +63,10 @@ func (r *Redirect) Process(request *http.Request, repl *caddy.Replacer) error {
 		location.RawQuery = request.URL.RawQuery
 	}
 
+	if r.Source != "" {
+		repl.Set("http.mirage.source", r.Source)
+	}
+
 	switch r.Type {
 	case TypeRedirect:
 		repl.Set("http.mirage.type", r.Type.String())
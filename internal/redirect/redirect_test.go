@@ -32,6 +32,18 @@ func TestRedirect_Prefix(t *testing.T) {
 				Location: "example.com",
 			},
 		},
+		{
+			name: "source placeholder",
+			url:  "https://www.example.com",
+			expect: map[string]any{
+				"http.mirage.source":            "file",
+				"http.mirage.redirect.location": "https://example.com",
+			},
+			redirect: redirect.Redirect{
+				Location: "example.com",
+				Source:   "file",
+			},
+		},
 		{
 			name:      "temporary redirect",
 			url:       "https://www.example.com",
@@ -296,3 +308,61 @@ func TestRedirect_RewritePath(t *testing.T) {
 		})
 	}
 }
+
+func TestRedirect_Validate(t *testing.T) {
+	tests := []struct {
+		name     string
+		redirect redirect.Redirect
+		err      string
+	}{
+		{
+			name: "valid",
+			redirect: redirect.Redirect{
+				Hostname: "www.example.com",
+				Location: "example.com",
+				Rewrites: []redirect.Rewrite{
+					{RegExp: redirect.RewriteRegexp{Regexp: regexp.MustCompile("^(.*)$")}},
+				},
+			},
+		},
+		{
+			name:     "missing hostname",
+			redirect: redirect.Redirect{Location: "example.com"},
+			err:      "hostname is empty",
+		},
+		{
+			name:     "missing location",
+			redirect: redirect.Redirect{Hostname: "www.example.com"},
+			err:      "location is empty (hostname: www.example.com)",
+		},
+		{
+			name: "proxy",
+			redirect: redirect.Redirect{
+				Hostname: "www.example.com",
+				Type:     redirect.TypeProxy,
+				Location: "example.com",
+			},
+			err: "proxy not implemented (hostname: www.example.com)",
+		},
+		{
+			name: "rewrite without regexp",
+			redirect: redirect.Redirect{
+				Hostname: "www.example.com",
+				Location: "example.com",
+				Rewrites: []redirect.Rewrite{{Replace: "/"}},
+			},
+			err: "rewrite 0 has no regexp (hostname: www.example.com)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.redirect.Validate()
+			if tt.err != "" {
+				require.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
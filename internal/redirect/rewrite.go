@@ -1,6 +1,7 @@
 package redirect
 
 import (
+	"encoding/json"
 	"regexp"
 
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
@@ -17,6 +18,26 @@ type RewriteRegexp struct {
 	*regexp.Regexp
 }
 
+func (rr RewriteRegexp) MarshalText() ([]byte, error) {
+	if rr.Regexp == nil {
+		return []byte{}, nil
+	}
+	return []byte(rr.String()), nil
+}
+
+func (rr *RewriteRegexp) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		rr.Regexp = nil
+		return nil
+	}
+	regex, err := regexp.Compile(string(text))
+	if err != nil {
+		return err
+	}
+	rr.Regexp = regex
+	return nil
+}
+
 func (rr RewriteRegexp) MarshalDynamoDBAttributeValue() (types.AttributeValue, error) {
 	return &types.AttributeValueMemberS{Value: rr.String()}, nil
 }
@@ -58,3 +79,20 @@ func (r *Rewrite) UnmarshalDynamoDBAttributeValue(value types.AttributeValue) er
 	r.Final = rewrite.Final
 	return nil
 }
+
+func (r *Rewrite) UnmarshalJSON(data []byte) error {
+	type Alias Rewrite
+	// Defaults for missing fields, matching records read from DynamoDB
+	rewrite := &Alias{
+		Replace: "$1",
+		Final:   true,
+	}
+
+	err := json.Unmarshal(data, rewrite)
+	if err != nil {
+		return err
+	}
+
+	*r = Rewrite(*rewrite)
+	return nil
+}
@@ -1,6 +1,7 @@
 package redirect_test
 
 import (
+	"encoding/json"
 	"regexp"
 	"testing"
 
@@ -107,3 +108,49 @@ func TestRewrite_Unmarshal(t *testing.T) {
 		})
 	}
 }
+
+func TestRewrite_UnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		expected  redirect.Rewrite
+		expectErr bool
+	}{
+		{
+			name:  "valid",
+			input: `{"RegExp":"^/foo(.*)$","Replace":"/bar$1","Final":false}`,
+			expected: redirect.Rewrite{
+				RegExp:  redirect.RewriteRegexp{Regexp: regexp.MustCompile("^/foo(.*)$")},
+				Replace: "/bar$1",
+				Final:   false,
+			},
+		},
+		{
+			name:  "defaults",
+			input: `{"RegExp":"^(.*)$"}`,
+			expected: redirect.Rewrite{
+				RegExp:  redirect.RewriteRegexp{Regexp: regexp.MustCompile("^(.*)$")},
+				Replace: "$1",
+				Final:   true,
+			},
+		},
+		{
+			name:      "invalid regexp",
+			input:     `{"RegExp":"[abc"}`,
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var result redirect.Rewrite
+			err := json.Unmarshal([]byte(tt.input), &result)
+			if tt.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package redirect
 
 import (
+	"fmt"
 	"net/http"
 
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
@@ -66,3 +67,21 @@ func (s *Status) UnmarshalDynamoDBAttributeValue(value types.AttributeValue) err
 	}
 	return nil
 }
+
+func (s Status) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *Status) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "":
+		*s = DefaultStatus
+	case statusNames()[StatusTemporary]:
+		*s = StatusTemporary
+	case statusNames()[StatusPermanent]:
+		*s = StatusPermanent
+	default:
+		return fmt.Errorf("unknown redirect status: %s", text)
+	}
+	return nil
+}
@@ -143,3 +143,46 @@ func TestStatus_UnmarshalDynamoDBAttributeValue(t *testing.T) {
 		})
 	}
 }
+
+func TestStatus_UnmarshalText(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		expected  redirect.Status
+		expectErr bool
+	}{
+		{
+			name:     "empty",
+			input:    "",
+			expected: redirect.StatusTemporary,
+		},
+		{
+			name:     "TEMPORARY",
+			input:    "TEMPORARY",
+			expected: redirect.StatusTemporary,
+		},
+		{
+			name:     "PERMANENT",
+			input:    "PERMANENT",
+			expected: redirect.StatusPermanent,
+		},
+		{
+			name:      "unknown status",
+			input:     "FOO",
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var result redirect.Status
+			err := result.UnmarshalText([]byte(tt.input))
+			if tt.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
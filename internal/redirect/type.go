@@ -1,6 +1,10 @@
 package redirect
 
-import "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
 
 type Type int
 
@@ -52,3 +56,21 @@ func (t *Type) UnmarshalDynamoDBAttributeValue(value types.AttributeValue) error
 	}
 	return nil
 }
+
+func (t Type) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+func (t *Type) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "":
+		*t = DefaultType
+	case typeNames()[TypeRedirect]:
+		*t = TypeRedirect
+	case typeNames()[TypeProxy]:
+		*t = TypeProxy
+	default:
+		return fmt.Errorf("unknown redirect type: %s", text)
+	}
+	return nil
+}
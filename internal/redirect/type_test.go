@@ -113,3 +113,46 @@ func TestType_UnmarshalDynamoDBAttributeValue(t *testing.T) {
 		})
 	}
 }
+
+func TestType_UnmarshalText(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		expected  redirect.Type
+		expectErr bool
+	}{
+		{
+			name:     "empty",
+			input:    "",
+			expected: redirect.TypeRedirect,
+		},
+		{
+			name:     "REDIRECT",
+			input:    "REDIRECT",
+			expected: redirect.TypeRedirect,
+		},
+		{
+			name:     "PROXY",
+			input:    "PROXY",
+			expected: redirect.TypeProxy,
+		},
+		{
+			name:      "unknown type",
+			input:     "FOO",
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var result redirect.Type
+			err := result.UnmarshalText([]byte(tt.input))
+			if tt.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
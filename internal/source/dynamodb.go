@@ -0,0 +1,215 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/CruGlobal/mirage-server/internal/dynamo"
+	"github.com/CruGlobal/mirage-server/internal/redirect"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+var (
+	// Interface guards.
+	_ caddy.Module          = (*DynamoDB)(nil)
+	_ caddy.Provisioner     = (*DynamoDB)(nil)
+	_ caddyfile.Unmarshaler = (*DynamoDB)(nil)
+	_ RedirectSource        = (*DynamoDB)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(DynamoDB{})
+}
+
+// DynamoDB reads redirects from a DynamoDB table keyed by hostname.
+//
+// Without a region or endpoint it shares the mirage app's client. With one,
+// the app creates a client of its own for it, with the app's credentials and
+// retry settings. An empty table or key falls back to the app's settings.
+//
+// Each lookup is bounded by the timeout and passes through the breaker, so a
+// slow or failing table cannot stall requests or TLS handshakes.
+type DynamoDB struct {
+	Client  dynamo.Client   `json:"-"`
+	Breaker *dynamo.Breaker `json:"-"`
+
+	Region   string `json:"region,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+	Table    string `json:"table,omitempty"`
+	Key      string `json:"key,omitempty"`
+	// Timeout bounds each lookup, including retries. It defaults to the
+	// app's lookup_timeout.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+}
+
+// CreateTableInput describes a redirect table keyed by key.
+func CreateTableInput(table string, key string) *dynamodb.CreateTableInput {
+	return &dynamodb.CreateTableInput{
+		TableName:   aws.String(table),
+		BillingMode: types.BillingModePayPerRequest,
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String(key), KeyType: types.KeyTypeHash},
+		},
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String(key), AttributeType: types.ScalarAttributeTypeS},
+		},
+	}
+}
+
+// EnsureTable creates the source's table unless it exists, and checks that an
+// existing table is keyed by Key, see dynamo.EnsureTable.
+func (d *DynamoDB) EnsureTable(ctx context.Context) (bool, error) {
+	return dynamo.EnsureTable(ctx, d.Client, CreateTableInput(d.Table, d.Key))
+}
+
+// CheckTable checks that the source's table is keyed by Key, see
+// dynamo.CheckTable.
+func (d *DynamoDB) CheckTable(ctx context.Context) error {
+	_, err := dynamo.CheckTable(ctx, d.Client, CreateTableInput(d.Table, d.Key))
+	return err
+}
+
+func (DynamoDB) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  Namespace + ".dynamodb",
+		New: func() caddy.Module { return new(DynamoDB) },
+	}
+}
+
+func (d *DynamoDB) Provision(ctx caddy.Context) error {
+	repl := caddy.NewReplacer()
+	d.Region = repl.ReplaceAll(d.Region, "")
+	d.Endpoint = repl.ReplaceAll(d.Endpoint, "")
+	d.Table = repl.ReplaceAll(d.Table, "")
+	d.Key = repl.ReplaceAll(d.Key, "")
+
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the source from Caddyfile tokens. Syntax:
+//
+//	source dynamodb {
+//	    region <region>
+//	    endpoint <endpoint>
+//	    table <table_name>
+//	    key <key_name>
+//	    timeout <duration>
+//	}
+func (d *DynamoDB) UnmarshalCaddyfile(disp *caddyfile.Dispenser) error {
+	for disp.Next() {
+		if disp.NextArg() {
+			return disp.ArgErr()
+		}
+
+		for nesting := disp.Nesting(); disp.NextBlock(nesting); {
+			configKey := disp.Val()
+			var configVal string
+
+			if !disp.Args(&configVal) {
+				return disp.ArgErr()
+			}
+
+			switch configKey {
+			case "region":
+				d.Region = configVal
+			case "endpoint":
+				d.Endpoint = configVal
+			case "table":
+				d.Table = configVal
+			case "key":
+				d.Key = configVal
+			case "timeout":
+				timeout, err := caddy.ParseDuration(configVal)
+				if err != nil {
+					return disp.Errf("invalid duration for 'timeout': %v", err)
+				}
+				d.Timeout = caddy.Duration(timeout)
+			default:
+				return disp.Errf("unknown parameter '%s' for source 'dynamodb'", configKey)
+			}
+		}
+	}
+	return nil
+}
+
+func (d *DynamoDB) Lookup(ctx context.Context, hostname string) (*redirect.Redirect, error) {
+	var item *dynamodb.GetItemOutput
+	err := d.Breaker.Do(ctx, func() error {
+		lookupCtx, cancel := d.withTimeout(ctx)
+		defer cancel()
+
+		var err error
+		item, err = d.Client.GetItem(lookupCtx, &dynamodb.GetItemInput{
+			TableName: aws.String(d.Table),
+			Key: map[string]types.AttributeValue{
+				d.Key: &types.AttributeValueMemberS{Value: hostname},
+			},
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if item.Item == nil {
+		return nil, fmt.Errorf("%s: %w", hostname, ErrNotFound)
+	}
+
+	var redir redirect.Redirect
+	if err = d.unmarshal(item.Item, &redir); err != nil {
+		return nil, fmt.Errorf("%s: %w: %w", hostname, ErrInvalid, err)
+	}
+	return &redir, nil
+}
+
+// unmarshal reads a record, taking its hostname from the key attribute so
+// tables keyed by something other than Hostname are read correctly.
+func (d *DynamoDB) unmarshal(item map[string]types.AttributeValue, redir *redirect.Redirect) error {
+	if err := attributevalue.UnmarshalMap(item, redir); err != nil {
+		return err
+	}
+	if key, ok := item[d.Key].(*types.AttributeValueMemberS); ok {
+		redir.Hostname = key.Value
+	}
+	return nil
+}
+
+func (d *DynamoDB) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d.Timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, time.Duration(d.Timeout))
+}
+
+func (d *DynamoDB) List(ctx context.Context) ([]redirect.Redirect, error) {
+	var redirects []redirect.Redirect
+
+	paginator := dynamodb.NewScanPaginator(d.Client, &dynamodb.ScanInput{
+		TableName: aws.String(d.Table),
+	})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range output.Items {
+			var redir redirect.Redirect
+			if err = d.unmarshal(item, &redir); err != nil {
+				return nil, err
+			}
+			redirects = append(redirects, redir)
+		}
+	}
+	return redirects, nil
+}
+
+// Watch is not supported by DynamoDB yet; records are refreshed when their
+// cache entry expires or is purged.
+func (d *DynamoDB) Watch(_ context.Context, _ func(hostnames ...string)) error {
+	return nil
+}
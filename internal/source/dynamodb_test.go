@@ -0,0 +1,197 @@
+package source_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/CruGlobal/mirage-server/internal/dynamo"
+	"github.com/CruGlobal/mirage-server/internal/source"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDynamoDB_CaddyModule(t *testing.T) {
+	module := source.DynamoDB{}.CaddyModule()
+	assert.Equal(t, caddy.ModuleID("mirage.sources.dynamodb"), module.ID)
+	assert.IsType(t, &source.DynamoDB{}, module.New())
+}
+
+func TestDynamoDB_UnmarshalCaddyfile(t *testing.T) {
+	testcases := []struct {
+		name      string
+		caddyfile string
+		want      source.DynamoDB
+		expectErr bool
+	}{
+		{
+			name:      "empty",
+			caddyfile: `dynamodb`,
+		},
+		{
+			name: "valid",
+			caddyfile: `dynamodb {
+				region us-west-2
+				endpoint http://localhost:8000
+				table Redirects
+				key Name
+				timeout 1s
+			}`,
+			want: source.DynamoDB{
+				Region:   "us-west-2",
+				Endpoint: "http://localhost:8000",
+				Table:    "Redirects",
+				Key:      "Name",
+				Timeout:  caddy.Duration(time.Second),
+			},
+		},
+		{
+			name:      "unexpected argument",
+			caddyfile: `dynamodb Redirects`,
+			expectErr: true,
+		},
+		{
+			name: "missing value",
+			caddyfile: `dynamodb {
+				table
+			}`,
+			expectErr: true,
+		},
+		{
+			name: "unknown parameter",
+			caddyfile: `dynamodb {
+				shard 1
+			}`,
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := source.DynamoDB{}
+			err := d.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tc.caddyfile))
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, d)
+		})
+	}
+}
+
+// slowClient answers GetItem once ctx is done, like an unresponsive table.
+type slowClient struct {
+	dynamo.Client
+
+	calls int
+}
+
+func (c *slowClient) GetItem(ctx context.Context, _ *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	c.calls++
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestDynamoDB_LookupTimeout(t *testing.T) {
+	client := &slowClient{}
+	d := &source.DynamoDB{
+		Client:  client,
+		Breaker: dynamo.NewBreaker("test", 2, time.Minute),
+		Table:   "Redirects",
+		Key:     "Hostname",
+		Timeout: caddy.Duration(10 * time.Millisecond),
+	}
+
+	for range 2 {
+		_, err := d.Lookup(t.Context(), "example.org")
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	}
+
+	// Once the breaker opens lookups fail without waiting on DynamoDB
+	_, err := d.Lookup(t.Context(), "example.org")
+	require.ErrorIs(t, err, dynamo.ErrCircuitOpen)
+	assert.Equal(t, 2, client.calls)
+}
+
+// itemClient answers GetItem and Scan with a single record.
+type itemClient struct {
+	dynamo.Client
+
+	item map[string]types.AttributeValue
+}
+
+func (c *itemClient) GetItem(_ context.Context, _ *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: c.item}, nil
+}
+
+func (c *itemClient) Scan(_ context.Context, _ *dynamodb.ScanInput, _ ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	return &dynamodb.ScanOutput{Items: []map[string]types.AttributeValue{c.item}}, nil
+}
+
+func TestDynamoDB_Key(t *testing.T) {
+	d := &source.DynamoDB{
+		Client: &itemClient{item: map[string]types.AttributeValue{
+			"Domain":   &types.AttributeValueMemberS{Value: "example.org"},
+			"Type":     &types.AttributeValueMemberS{Value: "REDIRECT"},
+			"Location": &types.AttributeValueMemberS{Value: "https://www.example.org"},
+		}},
+		Table: "PartnerRedirects",
+		Key:   "Domain",
+	}
+
+	r, err := d.Lookup(t.Context(), "example.org")
+	require.NoError(t, err)
+	assert.Equal(t, "example.org", r.Hostname)
+	assert.Equal(t, "https://www.example.org", r.Location)
+
+	list, err := d.List(t.Context())
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, "example.org", list[0].Hostname)
+}
+
+func TestDynamoDB_LookupInvalid(t *testing.T) {
+	d := &source.DynamoDB{
+		Client: &itemClient{item: map[string]types.AttributeValue{
+			"Hostname": &types.AttributeValueMemberS{Value: "example.org"},
+			"Location": &types.AttributeValueMemberS{Value: "https://www.example.org"},
+			"Rewrites": &types.AttributeValueMemberS{Value: "not a list"},
+		}},
+		Table: "Redirects",
+		Key:   "Hostname",
+	}
+
+	// Only records that cannot be read are invalid
+	_, err := d.Lookup(t.Context(), "example.org")
+	require.ErrorIs(t, err, source.ErrInvalid)
+}
+
+func TestDynamoDB_LookupBadRegexp(t *testing.T) {
+	d := &source.DynamoDB{
+		Client: &itemClient{item: map[string]types.AttributeValue{
+			"Hostname": &types.AttributeValueMemberS{Value: "example.org"},
+			"Location": &types.AttributeValueMemberS{Value: "www.example.org"},
+			"Rewrites": &types.AttributeValueMemberL{Value: []types.AttributeValue{
+				&types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+					"RegExp":  &types.AttributeValueMemberS{Value: "(unclosed"},
+					"Replace": &types.AttributeValueMemberS{Value: "/"},
+				}},
+			}},
+		}},
+		Table: "Redirects",
+		Key:   "Hostname",
+	}
+
+	// Records with a rewrite that does not compile are still served, with
+	// the rewrite skipped
+	r, err := d.Lookup(t.Context(), "example.org")
+	require.NoError(t, err)
+	require.Len(t, r.Rewrites, 1)
+	assert.Nil(t, r.Rewrites[0].RegExp.Regexp)
+	assert.Equal(t, "/path", r.RewritePath("/path", "/path"))
+}
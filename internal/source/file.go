@@ -0,0 +1,311 @@
+package source
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/CruGlobal/mirage-server/internal/redirect"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultFileInterval is how often a file source checks its file for changes.
+const DefaultFileInterval = 5 * time.Second
+
+var (
+	// Interface guards.
+	_ caddy.Module          = (*File)(nil)
+	_ caddy.Provisioner     = (*File)(nil)
+	_ caddy.Validator       = (*File)(nil)
+	_ caddyfile.Unmarshaler = (*File)(nil)
+	_ RedirectSource        = (*File)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(File{})
+}
+
+// File reads redirects from a JSON or YAML file holding a list of records in
+// the same shape as redirect.Redirect. Files ending in .yaml or .yml are read
+// as YAML, anything else as JSON.
+//
+// The file is checked for changes every interval. A changed file is loaded and
+// validated in full before it replaces the current records, so a bad edit
+// keeps the previous records in place.
+type File struct {
+	Path     string         `json:"path,omitempty"`
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	records *atomic.Pointer[fileRecords]
+	failed  fileVersion
+	logger  *zap.Logger
+}
+
+// fileVersion identifies a version of the file by modification time and size.
+type fileVersion struct {
+	modTime int64
+	size    int64
+}
+
+func versionOf(info os.FileInfo) fileVersion {
+	return fileVersion{modTime: info.ModTime().UnixNano(), size: info.Size()}
+}
+
+// fileRecords is one loaded version of the file.
+type fileRecords struct {
+	redirects map[string]redirect.Redirect
+	version   fileVersion
+}
+
+func (File) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  Namespace + ".file",
+		New: func() caddy.Module { return new(File) },
+	}
+}
+
+func (f *File) Provision(ctx caddy.Context) error {
+	f.logger = ctx.Logger(f)
+
+	repl := caddy.NewReplacer()
+	f.Path = repl.ReplaceAll(f.Path, "")
+	if f.Interval <= 0 {
+		f.Interval = caddy.Duration(DefaultFileInterval)
+	}
+
+	f.records = &atomic.Pointer[fileRecords]{}
+	if f.Path == "" {
+		return nil
+	}
+	records, err := loadFile(f.Path)
+	if err != nil {
+		return err
+	}
+	f.records.Store(records)
+	return nil
+}
+
+func (f *File) Validate() error {
+	if f.Path == "" {
+		return errors.New("file source requires a path")
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the source from Caddyfile tokens. Syntax:
+//
+//	source file [<path>] {
+//	    path <path>
+//	    interval <duration>
+//	}
+func (f *File) UnmarshalCaddyfile(disp *caddyfile.Dispenser) error {
+	for disp.Next() {
+		if disp.NextArg() {
+			f.Path = disp.Val()
+		}
+		if disp.NextArg() {
+			return disp.ArgErr()
+		}
+
+		for nesting := disp.Nesting(); disp.NextBlock(nesting); {
+			configKey := disp.Val()
+			var configVal string
+
+			if !disp.Args(&configVal) {
+				return disp.ArgErr()
+			}
+
+			switch configKey {
+			case "path":
+				f.Path = configVal
+			case "interval":
+				interval, err := caddy.ParseDuration(configVal)
+				if err != nil {
+					return disp.Errf("invalid duration for 'interval': %v", err)
+				}
+				f.Interval = caddy.Duration(interval)
+			default:
+				return disp.Errf("unknown parameter '%s' for source 'file'", configKey)
+			}
+		}
+	}
+	return nil
+}
+
+func (f *File) Lookup(_ context.Context, hostname string) (*redirect.Redirect, error) {
+	records := f.records.Load()
+	if records == nil {
+		return nil, fmt.Errorf("%s: %w", hostname, ErrNotFound)
+	}
+	redir, ok := records.redirects[strings.ToLower(hostname)]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", hostname, ErrNotFound)
+	}
+	return &redir, nil
+}
+
+func (f *File) List(_ context.Context) ([]redirect.Redirect, error) {
+	records := f.records.Load()
+	if records == nil {
+		return nil, nil
+	}
+	redirects := make([]redirect.Redirect, 0, len(records.redirects))
+	for _, redir := range records.redirects {
+		redirects = append(redirects, redir)
+	}
+	return redirects, nil
+}
+
+// Watch polls the file every interval and reloads it when its modification
+// time or size changes. Hostnames that were added, changed or removed are
+// passed to invalidate once the new records are in place.
+func (f *File) Watch(ctx context.Context, invalidate func(hostnames ...string)) error {
+	ticker := time.NewTicker(time.Duration(f.Interval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			changed, err := f.reload()
+			if err != nil {
+				f.logger.Error("unable to reload redirect file, keeping previous records",
+					zap.String("path", f.Path),
+					zap.Error(err),
+				)
+				continue
+			}
+			if len(changed) > 0 {
+				f.logger.Info("reloaded redirect file",
+					zap.String("path", f.Path),
+					zap.Int("changed", len(changed)),
+				)
+				invalidate(changed...)
+			}
+		}
+	}
+}
+
+// reload loads the file if it changed since the last load and returns the
+// hostnames whose records differ.
+func (f *File) reload() ([]string, error) {
+	current := f.records.Load()
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	// Skip unchanged files, and broken versions that were already reported
+	version := versionOf(info)
+	if (current != nil && version == current.version) || version == f.failed {
+		return nil, nil
+	}
+
+	records, err := loadFile(f.Path)
+	if err != nil {
+		f.failed = version
+		return nil, err
+	}
+	f.records.Store(records)
+
+	if current == nil {
+		current = &fileRecords{}
+	}
+	return diffRecords(current.redirects, records.redirects), nil
+}
+
+func loadFile(path string) (*fileRecords, error) {
+	// Stat first, so a write landing during the read changes the version
+	// after the one recorded and is loaded by the next poll
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// YAML is converted to JSON so both formats share the JSON field names
+	// and the redirect package's text unmarshalers
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if data, err = yamlToJSON(data); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+	}
+
+	var list []redirect.Redirect
+	if err = json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	records := &fileRecords{
+		redirects: make(map[string]redirect.Redirect, len(list)),
+		version:   versionOf(info),
+	}
+	for i, redir := range list {
+		if err = redir.Validate(); err != nil {
+			return nil, fmt.Errorf("%s: record %d: %w", path, i, err)
+		}
+		// Hostnames are case-insensitive and requests are cached by the
+		// lowercase host
+		redir.Hostname = strings.ToLower(redir.Hostname)
+		if _, ok := records.redirects[redir.Hostname]; ok {
+			return nil, fmt.Errorf("%s: record %d: duplicate hostname %s", path, i, redir.Hostname)
+		}
+		records.redirects[redir.Hostname] = redir
+	}
+	return records, nil
+}
+
+func yamlToJSON(data []byte) ([]byte, error) {
+	var value any
+	if err := yaml.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(value)
+}
+
+// diffRecords returns the hostnames added, removed or changed between two
+// record sets.
+func diffRecords(previous map[string]redirect.Redirect, next map[string]redirect.Redirect) []string {
+	var changed []string
+	for hostname, redir := range next {
+		old, ok := previous[hostname]
+		if !ok || !sameRedirect(old, redir) {
+			changed = append(changed, hostname)
+		}
+	}
+	for hostname := range previous {
+		if _, ok := next[hostname]; !ok {
+			changed = append(changed, hostname)
+		}
+	}
+	return changed
+}
+
+func sameRedirect(a redirect.Redirect, b redirect.Redirect) bool {
+	left, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	right, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(left, right)
+}
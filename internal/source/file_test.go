@@ -0,0 +1,266 @@
+package source_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CruGlobal/mirage-server/internal/redirect"
+	"github.com/CruGlobal/mirage-server/internal/source"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const jsonRedirects = `[
+	{"Hostname": "www.example.com", "Location": "example.com"},
+	{
+		"Hostname": "Example.ORG",
+		"Type": "REDIRECT",
+		"Status": "PERMANENT",
+		"Location": "www.example.org",
+		"Rewrites": [{"RegExp": "^(.*)$"}],
+		"Tags": ["marketing"]
+	}
+]`
+
+const yamlRedirects = `
+- hostname: www.example.com
+  location: example.com
+- hostname: example.org
+  status: PERMANENT
+  location: www.example.org
+  forwardQueryString: true
+  rewrites:
+    - regexp: ^/old(.*)$
+      replace: /new$1
+      final: false
+`
+
+func provisionFile(t *testing.T, name string, contents string) *source.File {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+	t.Cleanup(cancel)
+
+	f := &source.File{Path: path, Interval: caddy.Duration(10 * time.Millisecond)}
+	require.NoError(t, f.Provision(ctx))
+	require.NoError(t, f.Validate())
+	return f
+}
+
+func TestFile_CaddyModule(t *testing.T) {
+	module := source.File{}.CaddyModule()
+	assert.Equal(t, caddy.ModuleID("mirage.sources.file"), module.ID)
+	assert.IsType(t, &source.File{}, module.New())
+}
+
+func TestFile_UnmarshalCaddyfile(t *testing.T) {
+	testcases := []struct {
+		name      string
+		caddyfile string
+		want      source.File
+		expectErr bool
+	}{
+		{
+			name:      "path argument",
+			caddyfile: `file /etc/mirage/redirects.yaml`,
+			want:      source.File{Path: "/etc/mirage/redirects.yaml"},
+		},
+		{
+			name: "block",
+			caddyfile: `file {
+				path redirects.json
+				interval 30s
+			}`,
+			want: source.File{Path: "redirects.json", Interval: caddy.Duration(30 * time.Second)},
+		},
+		{
+			name:      "too many arguments",
+			caddyfile: `file a.json b.json`,
+			expectErr: true,
+		},
+		{
+			name: "invalid interval",
+			caddyfile: `file redirects.json {
+				interval often
+			}`,
+			expectErr: true,
+		},
+		{
+			name: "unknown parameter",
+			caddyfile: `file redirects.json {
+				format toml
+			}`,
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := source.File{}
+			err := f.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tc.caddyfile))
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, f)
+		})
+	}
+}
+
+func TestFile_Lookup(t *testing.T) {
+	ctx := t.Context()
+
+	t.Run("json", func(t *testing.T) {
+		f := provisionFile(t, "redirects.json", jsonRedirects)
+
+		r, err := f.Lookup(ctx, "example.org")
+		require.NoError(t, err)
+		assert.Equal(t, redirect.Redirect{
+			Hostname: "example.org",
+			Type:     redirect.TypeRedirect,
+			Status:   redirect.StatusPermanent,
+			Location: "www.example.org",
+			Rewrites: []redirect.Rewrite{
+				{RegExp: redirect.RewriteRegexp{Regexp: regexp.MustCompile("^(.*)$")}, Replace: "$1", Final: true},
+			},
+			Tags: []string{"marketing"},
+		}, *r)
+
+		_, err = f.Lookup(ctx, "example.edu")
+		require.ErrorIs(t, err, source.ErrNotFound)
+
+		list, err := f.List(ctx)
+		require.NoError(t, err)
+		assert.Len(t, list, 2)
+	})
+
+	t.Run("yaml", func(t *testing.T) {
+		f := provisionFile(t, "redirects.yaml", yamlRedirects)
+
+		r, err := f.Lookup(ctx, "EXAMPLE.org")
+		require.NoError(t, err)
+		assert.Equal(t, redirect.Redirect{
+			Hostname:           "example.org",
+			Status:             redirect.StatusPermanent,
+			Location:           "www.example.org",
+			ForwardQueryString: true,
+			Rewrites: []redirect.Rewrite{
+				{RegExp: redirect.RewriteRegexp{Regexp: regexp.MustCompile("^/old(.*)$")}, Replace: "/new$1", Final: false},
+			},
+		}, *r)
+	})
+}
+
+func TestFile_ProvisionInvalid(t *testing.T) {
+	testcases := []struct {
+		name     string
+		file     string
+		contents string
+		err      string
+	}{
+		{
+			name:     "malformed json",
+			file:     "redirects.json",
+			contents: `[{"Hostname": `,
+			err:      "parsing",
+		},
+		{
+			name:     "unknown status",
+			file:     "redirects.json",
+			contents: `[{"Hostname": "example.com", "Location": "www.example.com", "Status": "SOMETIMES"}]`,
+			err:      "unknown redirect status: SOMETIMES",
+		},
+		{
+			name:     "invalid regexp",
+			file:     "redirects.yaml",
+			contents: "- hostname: example.com\n  location: www.example.com\n  rewrites:\n    - regexp: '[abc'\n",
+			err:      "missing closing ]",
+		},
+		{
+			name:     "missing location",
+			file:     "redirects.yaml",
+			contents: "- hostname: example.com\n",
+			err:      "record 0: location is empty",
+		},
+		{
+			name:     "duplicate hostname",
+			file:     "redirects.json",
+			contents: `[{"Hostname": "example.com", "Location": "a.com"}, {"Hostname": "EXAMPLE.com", "Location": "b.com"}]`,
+			err:      "record 1: duplicate hostname example.com",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tc.file)
+			require.NoError(t, os.WriteFile(path, []byte(tc.contents), 0o600))
+
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: t.Context()})
+			defer cancel()
+
+			f := &source.File{Path: path}
+			err := f.Provision(ctx)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.err)
+		})
+	}
+}
+
+func TestFile_Watch(t *testing.T) {
+	f := provisionFile(t, "redirects.json", jsonRedirects)
+
+	mutex := sync.Mutex{}
+	var invalidated []string
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan error)
+	go func() {
+		done <- f.Watch(ctx, func(hostnames ...string) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			invalidated = append(invalidated, hostnames...)
+		})
+	}()
+
+	// A broken edit keeps the previous records
+	require.NoError(t, os.WriteFile(f.Path, []byte(`[{"Hostname": `), 0o600))
+	time.Sleep(50 * time.Millisecond)
+	_, err := f.Lookup(t.Context(), "www.example.com")
+	require.NoError(t, err)
+
+	// Change one record, remove one and add one
+	require.NoError(t, os.WriteFile(f.Path, []byte(`[
+		{"Hostname": "www.example.com", "Location": "example.net"},
+		{"Hostname": "example.info", "Location": "www.example.info"}
+	]`), 0o600))
+
+	assert.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(invalidated) == 3
+	}, time.Second, 10*time.Millisecond)
+
+	mutex.Lock()
+	assert.ElementsMatch(t, []string{"www.example.com", "example.org", "example.info"}, invalidated)
+	mutex.Unlock()
+
+	r, err := f.Lookup(t.Context(), "www.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "example.net", r.Location)
+	_, err = f.Lookup(t.Context(), "example.org")
+	require.ErrorIs(t, err, source.ErrNotFound)
+
+	cancel()
+	require.ErrorIs(t, <-done, context.Canceled)
+}
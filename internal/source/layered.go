@@ -0,0 +1,145 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/CruGlobal/mirage-server/internal/redirect"
+)
+
+// Layer is one source in a Layered lookup.
+type Layer struct {
+	// Name identifies the layer in logs and the http.mirage.source placeholder.
+	Name   string
+	Source RedirectSource
+}
+
+// LayerError is an error a Layered lookup returns from the layer named Layer.
+type LayerError struct {
+	Layer string
+	Err   error
+}
+
+func (e *LayerError) Error() string {
+	return fmt.Sprintf("source %s: %v", e.Layer, e.Err)
+}
+
+func (e *LayerError) Unwrap() error {
+	return e.Err
+}
+
+// LayerOf returns the name of the layer that answered a Layered lookup: the
+// one the redirect was read from, or the one whose error was returned. It is
+// empty when no layer had a record.
+func LayerOf(redir *redirect.Redirect, err error) string {
+	if redir != nil {
+		return redir.Source
+	}
+	var layerErr *LayerError
+	if errors.As(err, &layerErr) {
+		return layerErr.Layer
+	}
+	return ""
+}
+
+// Layered looks hostnames up in several sources in priority order. The first
+// layer with a record wins, and the record is tagged with that layer's name.
+//
+// An error from a layer stops the lookup unless fallThrough is set, in which
+// case the remaining layers are tried. If no later layer has a record the
+// error is returned rather than ErrNotFound, so a failing layer is never
+// mistaken for a missing record.
+type Layered struct {
+	layers      []Layer
+	fallThrough bool
+}
+
+var _ RedirectSource = (*Layered)(nil)
+
+func NewLayered(layers []Layer, fallThrough bool) *Layered {
+	return &Layered{
+		layers:      layers,
+		fallThrough: fallThrough,
+	}
+}
+
+// Layers returns the layers in priority order.
+func (l *Layered) Layers() []Layer {
+	return l.layers
+}
+
+func (l *Layered) Lookup(ctx context.Context, hostname string) (*redirect.Redirect, error) {
+	var lookupErr error
+	for _, layer := range l.layers {
+		redir, err := layer.Source.Lookup(ctx, hostname)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			err = &LayerError{Layer: layer.Name, Err: err}
+			if !l.fallThrough {
+				return nil, err
+			}
+			if lookupErr == nil {
+				lookupErr = err
+			}
+			continue
+		}
+		redir.Source = layer.Name
+		return redir, nil
+	}
+	if lookupErr != nil {
+		return nil, lookupErr
+	}
+	return nil, fmt.Errorf("%s: %w", hostname, ErrNotFound)
+}
+
+// List merges the records of every layer, keeping the highest priority record
+// for each hostname.
+func (l *Layered) List(ctx context.Context) ([]redirect.Redirect, error) {
+	var redirects []redirect.Redirect
+	seen := make(map[string]bool)
+	for _, layer := range l.layers {
+		list, err := layer.Source.List(ctx)
+		if err != nil {
+			err = &LayerError{Layer: layer.Name, Err: err}
+			if !l.fallThrough {
+				return nil, err
+			}
+			continue
+		}
+		for _, redir := range list {
+			if seen[redir.Hostname] {
+				continue
+			}
+			seen[redir.Hostname] = true
+			redir.Source = layer.Name
+			redirects = append(redirects, redir)
+		}
+	}
+	return redirects, nil
+}
+
+// Watch watches every layer until ctx is done. A change in any layer
+// invalidates the hostname, since it may change which layer answers.
+func (l *Layered) Watch(ctx context.Context, invalidate func(hostnames ...string)) error {
+	errs := make([]error, len(l.layers))
+	wg := sync.WaitGroup{}
+	for i, layer := range l.layers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := layer.Source.Watch(ctx, invalidate)
+			if err != nil && !errors.Is(err, context.Canceled) {
+				errs[i] = fmt.Errorf("source %s: %w", layer.Name, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
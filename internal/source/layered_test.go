@@ -0,0 +1,210 @@
+package source_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/CruGlobal/mirage-server/internal/redirect"
+	"github.com/CruGlobal/mirage-server/internal/source"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errUnavailable = errors.New("unavailable")
+
+// fakeSource is an in-memory source that can be made to fail.
+type fakeSource struct {
+	redirects map[string]redirect.Redirect
+	err       error
+	changed   []string
+}
+
+func (f *fakeSource) Lookup(_ context.Context, hostname string) (*redirect.Redirect, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	redir, ok := f.redirects[hostname]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", hostname, source.ErrNotFound)
+	}
+	return &redir, nil
+}
+
+func (f *fakeSource) List(_ context.Context) ([]redirect.Redirect, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	var list []redirect.Redirect
+	for _, redir := range f.redirects {
+		list = append(list, redir)
+	}
+	return list, nil
+}
+
+func (f *fakeSource) Watch(_ context.Context, invalidate func(hostnames ...string)) error {
+	if len(f.changed) > 0 {
+		invalidate(f.changed...)
+	}
+	return f.err
+}
+
+func newFakeSource(hostnames ...string) *fakeSource {
+	f := &fakeSource{redirects: make(map[string]redirect.Redirect)}
+	for _, hostname := range hostnames {
+		f.redirects[hostname] = redirect.Redirect{Hostname: hostname, Location: "example.com"}
+	}
+	return f
+}
+
+func TestLayered_Lookup(t *testing.T) {
+	failing := &fakeSource{err: errUnavailable}
+
+	tests := []struct {
+		name        string
+		layers      []source.Layer
+		fallThrough bool
+		hostname    string
+		expect      string
+		expectErr   error
+	}{
+		{
+			name: "first match wins",
+			layers: []source.Layer{
+				{Name: "overrides", Source: newFakeSource("example.org")},
+				{Name: "dynamodb", Source: newFakeSource("example.org", "example.com")},
+			},
+			hostname: "example.org",
+			expect:   "overrides",
+		},
+		{
+			name: "later layer",
+			layers: []source.Layer{
+				{Name: "overrides", Source: newFakeSource("example.org")},
+				{Name: "dynamodb", Source: newFakeSource("example.org", "example.com")},
+			},
+			hostname: "example.com",
+			expect:   "dynamodb",
+		},
+		{
+			name: "not found",
+			layers: []source.Layer{
+				{Name: "overrides", Source: newFakeSource("example.org")},
+			},
+			hostname:  "example.edu",
+			expectErr: source.ErrNotFound,
+		},
+		{
+			name: "error stops",
+			layers: []source.Layer{
+				{Name: "dynamodb", Source: failing},
+				{Name: "snapshot", Source: newFakeSource("example.com")},
+			},
+			hostname:  "example.com",
+			expectErr: errUnavailable,
+		},
+		{
+			name: "error falls through",
+			layers: []source.Layer{
+				{Name: "dynamodb", Source: failing},
+				{Name: "snapshot", Source: newFakeSource("example.com")},
+			},
+			fallThrough: true,
+			hostname:    "example.com",
+			expect:      "snapshot",
+		},
+		{
+			name: "error is not reported as not found",
+			layers: []source.Layer{
+				{Name: "dynamodb", Source: failing},
+				{Name: "snapshot", Source: newFakeSource("example.com")},
+			},
+			fallThrough: true,
+			hostname:    "example.edu",
+			expectErr:   errUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layered := source.NewLayered(tt.layers, tt.fallThrough)
+			r, err := layered.Lookup(t.Context(), tt.hostname)
+			if tt.expectErr != nil {
+				require.ErrorIs(t, err, tt.expectErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.hostname, r.Hostname)
+			assert.Equal(t, tt.expect, r.Source)
+		})
+	}
+}
+
+func TestLayered_LayerOf(t *testing.T) {
+	layered := source.NewLayered([]source.Layer{
+		{Name: "overrides", Source: newFakeSource("example.org")},
+		{Name: "dynamodb", Source: &fakeSource{err: errUnavailable}},
+	}, false)
+
+	r, err := layered.Lookup(t.Context(), "example.org")
+	assert.Equal(t, "overrides", source.LayerOf(r, err))
+
+	r, err = layered.Lookup(t.Context(), "example.com")
+	require.ErrorIs(t, err, errUnavailable)
+	assert.Equal(t, "dynamodb", source.LayerOf(r, err))
+
+	// No layer answers lookups without a record
+	r, err = source.NewLayered([]source.Layer{{Name: "overrides", Source: newFakeSource()}}, false).Lookup(t.Context(), "example.com")
+	require.ErrorIs(t, err, source.ErrNotFound)
+	assert.Empty(t, source.LayerOf(r, err))
+}
+
+func TestLayered_List(t *testing.T) {
+	overrides := newFakeSource("example.org")
+	overrides.redirects["example.org"] = redirect.Redirect{Hostname: "example.org", Location: "override.example.org"}
+	layers := []source.Layer{
+		{Name: "overrides", Source: overrides},
+		{Name: "broken", Source: &fakeSource{err: errUnavailable}},
+		{Name: "dynamodb", Source: newFakeSource("example.org", "example.com")},
+	}
+
+	_, err := source.NewLayered(layers, false).List(t.Context())
+	require.ErrorIs(t, err, errUnavailable)
+
+	list, err := source.NewLayered(layers, true).List(t.Context())
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []redirect.Redirect{
+		{Hostname: "example.org", Location: "override.example.org", Source: "overrides"},
+		{Hostname: "example.com", Location: "example.com", Source: "dynamodb"},
+	}, list)
+}
+
+func TestLayered_Watch(t *testing.T) {
+	first := newFakeSource()
+	first.changed = []string{"example.org"}
+	second := newFakeSource()
+	second.changed = []string{"example.com"}
+	second.err = errUnavailable
+
+	layered := source.NewLayered([]source.Layer{
+		{Name: "overrides", Source: first},
+		{Name: "dynamodb", Source: second},
+	}, false)
+
+	invalidated := make(chan string, 2)
+	err := layered.Watch(t.Context(), func(hostnames ...string) {
+		for _, hostname := range hostnames {
+			invalidated <- hostname
+		}
+	})
+	require.ErrorIs(t, err, errUnavailable)
+	require.ErrorContains(t, err, "source dynamodb")
+
+	close(invalidated)
+	var hostnames []string
+	for hostname := range invalidated {
+		hostnames = append(hostnames, hostname)
+	}
+	assert.ElementsMatch(t, []string{"example.org", "example.com"}, hostnames)
+}
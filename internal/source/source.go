@@ -0,0 +1,34 @@
+package source
+
+import (
+	"context"
+	"errors"
+
+	"github.com/CruGlobal/mirage-server/internal/redirect"
+)
+
+// Namespace is the Caddy module namespace redirect sources register in.
+const Namespace = "mirage.sources"
+
+var (
+	// ErrNotFound is returned by Lookup when a hostname has no redirect.
+	ErrNotFound = errors.New("redirect not found")
+	// ErrInvalid is returned by Lookup when a hostname's record cannot be read.
+	ErrInvalid = errors.New("invalid redirect record")
+)
+
+// RedirectSource provides redirect records to the mirage handler and the
+// on-demand TLS permission check. Implementations are Caddy guest modules in
+// the mirage.sources namespace.
+type RedirectSource interface {
+	// Lookup returns the redirect for hostname, or an error wrapping
+	// ErrNotFound if there is none and ErrInvalid if its record is malformed.
+	Lookup(ctx context.Context, hostname string) (*redirect.Redirect, error)
+
+	// List returns every redirect the source holds.
+	List(ctx context.Context) ([]redirect.Redirect, error)
+
+	// Watch calls invalidate with the hostnames whose records changed until
+	// ctx is done. Sources that cannot detect changes return nil immediately.
+	Watch(ctx context.Context, invalidate func(hostnames ...string)) error
+}
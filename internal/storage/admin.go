@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+var (
+	// Interface guards.
+	_ caddy.Module      = (*AdminAPI)(nil)
+	_ caddy.Provisioner = (*AdminAPI)(nil)
+	_ caddy.AdminRouter = (*AdminAPI)(nil)
+)
+
+const (
+	AdminLocksEndpoint   = "/mirage/locks"
+	AdminExpiredEndpoint = "/mirage/expired"
+)
+
+func init() {
+	caddy.RegisterModule(AdminAPI{})
+}
+
+// AdminAPI serves the certificate storage locks through the Caddy admin API:
+//
+//	GET /mirage/locks    lists the locks held by any instance
+//	GET /mirage/expired  lists the items past their TTL not yet deleted
+//
+// It helps tell who holds a lock when an issuance seems stuck, and which
+// certificates time to live is about to delete.
+type AdminAPI struct {
+	storage *DynamoDBStorage
+}
+
+func (AdminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.mirage_locks",
+		New: func() caddy.Module { return new(AdminAPI) },
+	}
+}
+
+func (a *AdminAPI) Provision(ctx caddy.Context) error {
+	// The admin API is loaded for every config, whatever its storage
+	switch storage := ctx.Storage().(type) {
+	case DynamoDBStorage:
+		a.storage = &storage
+	case *DynamoDBStorage:
+		a.storage = storage
+	}
+	return nil
+}
+
+func (a *AdminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: AdminLocksEndpoint,
+			Handler: caddy.AdminHandlerFunc(a.handleLocks),
+		},
+		{
+			Pattern: AdminExpiredEndpoint,
+			Handler: caddy.AdminHandlerFunc(a.handleExpired),
+		},
+	}
+}
+
+type locksResponse struct {
+	Locks []LockInfo `json:"locks"`
+}
+
+func (a *AdminAPI) handleLocks(w http.ResponseWriter, r *http.Request) error {
+	if err := a.checkRequest(r); err != nil {
+		return err
+	}
+	locks, err := a.storage.Locks(r.Context())
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+	}
+	return writeJSON(w, locksResponse{Locks: locks})
+}
+
+type expiredResponse struct {
+	Items []ExpiredItem `json:"items"`
+}
+
+func (a *AdminAPI) handleExpired(w http.ResponseWriter, r *http.Request) error {
+	if err := a.checkRequest(r); err != nil {
+		return err
+	}
+	items, err := a.storage.Expired(r.Context())
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+	}
+	return writeJSON(w, expiredResponse{Items: items})
+}
+
+// checkRequest rejects requests without a storage to answer them, and other
+// than GET.
+func (a *AdminAPI) checkRequest(r *http.Request) error {
+	if a.storage == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        errors.New("dynamodb storage is not configured"),
+		}
+	}
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, body any) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(encoded)
+	return nil
+}
@@ -0,0 +1,56 @@
+package storage_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/CruGlobal/mirage-server/internal/storage"
+	"github.com/CruGlobal/mirage-server/miragetest"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminAPI_CaddyModule(t *testing.T) {
+	module := storage.AdminAPI{}.CaddyModule()
+	assert.Equal(t, caddy.ModuleID("admin.api.mirage_locks"), module.ID)
+	assert.IsType(t, &storage.AdminAPI{}, module.New())
+}
+
+func TestAdminAPI_Routes(t *testing.T) {
+	config := miragetest.TestConfig{
+		Region:   "us-east-1",
+		Endpoint: miragetest.ClosedEndpoint,
+		Table:    "MirageServerConfigTest",
+		Key:      "Hostname",
+	}
+
+	serve := func(ctx caddy.Context, endpoint string, method string) error {
+		a := new(storage.AdminAPI)
+		require.NoError(t, a.Provision(ctx))
+		for _, route := range a.Routes() {
+			if route.Pattern == endpoint {
+				return route.Handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, endpoint, nil))
+			}
+		}
+		require.Failf(t, "route not found", "%s", endpoint)
+		return nil
+	}
+
+	for _, endpoint := range []string{storage.AdminLocksEndpoint, storage.AdminExpiredEndpoint} {
+		t.Run(endpoint, func(t *testing.T) {
+			// Other storage modules have nothing to list
+			err := serve(miragetest.NewMirageCaddyContext(t, config), endpoint, http.MethodGet)
+			var apiErr caddy.APIError
+			require.ErrorAs(t, err, &apiErr)
+			assert.Equal(t, http.StatusNotFound, apiErr.HTTPStatus)
+
+			withStorage := config
+			withStorage.StorageTable = "MirageServerCertificatesTest"
+			err = serve(miragetest.NewMirageCaddyContext(t, withStorage), endpoint, http.MethodDelete)
+			require.ErrorAs(t, err, &apiErr)
+			assert.Equal(t, http.StatusMethodNotAllowed, apiErr.HTTPStatus)
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"context"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+// issueLockPrefix starts the names of the locks certmagic holds while
+// obtaining or renewing the certificate of a name.
+const issueLockPrefix = "issue_cert_"
+
+// bundleFile returns the site directory and name of a certificate resource
+// file certmagic stores, such as
+// certificates/<issuer>/example.com/example.com.key.
+func bundleFile(key string) (string, string, bool) {
+	if !strings.HasPrefix(key, "certificates/") {
+		return "", "", false
+	}
+	dir, file := path.Split(key)
+	dir = strings.TrimSuffix(dir, "/")
+	name := path.Base(dir)
+	switch file {
+	case name + ".key", name + ".crt", name + ".json":
+		return dir, name, true
+	}
+	return "", "", false
+}
+
+// bundleSet tracks the files of certificate resources, which certmagic
+// stores one at a time: the private key, the certificate and then the
+// metadata. It is shared by the copies the value receivers make.
+type bundleSet struct {
+	mutex  sync.Mutex
+	staged map[string][]Write
+}
+
+func newBundleSet() *bundleSet {
+	return &bundleSet{staged: make(map[string][]Write)}
+}
+
+// stage adds a stored file to its bundle, replacing what was staged for the
+// same key.
+func (s *bundleSet) stage(write Write) {
+	dir, _, _ := bundleFile(write.Key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	writes := slices.DeleteFunc(s.staged[dir], func(staged Write) bool { return staged.Key == write.Key })
+	s.staged[dir] = append(writes, write)
+}
+
+// complete returns the files staged for the bundle of write, the metadata,
+// followed by write, and no longer stages them.
+func (s *bundleSet) complete(write Write) []Write {
+	dir, _, _ := bundleFile(write.Key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	writes := slices.DeleteFunc(s.staged[dir], func(staged Write) bool { return staged.Key == write.Key })
+	delete(s.staged, dir)
+	return append(writes, write)
+}
+
+// discard drops a staged file, as when certmagic deletes the files of a
+// bundle it failed to store.
+func (s *bundleSet) discard(key string) {
+	dir, _, ok := bundleFile(key)
+	if !ok {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.staged[dir] = slices.DeleteFunc(s.staged[dir], func(write Write) bool { return write.Key == key })
+	if len(s.staged[dir]) == 0 {
+		delete(s.staged, dir)
+	}
+}
+
+// take returns the writes staged for the sites of name and no longer stages
+// them.
+func (s *bundleSet) take(name string) []Write {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var writes []Write
+	for dir, staged := range s.staged {
+		if path.Base(dir) == name {
+			writes = append(writes, staged...)
+			delete(s.staged, dir)
+		}
+	}
+	return writes
+}
+
+// bundling reports whether the file at key belongs to the certificate of a
+// name whose issuance lock this instance holds.
+func (dbs DynamoDBStorage) bundling(key string) bool {
+	_, name, ok := bundleFile(key)
+	if !ok {
+		return false
+	}
+	return dbs.locks.has(func(lock string) bool {
+		domain, ok := strings.CutPrefix(lock, issueLockPrefix)
+		return ok && certmagic.StorageKeys.Safe(domain) == name
+	})
+}
+
+// storeBundled stores a file of a certificate bundle certmagic stores under
+// its issuance lock. Each file is written as it is stored, so it can be read
+// straight away. Once the metadata completes the bundle, it is written along
+// with the other files in one transaction, on the condition that they are
+// still at the versions written, see StoreAll. Files another instance
+// changed in between fail the bundle with a *ConflictError.
+func (dbs DynamoDBStorage) storeBundled(ctx context.Context, key string, value []byte) error {
+	dbs = dbs.onPrimary()
+	dir, name, _ := bundleFile(key)
+	if key != path.Join(dir, name+".json") {
+		version, err := dbs.store(ctx, key, value)
+		if err != nil {
+			return err
+		}
+		dbs.bundles.stage(Write{Key: key, Value: value, IfVersion: &version})
+		return nil
+	}
+	_, err := dbs.StoreAll(ctx, dbs.bundles.complete(Write{Key: key, Value: value}))
+	return err
+}
+
+// dropBundles forgets the files staged under the issuance lock named lock,
+// should certmagic not have completed a bundle. They are already stored.
+func (dbs DynamoDBStorage) dropBundles(lock string) {
+	domain, ok := strings.CutPrefix(lock, issueLockPrefix)
+	if !ok {
+		return
+	}
+	if writes := dbs.bundles.take(certmagic.StorageKeys.Safe(domain)); len(writes) > 0 {
+		dbs.logger.Warn("certificate bundle left incomplete",
+			zap.String("lock", lock),
+			zap.Int("files", len(writes)),
+		)
+	}
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/CruGlobal/mirage-server/internal/metrics"
+	"github.com/caddyserver/certmagic"
+	"github.com/jellydator/ttlcache/v3"
+)
+
+// DefaultCacheCapacity is how many keys the read cache holds.
+const DefaultCacheCapacity = 1000
+
+// cacheEntry is what the read cache knows of a key.
+type cacheEntry struct {
+	// missing is set for keys found not to exist.
+	missing bool
+	info    certmagic.KeyInfo
+	// contents is set once the value has been loaded, which took reads
+	// GetItem calls.
+	contents []byte
+	loaded   bool
+	reads    int
+}
+
+// readCache holds what was recently read from the table, so repeated Load,
+// Stat and Exists calls are answered locally. Writes by this instance
+// invalidate keys; those by other instances are picked up once entries
+// expire. It is shared by the copies the value receivers make.
+type readCache struct {
+	entries *ttlcache.Cache[string, cacheEntry]
+	// generation counts invalidations, so reads that raced one are not cached
+	generation atomic.Uint64
+}
+
+func newReadCache(ttl time.Duration, capacity uint64) *readCache {
+	return &readCache{
+		entries: ttlcache.New[string, cacheEntry](
+			ttlcache.WithTTL[string, cacheEntry](ttl),
+			ttlcache.WithCapacity[string, cacheEntry](capacity),
+			ttlcache.WithDisableTouchOnHit[string, cacheEntry](),
+		),
+	}
+}
+
+// get returns the entry for key, counting the lookup for operation. Entries
+// without a loaded value only answer Stat and Exists.
+func (c *readCache) get(operation string, key string) (cacheEntry, bool) {
+	if c == nil {
+		return cacheEntry{}, false
+	}
+	var entry cacheEntry
+	item := c.entries.Get(key)
+	if item != nil {
+		entry = item.Value()
+	}
+	switch {
+	case item == nil || (operation == metrics.StorageLoad && !entry.loaded && !entry.missing):
+		metrics.StorageCacheRequests.WithLabelValues(operation, metrics.ResultMiss).Inc()
+		return cacheEntry{}, false
+	case entry.missing:
+		metrics.StorageCacheRequests.WithLabelValues(operation, metrics.ResultNegativeHit).Inc()
+		metrics.StorageCacheReadsSaved.Inc()
+	default:
+		metrics.StorageCacheRequests.WithLabelValues(operation, metrics.ResultHit).Inc()
+		reads := 1
+		if operation == metrics.StorageLoad {
+			reads = entry.reads
+		}
+		metrics.StorageCacheReadsSaved.Add(float64(reads))
+	}
+	return entry, true
+}
+
+// start returns the generation to pass to set once a read is done.
+func (c *readCache) start() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.generation.Load()
+}
+
+// set caches entry for key, unless a key was invalidated since generation.
+// A loaded value is not replaced by a Stat of it.
+func (c *readCache) set(generation uint64, key string, entry cacheEntry) {
+	if c == nil || c.generation.Load() != generation {
+		return
+	}
+	if !entry.loaded && !entry.missing {
+		if item := c.entries.Get(key); item != nil && item.Value().loaded {
+			return
+		}
+	}
+	c.entries.Set(key, entry, ttlcache.DefaultTTL)
+}
+
+// invalidate forgets keys written by this instance.
+func (c *readCache) invalidate(keys ...string) {
+	if c == nil {
+		return
+	}
+	c.generation.Add(1)
+	for _, key := range keys {
+		c.entries.Delete(key)
+	}
+}
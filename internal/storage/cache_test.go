@@ -0,0 +1,91 @@
+package storage_test
+
+import (
+	"io/fs"
+	"path"
+	"time"
+
+	"github.com/CruGlobal/mirage-server/internal/metrics"
+	"github.com/CruGlobal/mirage-server/internal/storage"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newCachedStorage provisions a storage instance using the same table that
+// caches reads for ttl.
+func (ts *StorageTestSuite) newCachedStorage(ttl time.Duration) *storage.DynamoDBStorage {
+	dbs := storage.NewDynamoDBStorage()
+	dbs.Table = ts.dbs.Table
+	dbs.CacheTTL = caddy.Duration(ttl)
+	ts.Require().NoError(ts.provision(dbs))
+	return dbs
+}
+
+func (ts *StorageTestSuite) TestStorage_Cache() {
+	t := ts.T()
+	ctx := t.Context()
+	cached := ts.newCachedStorage(time.Minute)
+	key := path.Join("certificates", "acme-v02.api.example.com", "example.com", "example.com.crt")
+
+	require.NoError(t, cached.Store(ctx, key, []byte("first")))
+	hits := testutil.ToFloat64(metrics.StorageCacheRequests.WithLabelValues(metrics.StorageLoad, metrics.ResultHit))
+	misses := testutil.ToFloat64(metrics.StorageCacheRequests.WithLabelValues(metrics.StorageLoad, metrics.ResultMiss))
+	saved := testutil.ToFloat64(metrics.StorageCacheReadsSaved)
+	for range 2 {
+		content, err := cached.Load(ctx, key)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("first"), content)
+	}
+	assert.InDelta(t, misses+1, testutil.ToFloat64(metrics.StorageCacheRequests.WithLabelValues(metrics.StorageLoad, metrics.ResultMiss)), 0)
+	assert.InDelta(t, hits+1, testutil.ToFloat64(metrics.StorageCacheRequests.WithLabelValues(metrics.StorageLoad, metrics.ResultHit)), 0)
+	assert.InDelta(t, saved+1, testutil.ToFloat64(metrics.StorageCacheReadsSaved), 0)
+
+	// Values loaded also answer Stat and Exists
+	stats := testutil.ToFloat64(metrics.StorageCacheRequests.WithLabelValues(metrics.StorageStat, metrics.ResultHit))
+	info, err := cached.Stat(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, key, info.Key)
+	assert.Equal(t, int64(len("first")), info.Size)
+	assert.True(t, cached.Exists(ctx, key))
+	assert.InDelta(t, stats+1, testutil.ToFloat64(metrics.StorageCacheRequests.WithLabelValues(metrics.StorageStat, metrics.ResultHit)), 0)
+
+	// Writes of another instance are not seen until the entry expires
+	require.NoError(t, ts.dbs.Store(ctx, key, []byte("other")))
+	content, err := cached.Load(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("first"), content)
+
+	// Writes of this instance are seen at once
+	require.NoError(t, cached.Store(ctx, key, []byte("second")))
+	content, err = cached.Load(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("second"), content)
+
+	require.NoError(t, cached.Delete(ctx, key))
+	assert.False(t, cached.Exists(ctx, key))
+	_, err = cached.Load(ctx, key)
+	require.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func (ts *StorageTestSuite) TestStorage_CacheExpiry() {
+	t := ts.T()
+	ctx := t.Context()
+	cached := ts.newCachedStorage(time.Second)
+	key := path.Join("certificates", "acme-v02.api.example.com", "example.org", "example.org.json")
+
+	// Missing keys are cached too
+	negative := testutil.ToFloat64(metrics.StorageCacheRequests.WithLabelValues(metrics.StorageExists, metrics.ResultNegativeHit))
+	assert.False(t, cached.Exists(ctx, key))
+	require.NoError(t, ts.dbs.Store(ctx, key, []byte("{}")))
+	assert.False(t, cached.Exists(ctx, key))
+	assert.InDelta(t, negative+1, testutil.ToFloat64(metrics.StorageCacheRequests.WithLabelValues(metrics.StorageExists, metrics.ResultNegativeHit)), 0)
+
+	require.Eventually(t, func() bool {
+		return cached.Exists(ctx, key)
+	}, 5*time.Second, 100*time.Millisecond)
+	content, err := cached.Load(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("{}"), content)
+}
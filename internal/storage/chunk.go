@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"go.uber.org/zap"
+)
+
+const (
+	// chunkPrefix starts the keys of chunk items, which are neither indexed
+	// nor listed.
+	chunkPrefix = "CHUNK-"
+	// chunkSize is the most contents an item holds, leaving room below
+	// DynamoDB's 400 KB item limit for the other attributes.
+	chunkSize = 350 * 1024
+	// maxChunks keeps a value within one transaction's 4 MB limit.
+	maxChunks = 10
+)
+
+// chunkKey names the index'th chunk of the value at key. Every write of a
+// chunked value uses a new id, so readers never see chunks of two writes mixed.
+func chunkKey(key string, id string, index int) string {
+	return fmt.Sprintf("%s%s#%s/%d", chunkPrefix, key, id, index)
+}
+
+// put writes the item with input's condition. Contents too large for one item
+// are spread over chunk items written in a single transaction: the item keeps
+// the first chunk and records how many there are. Chunks of the value the
+// item replaces are deleted afterwards.
+func (dbs DynamoDBStorage) put(ctx context.Context, item *Item, input dynamodb.PutItemInput) error {
+	input.TableName = &dbs.Table
+	if len(item.Contents) <= chunkSize {
+		item.Chunks, item.ChunkID = 0, ""
+		input.Item = item.Item()
+		input.ReturnValues = types.ReturnValueAllOld
+		output, err := dbs.Client.PutItem(ctx, &input)
+		if err != nil {
+			return err
+		}
+		dbs.deleteChunks(ctx, output.Attributes)
+		return nil
+	}
+
+	// A transaction does not return the item it replaced
+	old, err := dbs.chunksOf(ctx, item.Key)
+	if err != nil {
+		return err
+	}
+	writes, err := dbs.putWrites(item, input)
+	if err != nil {
+		return err
+	}
+	if _, err = dbs.Client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: writes,
+	}); err != nil {
+		return err
+	}
+	dbs.deleteChunks(ctx, old)
+	return nil
+}
+
+// putWrites returns the transaction writes putting the item with input's
+// condition, the item first and then its chunks, which expire with it.
+func (dbs DynamoDBStorage) putWrites(item *Item, input dynamodb.PutItemInput) ([]types.TransactWriteItem, error) {
+	if len(item.Contents) > chunkSize*maxChunks {
+		return nil, fmt.Errorf("%s: %d bytes is too large to store", item.Key, len(item.Contents))
+	}
+	head := *item
+	head.Chunks, head.ChunkID = 0, ""
+	if len(item.Contents) > chunkSize {
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return nil, err
+		}
+		head.ChunkID = hex.EncodeToString(id)
+		head.Chunks = (len(item.Contents) + chunkSize - 1) / chunkSize
+		head.Contents = item.Contents[:chunkSize]
+	}
+
+	writes := []types.TransactWriteItem{{Put: &types.Put{
+		TableName:                 &dbs.Table,
+		Item:                      head.Item(),
+		ConditionExpression:       input.ConditionExpression,
+		ExpressionAttributeNames:  input.ExpressionAttributeNames,
+		ExpressionAttributeValues: input.ExpressionAttributeValues,
+	}}}
+	for i := 1; i < head.Chunks; i++ {
+		chunk := &Item{
+			Key:      chunkKey(head.Key, head.ChunkID, i),
+			Contents: item.Contents[i*chunkSize : min((i+1)*chunkSize, len(item.Contents))],
+			Expires:  head.Expires,
+		}
+		writes = append(writes, types.TransactWriteItem{Put: &types.Put{
+			TableName: &dbs.Table,
+			Item:      chunk.Item(),
+		}})
+	}
+	return writes, nil
+}
+
+// chunksOf reads what deleteChunks needs of the item at key.
+func (dbs DynamoDBStorage) chunksOf(ctx context.Context, key string) (map[string]types.AttributeValue, error) {
+	output, err := dbs.Client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:                &dbs.Table,
+		ConsistentRead:           aws.Bool(true),
+		Key:                      map[string]types.AttributeValue{"Key": &types.AttributeValueMemberS{Value: key}},
+		ExpressionAttributeNames: map[string]string{"#key": "Key", "#chunks": "Chunks", "#chunkID": "ChunkID"},
+		ProjectionExpression:     aws.String("#key, #chunks, #chunkID"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.Item, nil
+}
+
+// assemble appends the contents of the item's chunks to its own.
+func (dbs DynamoDBStorage) assemble(ctx context.Context, item *Item) error {
+	for i := 1; i < item.Chunks; i++ {
+		output, err := dbs.Client.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName:      &dbs.Table,
+			ConsistentRead: aws.Bool(true),
+			Key: map[string]types.AttributeValue{
+				"Key": &types.AttributeValueMemberS{Value: chunkKey(item.Key, item.ChunkID, i)},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if len(output.Item) == 0 {
+			return fmt.Errorf("%s: chunk %d of %d is missing", item.Key, i+1, item.Chunks)
+		}
+		var chunk Item
+		if err = chunk.Load(output.Item); err != nil {
+			return err
+		}
+		item.Contents = append(item.Contents, chunk.Contents...)
+	}
+	return nil
+}
+
+// deleteChunks deletes the chunks of an item that has been replaced or
+// deleted. Failures only leave unreachable items behind, so they are logged.
+func (dbs DynamoDBStorage) deleteChunks(ctx context.Context, attributes map[string]types.AttributeValue) {
+	if len(attributes) == 0 {
+		return
+	}
+	var item Item
+	if err := item.Load(attributes); err != nil {
+		dbs.logger.Warn("unable to read replaced item", zap.Error(err))
+		return
+	}
+	for i := 1; i < item.Chunks; i++ {
+		key := chunkKey(item.Key, item.ChunkID, i)
+		_, err := dbs.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName: &dbs.Table,
+			Key:       map[string]types.AttributeValue{"Key": &types.AttributeValueMemberS{Value: key}},
+		})
+		if err != nil {
+			dbs.logger.Warn("unable to delete chunk", zap.String("key", key), zap.Error(err))
+		}
+	}
+}
+
+// conditionFailed reports whether a write was rejected by its condition,
+// whether written on its own or in a transaction.
+func conditionFailed(err error) bool {
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return true
+	}
+	var canceledErr *types.TransactionCanceledException
+	if errors.As(err, &canceledErr) {
+		for _, reason := range canceledErr.CancellationReasons {
+			if aws.ToString(reason.Code) == "ConditionalCheckFailed" {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package storage_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"path"
+
+	"github.com/CruGlobal/mirage-server/internal/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countItems counts the items in the table, chunks and locks included.
+func (ts *StorageTestSuite) countItems() int {
+	t := ts.T()
+	output, err := ts.dbs.Client.Scan(t.Context(), &dynamodb.ScanInput{
+		TableName:      aws.String(ts.dbs.Table),
+		ConsistentRead: aws.Bool(true),
+	})
+	require.NoError(t, err)
+	return len(output.Items)
+}
+
+func (ts *StorageTestSuite) TestStorage_Compression() {
+	t := ts.T()
+	key := path.Join("certificates", "acme-v02.api.example.com", "example.com", "example.com.crt")
+	value := bytes.Repeat([]byte("MIIFazCCA1OgAwIBAgIUB"), 1024)
+
+	require.NoError(t, ts.dbs.Store(t.Context(), key, value))
+	item := ts.getItem(key)
+	assert.Equal(t, "gzip", item.Encoding)
+	assert.Less(t, len(item.Contents), len(value))
+
+	content, err := ts.dbs.Load(t.Context(), key)
+	require.NoError(t, err)
+	assert.Equal(t, value, content)
+
+	stat, err := ts.dbs.Stat(t.Context(), key)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(value)), stat.Size, "the size is that of the value stored")
+
+	// Compressed items are still read with compression disabled
+	uncompressed := *ts.dbs
+	uncompressed.DisableCompression = true
+	content, err = uncompressed.Load(t.Context(), key)
+	require.NoError(t, err)
+	assert.Equal(t, value, content)
+
+	require.NoError(t, uncompressed.Store(t.Context(), key, value))
+	assert.Empty(t, ts.getItem(key).Encoding)
+}
+
+func (ts *StorageTestSuite) TestStorage_Chunks() {
+	t := ts.T()
+	key := path.Join("certificates", "acme-v02.api.example.com", "example.com", "example.com.json")
+	dir := path.Join("certificates", "acme-v02.api.example.com", "example.com")
+
+	// Random bytes do not compress, so 1 MB needs three items
+	value := make([]byte, 1024*1024)
+	_, err := rand.Read(value)
+	require.NoError(t, err)
+
+	require.NoError(t, ts.dbs.Store(t.Context(), key, value))
+	item := ts.getItem(key)
+	assert.Equal(t, 3, item.Chunks)
+	assert.Equal(t, 3, ts.countItems())
+
+	content, err := ts.dbs.Load(t.Context(), key)
+	require.NoError(t, err)
+	assert.Equal(t, value, content)
+
+	stat, err := ts.dbs.Stat(t.Context(), key)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(value)), stat.Size)
+
+	keys, err := ts.dbs.List(t.Context(), dir, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{key}, keys, "chunks are not listed")
+
+	// Replacing the value removes the chunks of the previous one
+	require.NoError(t, ts.dbs.Store(t.Context(), key, value[:500*1024]))
+	assert.Equal(t, 2, ts.getItem(key).Chunks)
+	assert.Equal(t, 2, ts.countItems())
+	require.NoError(t, ts.dbs.Store(t.Context(), key, value[:1024]))
+	assert.Zero(t, ts.getItem(key).Chunks)
+	assert.Equal(t, 1, ts.countItems())
+
+	require.NoError(t, ts.dbs.Store(t.Context(), key, value))
+	require.NoError(t, ts.dbs.Delete(t.Context(), key))
+	assert.Zero(t, ts.countItems(), "deleting a value deletes its chunks")
+
+	// Values beyond what one transaction can write are rejected
+	large := make([]byte, 4*1024*1024)
+	_, err = rand.Read(large)
+	require.NoError(t, err)
+	require.ErrorContains(t, ts.dbs.Store(t.Context(), key, large), "too large")
+}
+
+func (ts *StorageTestSuite) TestStorage_ChunksEncrypted() {
+	t := ts.T()
+	key := path.Join("certificates", "acme-v02.api.example.com", "example.org", "example.org.json")
+	value := make([]byte, 800*1024)
+	_, err := rand.Read(value)
+	require.NoError(t, err)
+
+	oldFile := writeKeyFile(t)
+	oldKeys := &storage.FileKeys{KeyFile: oldFile}
+	require.NoError(t, oldKeys.Provision(caddy.Context{}))
+	old := *ts.dbs
+	old.Keys = oldKeys
+	require.NoError(t, old.Store(t.Context(), key, value))
+	assert.Equal(t, 3, ts.getItem(key).Chunks)
+
+	// Reencrypting a chunked value replaces all of its chunks
+	newKeys := &storage.FileKeys{KeyFile: writeKeyFile(t), OldKeyFiles: []string{oldFile}}
+	require.NoError(t, newKeys.Provision(caddy.Context{}))
+	current := *ts.dbs
+	current.Keys = newKeys
+	rewritten, err := current.ReencryptItems(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, 1, rewritten, "chunks are rewritten with their value")
+	assert.Equal(t, 3, ts.countItems())
+
+	content, err := current.Load(t.Context(), key)
+	require.NoError(t, err)
+	assert.Equal(t, value, content)
+}
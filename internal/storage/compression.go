@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// encodingGzip marks items whose contents are gzip compressed.
+const encodingGzip = "gzip"
+
+// compressMinSize is the size below which contents are not worth compressing.
+const compressMinSize = 512
+
+// compress gzips the item's contents unless compression is disabled, the
+// contents are small, or compressing them does not save space.
+func (dbs DynamoDBStorage) compress(item *Item) error {
+	if dbs.DisableCompression || len(item.Contents) < compressMinSize {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(item.Contents); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if buf.Len() >= len(item.Contents) {
+		return nil
+	}
+	item.Contents = buf.Bytes()
+	item.Encoding = encodingGzip
+	return nil
+}
+
+// decompress restores the item's contents. Compressed items are read even
+// with compression disabled.
+func decompress(item *Item) error {
+	switch item.Encoding {
+	case "":
+		return nil
+	case encodingGzip:
+		r, err := gzip.NewReader(bytes.NewReader(item.Contents))
+		if err != nil {
+			return fmt.Errorf("decompressing %s: %w", item.Key, err)
+		}
+		contents, err := io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("decompressing %s: %w", item.Key, err)
+		}
+		item.Contents = contents
+		item.Encoding = ""
+		return nil
+	default:
+		return fmt.Errorf("%s: unknown encoding %s", item.Key, item.Encoding)
+	}
+}
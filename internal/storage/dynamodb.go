@@ -1,19 +1,93 @@
 package storage
 
 import (
-	"sync"
+	"encoding/json"
 
 	"cirello.io/dynamolock/v2"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/CruGlobal/mirage-server/internal/dynamo"
+	"github.com/caddyserver/caddy/v2"
 	"go.uber.org/zap"
 )
 
+// DynamoDBStorage stores certificates in a DynamoDB table. When the mirage
+// app fails over between replicas, so do reads and plain writes, so
+// certificates are served while the primary is down. Locks and conditional
+// writes stay on the primary, as global tables replicate asynchronously: a
+// condition checked on a replica may no longer hold once the primary's writes
+// arrive. Obtaining and renewing certificates, which certmagic does under a
+// lock, waits for the primary to recover.
 type DynamoDBStorage struct {
-	logger *zap.Logger
-	locks  map[string]*dynamolock.Lock
-	mutex  *sync.RWMutex
+	logger  *zap.Logger
+	locks   *lockSet
+	bundles *bundleSet
+	cache   *readCache
 
-	Client *dynamodb.Client   `json:"-"`
+	Client dynamo.Client      `json:"-"`
 	Locker *dynamolock.Client `json:"-"`
 	Table  string             `json:"table,omitempty"`
+	// Prefix namespaces every key and lock in the table, so environments can
+	// share one table. Storages sharing a table should all set a prefix:
+	// those without one see the keys of all others.
+	Prefix string `json:"prefix,omitempty"`
+	// AutoCreate creates the table, with its index and time to live, if it
+	// does not exist when the storage is provisioned, and enables time to
+	// live on an existing table. Existing tables are checked to be keyed by
+	// Key either way.
+	AutoCreate bool `json:"auto_create,omitempty"`
+
+	// LockOwner is recorded in the locks this instance holds, so operators
+	// can tell who holds a lock, see Locks. Defaults to the hostname and
+	// process ID; a placeholder such as {env.TASK_ID} can name the task.
+	LockOwner string `json:"lock_owner,omitempty"`
+	// LeaseDuration is how long a lock is held without being renewed, and
+	// HeartbeatPeriod how often held locks are renewed. A lock whose lease
+	// has expired, as when its owner stopped, is taken over. The lease must
+	// be at least three heartbeat periods long. Default to 15s and 5s.
+	LeaseDuration   caddy.Duration `json:"lease_duration,omitempty"`
+	HeartbeatPeriod caddy.Duration `json:"heartbeat_period,omitempty"`
+
+	// Index is the global secondary index List queries. Defaults to
+	// RootKeyIndex, see CreateTableInput.
+	Index string `json:"index,omitempty"`
+	// ScanList lists keys with a Scan of the whole table instead of the
+	// index, for tables the index has not been added to yet.
+	ScanList bool `json:"scan_list,omitempty"`
+	// Backfill sets the index attribute on items stored before the index
+	// existed when the storage is provisioned. It is meant to be enabled
+	// once after adding the index to an existing table.
+	Backfill bool `json:"backfill_index,omitempty"`
+
+	// KeysRaw is the key provider item contents are encrypted with. Without
+	// one contents are stored in plaintext.
+	KeysRaw json.RawMessage `json:"encryption,omitempty" caddy:"namespace=caddy.storage.dynamodb.keys inline_key=provider"`
+	Keys    KeyProvider     `json:"-"`
+	// Reencrypt rewrites plaintext items and items encrypted with an older
+	// key when the storage is provisioned, see ReencryptItems.
+	Reencrypt bool `json:"reencrypt,omitempty"`
+
+	// DisableCompression stores contents as they are. Compressed items are
+	// still read.
+	DisableCompression bool `json:"disable_compression,omitempty"`
+
+	// TTLGracePeriod is how long certificate files are kept past the expiry
+	// of their certificate, see TTLAttribute. Defaults to 14 days.
+	TTLGracePeriod caddy.Duration `json:"ttl_grace_period,omitempty"`
+
+	// CacheTTL, if set, caches what Load, Stat and Exists read for as long,
+	// up to CacheCapacity keys, which defaults to 1000. Keys this instance
+	// stores or deletes are dropped from the cache; those written by other
+	// instances are seen once their entry expires.
+	CacheTTL      caddy.Duration `json:"cache_ttl,omitempty"`
+	CacheCapacity int            `json:"cache_capacity,omitempty"`
+
+	// Credentials override the mirage app's credentials for the certificate
+	// table. By default the app's client is shared.
+	Credentials *dynamo.Credentials `json:"credentials,omitempty"`
+}
+
+// onPrimary returns the storage with its client set to the primary replica's,
+// for locks and conditional writes, see dynamo.Primary.
+func (dbs DynamoDBStorage) onPrimary() DynamoDBStorage {
+	dbs.Client = dynamo.Primary(dbs.Client)
+	return dbs
 }
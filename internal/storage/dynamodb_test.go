@@ -0,0 +1,63 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/CruGlobal/mirage-server/internal/dynamo"
+	"github.com/CruGlobal/mirage-server/internal/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// replicaClient serves one item, or fails every call when down.
+type replicaClient struct {
+	dynamo.Client
+	item *storage.Item
+	down bool
+	puts int
+}
+
+func (c *replicaClient) GetItem(_ context.Context, _ *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	if c.down {
+		return nil, errors.New("replica is down")
+	}
+	return &dynamodb.GetItemOutput{Item: c.item.Item()}, nil
+}
+
+func (c *replicaClient) PutItem(_ context.Context, _ *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	c.puts++
+	if c.down {
+		return nil, errors.New("replica is down")
+	}
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func TestStorage_Failover(t *testing.T) {
+	item := &storage.Item{Key: "acme/users/hello.json", Contents: []byte("{}"), Modified: aws.Time(time.Now()), Version: 1}
+	primary := &replicaClient{item: item, down: true}
+	replica := &replicaClient{item: item}
+	dbs := storage.NewDynamoDBStorage()
+	dbs.Client = dynamo.NewFailover([]dynamo.Replica{
+		{Name: "us-east-1", Client: primary},
+		{Name: "us-west-2", Client: replica},
+	})
+
+	// Reads are served by a replica while the primary is down
+	contents, err := dbs.Load(t.Context(), item.Key)
+	require.NoError(t, err)
+	assert.Equal(t, item.Contents, contents)
+
+	// Versioned reads and writes are not, as their condition only holds on
+	// the primary
+	_, _, err = dbs.LoadVersion(t.Context(), item.Key)
+	require.Error(t, err)
+	_, err = dbs.StoreVersion(t.Context(), item.Key, []byte("{}"), item.Version)
+	require.Error(t, err)
+	assert.Equal(t, 1, primary.puts)
+	assert.Zero(t, replica.puts)
+}
@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"go.uber.org/zap"
+)
+
+// KeyNamespace is the Caddy module namespace of key providers.
+const KeyNamespace = "caddy.storage.dynamodb.keys"
+
+// dataKeySize is the size of the AES-256 keys item contents are encrypted with.
+const dataKeySize = 32
+
+// ErrNoKeyProvider is returned when loading an encrypted item without a key
+// provider configured.
+var ErrNoKeyProvider = errors.New("item is encrypted but no key provider is configured")
+
+// KeyProvider wraps the data keys item contents are encrypted with, so only
+// the wrapped keys are stored next to the contents.
+type KeyProvider interface {
+	// KeyID names the key new data keys are wrapped with.
+	KeyID() string
+	// WrapKey encrypts a data key with the current key.
+	WrapKey(ctx context.Context, dataKey []byte) ([]byte, error)
+	// UnwrapKey decrypts a data key wrapped with the key named keyID, which
+	// may be a key rotated out since.
+	UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// DataKeyGenerator is implemented by key providers that hand out the data
+// keys items are encrypted with, along with their wrapped form, such as to
+// reuse one for a while rather than wrapping a new key for every item.
+type DataKeyGenerator interface {
+	GenerateDataKey(ctx context.Context) ([]byte, []byte, error)
+}
+
+// seal encrypts the item's contents with a data key, new unless the key
+// provider hands them out. Without a key provider the contents are stored as
+// they are.
+func (dbs DynamoDBStorage) seal(ctx context.Context, item *Item) error {
+	if dbs.Keys == nil {
+		return nil
+	}
+
+	dataKey, wrapped, err := newDataKey(ctx, dbs.Keys)
+	if err != nil {
+		return fmt.Errorf("wrapping data key for %s: %w", item.Key, err)
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return err
+	}
+	// The key is authenticated so contents cannot be moved to another key
+	item.Contents = aead.Seal(nil, nonce, item.Contents, []byte(item.Key))
+	item.Nonce = nonce
+	item.DataKey = wrapped
+	item.KeyID = dbs.Keys.KeyID()
+	return nil
+}
+
+// open decrypts the item's contents. Items stored before encryption was
+// enabled are returned as they are, so tables can be migrated gradually.
+func (dbs DynamoDBStorage) open(ctx context.Context, item *Item) error {
+	if item.DataKey == nil {
+		return nil
+	}
+	if dbs.Keys == nil {
+		return fmt.Errorf("%s: %w", item.Key, ErrNoKeyProvider)
+	}
+
+	dataKey, err := dbs.Keys.UnwrapKey(ctx, item.KeyID, item.DataKey)
+	if err != nil {
+		return fmt.Errorf("unwrapping data key for %s: %w", item.Key, err)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+	contents, err := aead.Open(nil, item.Nonce, item.Contents, []byte(item.Key))
+	if err != nil {
+		return fmt.Errorf("decrypting %s: %w", item.Key, err)
+	}
+	item.Contents = contents
+	item.Nonce = nil
+	item.DataKey = nil
+	item.KeyID = ""
+	return nil
+}
+
+// newDataKey returns a data key and its wrapped form from keys.
+func newDataKey(ctx context.Context, keys KeyProvider) ([]byte, []byte, error) {
+	if generator, ok := keys.(DataKeyGenerator); ok {
+		return generator.GenerateDataKey(ctx)
+	}
+	return wrapNewKey(ctx, keys)
+}
+
+// wrapNewKey returns a new random data key and its form wrapped by keys.
+func wrapNewKey(ctx context.Context, keys KeyProvider) ([]byte, []byte, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, err
+	}
+	wrapped, err := keys.WrapKey(ctx, dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dataKey, wrapped, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ReencryptItems rewrites items that are stored in plaintext or whose data
+// key is wrapped with a key other than the current one, completing a
+// migration or key rotation. Only items within Prefix are rewritten; lock and
+// chunk items are skipped, chunked values being rewritten whole. It returns
+// the number of items rewritten.
+func (dbs DynamoDBStorage) ReencryptItems(ctx context.Context) (int, error) {
+	if dbs.Keys == nil {
+		return 0, ErrNoKeyProvider
+	}
+	dbs = dbs.onPrimary()
+
+	names := map[string]string{"#keyID": "KeyID"}
+	values := map[string]types.AttributeValue{
+		":keyID": &types.AttributeValueMemberS{Value: dbs.Keys.KeyID()},
+	}
+	filter := dbs.scanFilter(names, values)
+	paginator := dynamodb.NewScanPaginator(dbs.Client, &dynamodb.ScanInput{
+		TableName:                 &dbs.Table,
+		ConsistentRead:            aws.Bool(true),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		FilterExpression:          aws.String(filter + " AND (attribute_not_exists(#keyID) OR #keyID <> :keyID)"),
+	})
+
+	rewritten := 0
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return rewritten, err
+		}
+		for _, i := range output.Items {
+			var item Item
+			if err = item.Load(i); err != nil {
+				return rewritten, err
+			}
+			if err = dbs.assemble(ctx, &item); err != nil {
+				return rewritten, err
+			}
+			if err = dbs.open(ctx, &item); err != nil {
+				return rewritten, err
+			}
+			if err = dbs.seal(ctx, &item); err != nil {
+				return rewritten, err
+			}
+			// Skip items written since the scan, keeping the version of those
+			// rewritten as their value is unchanged
+			input := versionCondition(item.Version)
+			input.ExpressionAttributeNames["#key"] = "Key"
+			input.ConditionExpression = aws.String("attribute_exists(#key) AND " + *input.ConditionExpression)
+			err = dbs.put(ctx, &item, input)
+			if conditionFailed(err) {
+				continue
+			}
+			if err != nil {
+				return rewritten, fmt.Errorf("reencrypting %s: %w", item.Key, err)
+			}
+			rewritten++
+		}
+	}
+	dbs.logger.Info("reencrypted certificate storage", zap.String("table", dbs.Table), zap.Int("items", rewritten))
+	return rewritten, nil
+}
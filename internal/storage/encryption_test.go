@@ -0,0 +1,103 @@
+package storage_test
+
+import (
+	"bytes"
+	"path"
+	"testing"
+
+	"github.com/CruGlobal/mirage-server/internal/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorage_ReencryptWithoutKeys(t *testing.T) {
+	_, err := storage.NewDynamoDBStorage().ReencryptItems(t.Context())
+	require.ErrorIs(t, err, storage.ErrNoKeyProvider)
+}
+
+// getItem reads an item as stored, without decrypting it.
+func (ts *StorageTestSuite) getItem(key string) storage.Item {
+	t := ts.T()
+	output, err := ts.dbs.Client.GetItem(t.Context(), &dynamodb.GetItemInput{
+		TableName:      aws.String(ts.dbs.Table),
+		Key:            (&storage.Item{Key: key}).Item(),
+		ConsistentRead: aws.Bool(true),
+	})
+	require.NoError(t, err)
+	var item storage.Item
+	require.NoError(t, item.Load(output.Item))
+	return item
+}
+
+func (ts *StorageTestSuite) TestStorage_Encryption() {
+	t := ts.T()
+	key := path.Join("certificates", "acme-v02.api.example.com", "example.com", "example.com.key")
+	value := bytes.Repeat([]byte("k"), 2048)
+
+	keys := &storage.FileKeys{KeyFile: writeKeyFile(t)}
+	require.NoError(t, keys.Provision(caddy.Context{}))
+	encrypted := *ts.dbs
+	encrypted.Keys = keys
+
+	require.NoError(t, encrypted.Store(t.Context(), key, value))
+	item := ts.getItem(key)
+	assert.NotEqual(t, value, item.Contents)
+	assert.Equal(t, keys.KeyID(), item.KeyID)
+	assert.NotEmpty(t, item.DataKey)
+
+	content, err := encrypted.Load(t.Context(), key)
+	require.NoError(t, err)
+	assert.Equal(t, value, content)
+
+	stat, err := encrypted.Stat(t.Context(), key)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(value)), stat.Size)
+
+	// Encrypted items cannot be read without the key provider
+	_, err = ts.dbs.Load(t.Context(), key)
+	require.ErrorIs(t, err, storage.ErrNoKeyProvider)
+}
+
+func (ts *StorageTestSuite) TestStorage_ReencryptItems() {
+	t := ts.T()
+	plain := path.Join("certificates", "acme-v02.api.example.com", "example.com", "example.com.key")
+	rotated := path.Join("certificates", "acme-v02.api.example.com", "example.org", "example.org.key")
+	value := bytes.Repeat([]byte("p"), 1024)
+
+	oldFile := writeKeyFile(t)
+	oldKeys := &storage.FileKeys{KeyFile: oldFile}
+	require.NoError(t, oldKeys.Provision(caddy.Context{}))
+	newKeys := &storage.FileKeys{KeyFile: writeKeyFile(t), OldKeyFiles: []string{oldFile}}
+	require.NoError(t, newKeys.Provision(caddy.Context{}))
+
+	// One item predates encryption, the other is wrapped with a rotated-out key
+	require.NoError(t, ts.dbs.Store(t.Context(), plain, value))
+	old := *ts.dbs
+	old.Keys = oldKeys
+	require.NoError(t, old.Store(t.Context(), rotated, value))
+	require.NoError(t, ts.dbs.Lock(t.Context(), "reencrypt"))
+	defer ts.dbs.Unlock(t.Context(), "reencrypt") //nolint:errcheck // test cleanup
+
+	current := *ts.dbs
+	current.Keys = newKeys
+	content, err := current.Load(t.Context(), plain)
+	require.NoError(t, err)
+	assert.Equal(t, value, content, "plaintext items are still read")
+
+	rewritten, err := current.ReencryptItems(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, 2, rewritten, "locks are not reencrypted")
+	for _, key := range []string{plain, rotated} {
+		assert.Equal(t, newKeys.KeyID(), ts.getItem(key).KeyID)
+		content, err = current.Load(t.Context(), key)
+		require.NoError(t, err)
+		assert.Equal(t, value, content)
+	}
+
+	rewritten, err = current.ReencryptItems(t.Context())
+	require.NoError(t, err)
+	assert.Zero(t, rewritten)
+}
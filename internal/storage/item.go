@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
@@ -8,10 +9,31 @@ import (
 )
 
 type Item struct {
-	Key      string     `dynamodbav:"Key"`
+	Key string `dynamodbav:"Key"`
+	// Root is the first segment of Key, the partition key of the index List
+	// queries.
+	Root     string     `dynamodbav:"Root,omitempty"`
 	Contents []byte     `dynamodbav:"Contents,omitempty"`
 	Modified *time.Time `dynamodbav:"Modified,omitempty"`
 	Size     int64      `dynamodbav:"Size,omitempty"`
+	// Version identifies the write of the value, see StoreVersion.
+	Version int64 `dynamodbav:"Version,omitempty"`
+	// Expires is when certificate files expire, in Unix seconds, see
+	// TTLAttribute.
+	Expires int64 `dynamodbav:"Expires,omitempty"`
+
+	// Encoding names how Contents is compressed, if it is.
+	Encoding string `dynamodbav:"Encoding,omitempty"`
+	// Chunks and ChunkID are set on values spread over several items: Contents
+	// holds the first chunk and the rest are stored under chunk keys.
+	Chunks  int    `dynamodbav:"Chunks,omitempty"`
+	ChunkID string `dynamodbav:"ChunkID,omitempty"`
+
+	// KeyID, DataKey and Nonce are set on encrypted items: Contents is
+	// encrypted with DataKey, which is wrapped with the key named KeyID.
+	KeyID   string `dynamodbav:"KeyID,omitempty"`
+	DataKey []byte `dynamodbav:"DataKey,omitempty"`
+	Nonce   []byte `dynamodbav:"Nonce,omitempty"`
 }
 
 func (i *Item) Item() map[string]types.AttributeValue {
@@ -22,3 +44,9 @@ func (i *Item) Item() map[string]types.AttributeValue {
 func (i *Item) Load(item map[string]types.AttributeValue) error {
 	return attributevalue.UnmarshalMap(item, i)
 }
+
+// rootOf returns the first segment of a storage key or path.
+func rootOf(key string) string {
+	root, _, _ := strings.Cut(key, "/")
+	return root
+}
@@ -39,6 +39,14 @@ func TestItem_Item(t *testing.T) {
 				"Size":     &types.AttributeValueMemberN{Value: "7"},
 			},
 		},
+		{
+			name: "root",
+			item: &storage.Item{Key: "acme/example.com", Root: "acme"},
+			want: map[string]types.AttributeValue{
+				"Key":  &types.AttributeValueMemberS{Value: "acme/example.com"},
+				"Root": &types.AttributeValueMemberS{Value: "acme"},
+			},
+		},
 		{
 			name: "only contents",
 			item: &storage.Item{
@@ -0,0 +1,392 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/CruGlobal/mirage-server/internal/app"
+	"github.com/CruGlobal/mirage-server/internal/dynamo"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/jellydator/ttlcache/v3"
+)
+
+var (
+	// Interface guards.
+	_ caddy.Module          = (*FileKeys)(nil)
+	_ caddy.Provisioner     = (*FileKeys)(nil)
+	_ caddyfile.Unmarshaler = (*FileKeys)(nil)
+	_ KeyProvider           = (*FileKeys)(nil)
+
+	_ caddy.Module          = (*KMSKeys)(nil)
+	_ caddy.Provisioner     = (*KMSKeys)(nil)
+	_ caddyfile.Unmarshaler = (*KMSKeys)(nil)
+	_ KeyProvider           = (*KMSKeys)(nil)
+	_ DataKeyGenerator      = (*KMSKeys)(nil)
+)
+
+// wrapContext binds wrapped data keys to their use.
+const wrapContext = "mirage certificate storage"
+
+const (
+	// DefaultKMSCacheTTL is how long KMSKeys reuses a data key for new items
+	// and keeps the data keys it unwrapped.
+	DefaultKMSCacheTTL = 5 * time.Minute
+	// kmsCacheCapacity is how many unwrapped data keys KMSKeys keeps.
+	kmsCacheCapacity = 1000
+)
+
+func init() {
+	caddy.RegisterModule(FileKeys{})
+	caddy.RegisterModule(KMSKeys{})
+}
+
+// FileKeys wraps data keys with AES-256 keys read from files, each holding 32
+// bytes encoded as base64, such as the output of openssl rand -base64 32.
+//
+// Keys are identified by a fingerprint, so rotating is a matter of writing a
+// new key file and moving the old one to old_key_file until every item has
+// been reencrypted.
+type FileKeys struct {
+	// KeyFile holds the key new data keys are wrapped with.
+	KeyFile string `json:"key_file,omitempty"`
+	// OldKeyFiles hold keys rotated out that items may still be wrapped with.
+	OldKeyFiles []string `json:"old_key_files,omitempty"`
+
+	current string
+	keys    map[string][]byte
+}
+
+func (FileKeys) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  KeyNamespace + ".file",
+		New: func() caddy.Module { return new(FileKeys) },
+	}
+}
+
+func (f *FileKeys) Provision(_ caddy.Context) error {
+	repl := caddy.NewReplacer()
+	f.KeyFile = repl.ReplaceAll(f.KeyFile, "")
+	if f.KeyFile == "" {
+		return errors.New("key_file is required")
+	}
+
+	f.keys = make(map[string][]byte)
+	for i, path := range append([]string{f.KeyFile}, f.OldKeyFiles...) {
+		key, err := readKeyFile(repl.ReplaceAll(path, ""))
+		if err != nil {
+			return err
+		}
+		id := fingerprint(key)
+		if i == 0 {
+			f.current = id
+		}
+		f.keys[id] = key
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the key provider from Caddyfile tokens. Syntax:
+//
+//	encryption file [<key_file>] {
+//	    key_file <path>
+//	    old_key_file <path>
+//	}
+func (f *FileKeys) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			f.KeyFile = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			configKey := d.Val()
+			var configVal string
+
+			if !d.Args(&configVal) {
+				return d.ArgErr()
+			}
+
+			switch configKey {
+			case "key_file":
+				f.KeyFile = configVal
+			case "old_key_file":
+				f.OldKeyFiles = append(f.OldKeyFiles, configVal)
+			default:
+				return d.Errf("unknown parameter '%s' for encryption 'file'", configKey)
+			}
+		}
+	}
+	return nil
+}
+
+func (f *FileKeys) KeyID() string {
+	return f.current
+}
+
+func (f *FileKeys) WrapKey(_ context.Context, dataKey []byte) ([]byte, error) {
+	aead, err := newGCM(f.keys[f.current])
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, dataKey, []byte(wrapContext)), nil
+}
+
+func (f *FileKeys) UnwrapKey(_ context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	key, ok := f.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %s", keyID)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("wrapped key is too short")
+	}
+	nonce, ciphertext := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, []byte(wrapContext))
+}
+
+func readKeyFile(path string) ([]byte, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(contents)))
+	if err != nil {
+		return nil, fmt.Errorf("key file %s: %w", path, err)
+	}
+	if len(key) != dataKeySize {
+		return nil, fmt.Errorf("key file %s: key must be %d bytes, got %d", path, dataKeySize, len(key))
+	}
+	return key, nil
+}
+
+// fingerprint identifies a key without revealing it.
+func fingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// KMSClient is the part of the KMS API that wraps data keys. Tests and local
+// setups can stand in for KMS by implementing it.
+type KMSClient interface {
+	Encrypt(ctx context.Context, params *kms.EncryptInput, optFns ...func(*kms.Options)) (*kms.EncryptOutput, error)
+	Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error)
+}
+
+// credentialsKey passes the storage's credentials override to the key
+// provider it loads.
+type credentialsKey struct{}
+
+// KMSKeys wraps data keys with an AWS KMS key, or any service that speaks the
+// KMS API at endpoint. KMS rotates the key material itself. To move to a
+// different key, change key_id and reencrypt; items wrapped with the old key
+// can be read meanwhile, as long as the old key remains usable.
+//
+// So that not every Store and Load calls KMS, items stored within CacheTTL of
+// each other share a data key, and unwrapped data keys are kept as long.
+type KMSKeys struct {
+	Client KMSClient `json:"-"`
+
+	// Key is the key ID, ARN or alias data keys are wrapped with.
+	Key string `json:"key_id,omitempty"`
+	// Region defaults to the mirage app's, and Endpoint to the region's KMS
+	// endpoint. The storage's credentials are used, which default to the
+	// app's.
+	Region   string `json:"region,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+	// CacheTTL is how long a data key is reused and kept once unwrapped.
+	// Defaults to DefaultKMSCacheTTL.
+	CacheTTL caddy.Duration `json:"cache_ttl,omitempty"`
+
+	cache *kmsCache
+}
+
+// kmsCache holds the data key KMSKeys wraps new items with, and the data keys
+// it unwrapped.
+type kmsCache struct {
+	mutex     sync.Mutex
+	dataKey   []byte
+	wrapped   []byte
+	expires   time.Time
+	unwrapped *ttlcache.Cache[string, []byte]
+}
+
+func (KMSKeys) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  KeyNamespace + ".kms",
+		New: func() caddy.Module { return new(KMSKeys) },
+	}
+}
+
+func (k *KMSKeys) Provision(ctx caddy.Context) error {
+	repl := caddy.NewReplacer()
+	k.Key = repl.ReplaceAll(k.Key, "")
+	k.Region = repl.ReplaceAll(k.Region, "")
+	k.Endpoint = repl.ReplaceAll(k.Endpoint, "")
+	if k.Key == "" {
+		return errors.New("key_id is required")
+	}
+	if k.CacheTTL < 0 {
+		return fmt.Errorf("cache_ttl %s must not be negative", time.Duration(k.CacheTTL))
+	}
+	if k.CacheTTL == 0 {
+		k.CacheTTL = caddy.Duration(DefaultKMSCacheTTL)
+	}
+	k.cache = &kmsCache{
+		unwrapped: ttlcache.New[string, []byte](
+			ttlcache.WithTTL[string, []byte](time.Duration(k.CacheTTL)),
+			ttlcache.WithCapacity[string, []byte](kmsCacheCapacity),
+			ttlcache.WithDisableTouchOnHit[string, []byte](),
+		),
+	}
+	if k.Client != nil {
+		return nil
+	}
+
+	module, err := ctx.App(app.AppName)
+	if err != nil {
+		return err
+	}
+	mirageApp, ok := module.(*app.App)
+	if !ok {
+		return fmt.Errorf("unexpected module type: %T", module)
+	}
+	if k.Region == "" {
+		k.Region = mirageApp.Region
+	}
+	creds := mirageApp.Credentials
+	if storageCreds, ok := ctx.Value(credentialsKey{}).(*dynamo.Credentials); ok && storageCreds != nil {
+		creds = storageCreds
+	}
+	cfg, err := creds.LoadConfig(ctx, k.Region, k.Endpoint)
+	if err != nil {
+		return err
+	}
+	k.Client = kms.NewFromConfig(cfg)
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the key provider from Caddyfile tokens. Syntax:
+//
+//	encryption kms [<key_id>] {
+//	    key_id <key_id>
+//	    region <region>
+//	    endpoint <endpoint>
+//	    cache_ttl <duration>
+//	}
+func (k *KMSKeys) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			k.Key = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			configKey := d.Val()
+			var configVal string
+
+			if !d.Args(&configVal) {
+				return d.ArgErr()
+			}
+
+			switch configKey {
+			case "key_id":
+				k.Key = configVal
+			case "region":
+				k.Region = configVal
+			case "endpoint":
+				k.Endpoint = configVal
+			case "cache_ttl":
+				dur, err := caddy.ParseDuration(configVal)
+				if err != nil {
+					return d.Errf("invalid duration for 'cache_ttl': %v", err)
+				}
+				k.CacheTTL = caddy.Duration(dur)
+			default:
+				return d.Errf("unknown parameter '%s' for encryption 'kms'", configKey)
+			}
+		}
+	}
+	return nil
+}
+
+func (k *KMSKeys) KeyID() string {
+	return k.Key
+}
+
+func (k *KMSKeys) WrapKey(ctx context.Context, dataKey []byte) ([]byte, error) {
+	output, err := k.Client.Encrypt(ctx, &kms.EncryptInput{
+		KeyId:             aws.String(k.Key),
+		Plaintext:         dataKey,
+		EncryptionContext: map[string]string{"purpose": wrapContext},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.CiphertextBlob, nil
+}
+
+// GenerateDataKey returns the data key new items are encrypted with, and its
+// wrapped form. A new key is wrapped once the current one is CacheTTL old.
+func (k *KMSKeys) GenerateDataKey(ctx context.Context) ([]byte, []byte, error) {
+	if k.cache == nil {
+		return wrapNewKey(ctx, k)
+	}
+	k.cache.mutex.Lock()
+	defer k.cache.mutex.Unlock()
+	if k.cache.dataKey != nil && time.Now().Before(k.cache.expires) {
+		return k.cache.dataKey, k.cache.wrapped, nil
+	}
+	dataKey, wrapped, err := wrapNewKey(ctx, k)
+	if err != nil {
+		return nil, nil, err
+	}
+	k.cache.dataKey, k.cache.wrapped = dataKey, wrapped
+	k.cache.expires = time.Now().Add(time.Duration(k.CacheTTL))
+	k.cache.unwrapped.Set(string(wrapped), dataKey, ttlcache.DefaultTTL)
+	return dataKey, wrapped, nil
+}
+
+// UnwrapKey decrypts a data key, unless it was unwrapped or generated within
+// CacheTTL. The wrapped key names the KMS key it was wrapped with, so keys
+// rotated out or behind a changed alias still work.
+func (k *KMSKeys) UnwrapKey(ctx context.Context, _ string, wrapped []byte) ([]byte, error) {
+	if k.cache != nil {
+		if item := k.cache.unwrapped.Get(string(wrapped)); item != nil {
+			return item.Value(), nil
+		}
+	}
+	output, err := k.Client.Decrypt(ctx, &kms.DecryptInput{
+		CiphertextBlob:    wrapped,
+		EncryptionContext: map[string]string{"purpose": wrapContext},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if k.cache != nil {
+		k.cache.unwrapped.Set(string(wrapped), output.Plaintext, ttlcache.DefaultTTL)
+	}
+	return output.Plaintext, nil
+}
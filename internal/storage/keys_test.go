@@ -0,0 +1,289 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/CruGlobal/mirage-server/internal/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeKeyFile(t *testing.T) string {
+	t.Helper()
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "storage.key")
+	require.NoError(t, os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0o600))
+	return path
+}
+
+func TestFileKeys_Provision(t *testing.T) {
+	short := filepath.Join(t.TempDir(), "short.key")
+	require.NoError(t, os.WriteFile(short, []byte(base64.StdEncoding.EncodeToString([]byte("short"))), 0o600))
+
+	testcases := []struct {
+		name      string
+		keys      storage.FileKeys
+		expectErr string
+	}{
+		{
+			name: "valid",
+			keys: storage.FileKeys{KeyFile: writeKeyFile(t)},
+		},
+		{
+			name:      "missing key_file",
+			expectErr: "key_file is required",
+		},
+		{
+			name:      "short key",
+			keys:      storage.FileKeys{KeyFile: short},
+			expectErr: "key must be 32 bytes",
+		},
+		{
+			name:      "missing old key file",
+			keys:      storage.FileKeys{KeyFile: writeKeyFile(t), OldKeyFiles: []string{"/nonexistent.key"}},
+			expectErr: "no such file",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.keys.Provision(caddy.Context{})
+			if tc.expectErr != "" {
+				require.ErrorContains(t, err, tc.expectErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Len(t, tc.keys.KeyID(), 16)
+		})
+	}
+}
+
+func TestFileKeys_Rotation(t *testing.T) {
+	oldFile := writeKeyFile(t)
+	dataKey := bytes.Repeat([]byte("k"), 32)
+
+	old := storage.FileKeys{KeyFile: oldFile}
+	require.NoError(t, old.Provision(caddy.Context{}))
+	wrapped, err := old.WrapKey(t.Context(), dataKey)
+	require.NoError(t, err)
+
+	// A new key still unwraps data keys wrapped with the old one
+	rotated := storage.FileKeys{KeyFile: writeKeyFile(t), OldKeyFiles: []string{oldFile}}
+	require.NoError(t, rotated.Provision(caddy.Context{}))
+	assert.NotEqual(t, old.KeyID(), rotated.KeyID())
+	unwrapped, err := rotated.UnwrapKey(t.Context(), old.KeyID(), wrapped)
+	require.NoError(t, err)
+	assert.Equal(t, dataKey, unwrapped)
+
+	// Once the old key is dropped its data keys cannot be unwrapped
+	dropped := storage.FileKeys{KeyFile: rotated.KeyFile}
+	require.NoError(t, dropped.Provision(caddy.Context{}))
+	_, err = dropped.UnwrapKey(t.Context(), old.KeyID(), wrapped)
+	require.ErrorContains(t, err, "unknown key")
+
+	// Tampered data keys are rejected
+	wrapped[len(wrapped)-1] ^= 1
+	_, err = rotated.UnwrapKey(t.Context(), old.KeyID(), wrapped)
+	require.Error(t, err)
+}
+
+func TestFileKeys_UnmarshalCaddyfile(t *testing.T) {
+	testcases := []struct {
+		name      string
+		caddyfile string
+		expected  storage.FileKeys
+		expectErr bool
+	}{
+		{
+			name:      "argument",
+			caddyfile: `file /etc/mirage/storage.key`,
+			expected:  storage.FileKeys{KeyFile: "/etc/mirage/storage.key"},
+		},
+		{
+			name: "block",
+			caddyfile: `file {
+				key_file /etc/mirage/storage.key
+				old_key_file /etc/mirage/old1.key
+				old_key_file /etc/mirage/old2.key
+			}`,
+			expected: storage.FileKeys{
+				KeyFile:     "/etc/mirage/storage.key",
+				OldKeyFiles: []string{"/etc/mirage/old1.key", "/etc/mirage/old2.key"},
+			},
+		},
+		{
+			name:      "too many arguments",
+			caddyfile: `file /etc/mirage/storage.key extra`,
+			expectErr: true,
+		},
+		{
+			name: "unknown parameter",
+			caddyfile: `file {
+				key_id mirage
+			}`,
+			expectErr: true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var keys storage.FileKeys
+			err := keys.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tc.caddyfile))
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, keys)
+		})
+	}
+}
+
+// fakeKMS stands in for KMS, "wrapping" data keys by prefixing the key ID.
+type fakeKMS struct {
+	encryptInput *kms.EncryptInput
+	decryptInput *kms.DecryptInput
+	encrypts     int
+	decrypts     int
+}
+
+func (f *fakeKMS) Encrypt(_ context.Context, params *kms.EncryptInput, _ ...func(*kms.Options)) (*kms.EncryptOutput, error) {
+	f.encryptInput = params
+	f.encrypts++
+	return &kms.EncryptOutput{
+		CiphertextBlob: append([]byte(aws.ToString(params.KeyId)+":"), params.Plaintext...),
+		KeyId:          params.KeyId,
+	}, nil
+}
+
+func (f *fakeKMS) Decrypt(_ context.Context, params *kms.DecryptInput, _ ...func(*kms.Options)) (*kms.DecryptOutput, error) {
+	f.decryptInput = params
+	f.decrypts++
+	_, plaintext, _ := bytes.Cut(params.CiphertextBlob, []byte(":"))
+	return &kms.DecryptOutput{Plaintext: plaintext}, nil
+}
+
+func TestKMSKeys(t *testing.T) {
+	client := &fakeKMS{}
+	keys := storage.KMSKeys{Client: client, Key: "alias/mirage-storage"}
+	require.NoError(t, keys.Provision(caddy.Context{}))
+	assert.Equal(t, "alias/mirage-storage", keys.KeyID())
+
+	dataKey := bytes.Repeat([]byte("k"), 32)
+	wrapped, err := keys.WrapKey(t.Context(), dataKey)
+	require.NoError(t, err)
+	assert.Equal(t, "alias/mirage-storage", aws.ToString(client.encryptInput.KeyId))
+	assert.NotEmpty(t, client.encryptInput.EncryptionContext)
+
+	unwrapped, err := keys.UnwrapKey(t.Context(), "alias/previous", wrapped)
+	require.NoError(t, err)
+	assert.Equal(t, dataKey, unwrapped)
+	assert.Nil(t, client.decryptInput.KeyId, "KMS finds the key from the wrapped data key")
+	assert.Equal(t, client.encryptInput.EncryptionContext, client.decryptInput.EncryptionContext)
+
+	require.ErrorContains(t, (&storage.KMSKeys{Client: client}).Provision(caddy.Context{}), "key_id is required")
+}
+
+func TestKMSKeys_Cache(t *testing.T) {
+	client := &fakeKMS{}
+	keys := storage.KMSKeys{Client: client, Key: "alias/mirage-storage", CacheTTL: caddy.Duration(time.Hour)}
+	require.NoError(t, keys.Provision(caddy.Context{}))
+
+	// Items stored within the TTL share a data key, which KMS wraps once
+	dataKey, wrapped, err := keys.GenerateDataKey(t.Context())
+	require.NoError(t, err)
+	again, wrappedAgain, err := keys.GenerateDataKey(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, dataKey, again)
+	assert.Equal(t, wrapped, wrappedAgain)
+	assert.Equal(t, 1, client.encrypts)
+
+	// Data keys generated or unwrapped within the TTL are not decrypted again
+	unwrapped, err := keys.UnwrapKey(t.Context(), keys.KeyID(), wrapped)
+	require.NoError(t, err)
+	assert.Equal(t, dataKey, unwrapped)
+	assert.Zero(t, client.decrypts)
+	other := append([]byte("alias/previous:"), bytes.Repeat([]byte("o"), 32)...)
+	for range 2 {
+		unwrapped, err = keys.UnwrapKey(t.Context(), "alias/previous", other)
+		require.NoError(t, err)
+		assert.Equal(t, bytes.Repeat([]byte("o"), 32), unwrapped)
+	}
+	assert.Equal(t, 1, client.decrypts)
+
+	require.ErrorContains(t, (&storage.KMSKeys{Client: client, Key: "alias/mirage-storage", CacheTTL: -1}).Provision(caddy.Context{}), "must not be negative")
+}
+
+func TestKMSKeys_UnmarshalCaddyfile(t *testing.T) {
+	testcases := []struct {
+		name      string
+		caddyfile string
+		expected  storage.KMSKeys
+		expectErr bool
+	}{
+		{
+			name:      "argument",
+			caddyfile: `kms alias/mirage-storage`,
+			expected:  storage.KMSKeys{Key: "alias/mirage-storage"},
+		},
+		{
+			name: "block",
+			caddyfile: `kms {
+				key_id alias/mirage-storage
+				region us-west-2
+				endpoint http://localhost:4566
+				cache_ttl 1m
+			}`,
+			expected: storage.KMSKeys{
+				Key:      "alias/mirage-storage",
+				Region:   "us-west-2",
+				Endpoint: "http://localhost:4566",
+				CacheTTL: caddy.Duration(time.Minute),
+			},
+		},
+		{
+			name: "missing value",
+			caddyfile: `kms {
+				region
+			}`,
+			expectErr: true,
+		},
+		{
+			name: "invalid cache_ttl",
+			caddyfile: `kms {
+				cache_ttl soon
+			}`,
+			expectErr: true,
+		},
+		{
+			name: "unknown parameter",
+			caddyfile: `kms {
+				key_file /etc/mirage/storage.key
+			}`,
+			expectErr: true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var keys storage.KMSKeys
+			err := keys.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tc.caddyfile))
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, keys)
+		})
+	}
+}
@@ -2,62 +2,403 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"cirello.io/dynamolock/v2"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/caddyserver/certmagic"
 	"go.uber.org/zap"
 )
 
+var (
+	// Interface guards.
+	_ certmagic.TryLocker = (*DynamoDBStorage)(nil)
+)
+
+// LockInfo describes a lock held in the table.
+type LockInfo struct {
+	// Name is the key the lock was acquired for.
+	Name string `json:"name"`
+	// Owner identifies the instance holding the lock, see LockOwner.
+	Owner string `json:"owner,omitempty"`
+	// Acquired is when the owner asked for the lock.
+	Acquired *time.Time `json:"acquired,omitempty"`
+	// Renewed is when the owner last renewed its lease.
+	Renewed       *time.Time    `json:"renewed,omitempty"`
+	LeaseAge      time.Duration `json:"lease_age"`
+	LeaseDuration time.Duration `json:"lease_duration"`
+	// Expired is set once the lease has not been renewed in time, as when
+	// the owner has stopped.
+	Expired bool `json:"expired"`
+}
+
+// lockItem holds the attributes of a lock item, as written by dynamolock and
+// Lock.
+type lockItem struct {
+	Key                 string     `dynamodbav:"Key"`
+	Owner               string     `dynamodbav:"Owner,omitempty"`
+	Acquired            *time.Time `dynamodbav:"Acquired,omitempty"`
+	LeaseDuration       string     `dynamodbav:"leaseDuration,omitempty"`
+	RecordVersionNumber string     `dynamodbav:"recordVersionNumber,omitempty"`
+	IsReleased          string     `dynamodbav:"isReleased,omitempty"`
+}
+
+func (l lockItem) info(now time.Time) LockInfo {
+	info := LockInfo{
+		Name:          strings.TrimPrefix(l.Key, lockPrefix),
+		Owner:         l.Owner,
+		Acquired:      l.Acquired,
+		LeaseDuration: DefaultLeaseDuration,
+	}
+	if duration, err := time.ParseDuration(l.LeaseDuration); err == nil {
+		info.LeaseDuration = duration
+	}
+	// dynamolock versions lock items with the time they were written, which
+	// is renewed with every heartbeat
+	version, _, _ := strings.Cut(l.RecordVersionNumber, ":")
+	if nanos, err := strconv.ParseInt(version, 10, 64); err == nil {
+		renewed := time.Unix(0, nanos)
+		info.Renewed = &renewed
+		info.LeaseAge = now.Sub(renewed)
+		info.Expired = info.LeaseAge > info.LeaseDuration
+	}
+	return info
+}
+
+const lockPrefix = "LOCK-"
+
 func (dbs DynamoDBStorage) prefixLock(key string) string {
-	return fmt.Sprintf("LOCK-%s", key)
+	return lockPrefix + dbs.storageKey(key)
 }
 
-func (dbs DynamoDBStorage) GetLock(key string) (*dynamolock.Lock, bool) {
-	dbs.mutex.RLock()
-	defer dbs.mutex.RUnlock()
+// DefaultLockOwner identifies this process by hostname and process ID.
+func DefaultLockOwner() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", hostname, os.Getpid())
+}
+
+// ErrLeaseLost is the cause a lock's context is canceled with when its lease
+// could not be renewed in time, so another instance may hold the lock.
+var ErrLeaseLost = errors.New("lock lease lost")
+
+// heldLock is a lock held, or being acquired, by this instance.
+type heldLock struct {
+	// lock is nil while the lock is being acquired.
+	lock   *dynamolock.Lock
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	// done is closed once the lock is released or not acquired. A lock whose
+	// lease was lost stays claimed until its holder unlocks it.
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+func newHeldLock(ctx context.Context) *heldLock {
+	lockCtx, cancel := context.WithCancelCause(ctx)
+	return &heldLock{ctx: lockCtx, cancel: cancel, done: make(chan struct{})}
+}
+
+// end cancels the lock's context with cause and wakes those waiting for it.
+func (h *heldLock) end(cause error) {
+	h.cancel(cause)
+	h.doneOnce.Do(func() { close(h.done) })
+}
+
+// lost reports whether the lock's lease has been lost.
+func (h *heldLock) lost() bool {
+	return errors.Is(context.Cause(h.ctx), ErrLeaseLost)
+}
+
+// lockSet holds the locks of a storage instance, so that only one caller in
+// this instance holds a lock at a time. It is shared by the copies the value
+// receivers make.
+type lockSet struct {
+	mutex sync.Mutex
+	locks map[string]*heldLock
+}
+
+func newLockSet() *lockSet {
+	return &lockSet{locks: make(map[string]*heldLock)}
+}
+
+// claim reserves key for held. If another caller holds or is acquiring the
+// lock, its heldLock is returned instead. That includes locks whose lease was
+// lost, so their holder's Unlock cannot release a lock acquired after them.
+func (s *lockSet) claim(key string, held *heldLock) (*heldLock, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if current, ok := s.locks[key]; ok {
+		return current, false
+	}
+	s.locks[key] = held
+	return held, true
+}
+
+// acquired records the lock held for key.
+func (s *lockSet) acquired(held *heldLock, lock *dynamolock.Lock) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	held.lock = lock
+}
 
-	if lock, exists := dbs.locks[key]; exists {
-		return lock, true
+// get returns the lock held for key, if it has been acquired.
+func (s *lockSet) get(key string) (*heldLock, *dynamolock.Lock, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	held, ok := s.locks[key]
+	if !ok || held.lock == nil {
+		return nil, nil, false
 	}
-	return nil, false
+	return held, held.lock, true
+}
+
+// has reports whether a lock has been acquired for a key matching match.
+func (s *lockSet) has(match func(key string) bool) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for key, held := range s.locks {
+		if held.lock != nil && match(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// remove gives up key if held still has it, returning the lock acquired.
+func (s *lockSet) remove(key string, held *heldLock) *dynamolock.Lock {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.locks[key] == held {
+		delete(s.locks, key)
+	}
+	return held.lock
+}
+
+// lockOptions records who asks for a lock, and when, in the lock item, and
+// watches its lease. Should the lease go unrenewed for all but a heartbeat
+// period, lost is called.
+func (dbs DynamoDBStorage) lockOptions(lost func(), opts ...dynamolock.AcquireLockOption) []dynamolock.AcquireLockOption {
+	safeTime := time.Duration(dbs.LeaseDuration - dbs.HeartbeatPeriod)
+	return append(opts,
+		dynamolock.WithAdditionalAttributes(map[string]types.AttributeValue{
+			"Owner":    &types.AttributeValueMemberS{Value: dbs.LockOwner},
+			"Acquired": &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339Nano)},
+		}),
+		dynamolock.WithSessionMonitor(safeTime, lost),
+	)
+}
+
+func (dbs DynamoDBStorage) GetLock(key string) (*dynamolock.Lock, bool) {
+	held, lock, ok := dbs.locks.get(key)
+	if !ok || held.lost() {
+		return nil, false
+	}
+	return lock, true
 }
 
 // Lock acquires a distributed lock for the given key or blocks until it gets one.
 func (dbs DynamoDBStorage) Lock(ctx context.Context, key string) error {
-	dbs.logger.Debug("acquiring lock", zap.String("key", key))
+	_, _, err := dbs.acquire(ctx, key, false)
+	return err
+}
+
+// LockContext acquires a distributed lock like Lock. The context returned is
+// canceled with ErrLeaseLost should the lease be lost before Unlock, so work
+// done under the lock can stop. Other callers in this instance still wait for
+// that Unlock.
+func (dbs DynamoDBStorage) LockContext(ctx context.Context, key string) (context.Context, error) {
+	lockCtx, _, err := dbs.acquire(ctx, key, false)
+	return lockCtx, err
+}
+
+// TryLock acquires a distributed lock for the given key if no one else holds
+// it, without waiting. A lock whose owner has stopped renewing it is taken
+// over.
+func (dbs DynamoDBStorage) TryLock(ctx context.Context, key string) (bool, error) {
+	_, locked, err := dbs.acquire(ctx, key, true)
+	return locked, err
+}
 
-	if _, isLocked := dbs.GetLock(key); isLocked {
-		return nil
+// acquire acquires the lock for key, waiting for it unless try is set. It
+// returns the lock's context and whether the lock was acquired.
+func (dbs DynamoDBStorage) acquire(ctx context.Context, key string, try bool) (context.Context, bool, error) {
+	dbs.logger.Debug("acquiring lock", zap.String("key", key), zap.Bool("try", try))
+
+	held := newHeldLock(ctx)
+	for {
+		current, claimed := dbs.locks.claim(key, held)
+		if claimed {
+			break
+		}
+		// Another caller in this instance holds the lock
+		if try {
+			held.end(nil)
+			return nil, false, nil
+		}
+		select {
+		case <-current.done:
+		case <-ctx.Done():
+			held.end(nil)
+			return nil, false, ctx.Err()
+		}
+	}
+
+	lost := func() {
+		dbs.logger.Error("lost lock lease",
+			zap.String("key", key),
+			zap.String("owner", dbs.LockOwner),
+			zap.Duration("lease_duration", time.Duration(dbs.LeaseDuration)),
+		)
+		held.cancel(ErrLeaseLost)
+	}
+	var opts []dynamolock.AcquireLockOption
+	if try {
+		opts = append(opts, dynamolock.FailIfLocked())
 	}
 
-	lock, err := dbs.Locker.AcquireLockWithContext(ctx, dbs.prefixLock(key))
+	lock, err := dbs.Locker.AcquireLockWithContext(ctx, dbs.prefixLock(key), dbs.lockOptions(lost, opts...)...)
+	var notGranted *dynamolock.LockNotGrantedError
+	if errors.As(err, &notGranted) {
+		// dynamolock only takes over a lock after watching it go unrenewed
+		// for a lease, which FailIfLocked does not wait for
+		var removed bool
+		removed, err = dbs.removeExpiredLock(ctx, key)
+		if removed {
+			lock, err = dbs.Locker.AcquireLockWithContext(ctx, dbs.prefixLock(key), dbs.lockOptions(lost, opts...)...)
+		} else if err == nil {
+			err = notGranted
+		}
+	}
 	if err != nil {
-		return fmt.Errorf("unable to acquire lock: %w", err)
+		dbs.locks.remove(key, held)
+		held.end(nil)
+		if try && errors.As(err, &notGranted) {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("unable to acquire lock: %w", err)
 	}
 
-	dbs.mutex.Lock()
-	dbs.locks[key] = lock
-	dbs.mutex.Unlock()
+	dbs.locks.acquired(held, lock)
+	return held.ctx, true, nil
+}
+
+// removeExpiredLock deletes the lock for key if its lease has not been renewed
+// for twice its duration, allowing for clock skew between instances. It
+// reports whether the lock was removed.
+func (dbs DynamoDBStorage) removeExpiredLock(ctx context.Context, key string) (bool, error) {
+	dbs = dbs.onPrimary()
+	output, err := dbs.Client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      &dbs.Table,
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]types.AttributeValue{
+			"Key": &types.AttributeValueMemberS{Value: dbs.prefixLock(key)},
+		},
+	})
+	if err != nil || len(output.Item) == 0 {
+		return false, err
+	}
+	var lock lockItem
+	if err = attributevalue.UnmarshalMap(output.Item, &lock); err != nil {
+		return false, err
+	}
+	info := lock.info(time.Now())
+	if info.Renewed == nil || info.LeaseAge < 2*info.LeaseDuration {
+		return false, nil
+	}
 
-	return nil
+	_, err = dbs.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: &dbs.Table,
+		Key: map[string]types.AttributeValue{
+			"Key": &types.AttributeValueMemberS{Value: lock.Key},
+		},
+		ExpressionAttributeNames: map[string]string{"#rvn": "recordVersionNumber"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":rvn": &types.AttributeValueMemberS{Value: lock.RecordVersionNumber},
+		},
+		// Leave the lock alone if it was renewed or taken over meanwhile
+		ConditionExpression: aws.String("#rvn = :rvn"),
+	})
+	if conditionFailed(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	dbs.logger.Warn("removed expired lock",
+		zap.String("key", key),
+		zap.String("owner", info.Owner),
+		zap.Duration("lease_age", info.LeaseAge),
+	)
+	return true, nil
 }
 
-// Unlock releases a specific lock.
+// Unlock releases a specific lock. Releasing a lock whose lease was lost
+// fails with ErrLeaseLost if another instance has taken it over.
 func (dbs DynamoDBStorage) Unlock(ctx context.Context, name string) error {
 	// check if we own it and unlock
-	lock, exists := dbs.GetLock(name)
+	held, _, exists := dbs.locks.get(name)
 	if !exists {
 		return fmt.Errorf("lock %s not found", name)
 	}
+	dbs.dropBundles(name)
+	lock := dbs.locks.remove(name, held)
+	defer held.end(nil)
 
 	_, err := dbs.Locker.ReleaseLockWithContext(ctx, lock)
+	if err != nil && held.lost() {
+		err = errors.Join(ErrLeaseLost, err)
+	}
 	if err != nil {
-		return fmt.Errorf("unable to unlock %s: %w", name, err)
+		err = fmt.Errorf("unable to unlock %s: %w", name, err)
 	}
+	return err
+}
 
-	dbs.mutex.RLock()
-	delete(dbs.locks, name)
-	dbs.mutex.RUnlock()
+// Locks lists the locks held in the table by any instance, sorted by name.
+// Only locks within Prefix are listed.
+func (dbs DynamoDBStorage) Locks(ctx context.Context) ([]LockInfo, error) {
+	paginator := dynamodb.NewScanPaginator(dbs.onPrimary().Client, &dynamodb.ScanInput{
+		TableName:                &dbs.Table,
+		ConsistentRead:           aws.Bool(true),
+		ExpressionAttributeNames: map[string]string{"#key": "Key", "#released": "isReleased"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":lock": &types.AttributeValueMemberS{Value: dbs.prefixLock("")},
+		},
+		FilterExpression: aws.String("begins_with(#key, :lock) AND attribute_not_exists(#released)"),
+	})
 
-	return nil
+	now := time.Now()
+	locks := []LockInfo{}
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range output.Items {
+			var lock lockItem
+			if err = attributevalue.UnmarshalMap(i, &lock); err != nil {
+				return nil, err
+			}
+			info := lock.info(now)
+			info.Name = strings.TrimPrefix(lock.Key, dbs.prefixLock(""))
+			locks = append(locks, info)
+		}
+	}
+	slices.SortFunc(locks, func(a, b LockInfo) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return locks, nil
 }
@@ -1,12 +1,23 @@
 package storage_test
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
 	"path"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/CruGlobal/mirage-server/internal/storage"
 	"github.com/CruGlobal/mirage-server/miragetest"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/caddyserver/caddy/v2"
 )
 
 func (ts *StorageTestSuite) TestStorage_LockUnlock() {
@@ -63,3 +74,267 @@ func (ts *StorageTestSuite) TestStorage_TwoLocks() {
 	err = dbs2.Unlock(ctx, key)
 	ts.Require().NoError(err)
 }
+
+// newStorage provisions a second storage instance using the same table.
+func (ts *StorageTestSuite) newStorage(owner string) *storage.DynamoDBStorage {
+	endpoint, err := ts.ddbc.ConnectionString(ts.T().Context())
+	ts.Require().NoError(err)
+	dbs := storage.NewDynamoDBStorage()
+	dbs.Table = ts.dbs.Table
+	dbs.LockOwner = owner
+	ts.Require().NoError(dbs.Provision(miragetest.NewMirageCaddyContext(ts.T(), miragetest.TestConfig{
+		Region:   "us-east-1",
+		Endpoint: fmt.Sprintf("http://%s", endpoint),
+		Table:    "MirageServerConfigTest",
+		Key:      "Hostname",
+	})))
+	return dbs
+}
+
+func (ts *StorageTestSuite) TestStorage_TryLock() {
+	ctx := ts.T().Context()
+	key := "issue_cert_example.com"
+	dbs1, dbs2 := ts.newStorage("instance-1"), ts.newStorage("instance-2")
+
+	locked, err := dbs1.TryLock(ctx, key)
+	ts.Require().NoError(err)
+	ts.True(locked)
+
+	// A held lock is not waited for
+	start := time.Now()
+	locked, err = dbs2.TryLock(ctx, key)
+	ts.Require().NoError(err)
+	ts.False(locked)
+	ts.Less(time.Since(start), storage.DefaultLeaseDuration)
+
+	locks, err := dbs2.Locks(ctx)
+	ts.Require().NoError(err)
+	ts.Require().Len(locks, 1)
+	ts.Equal(key, locks[0].Name)
+	ts.Equal("instance-1", locks[0].Owner)
+	ts.NotNil(locks[0].Acquired)
+	ts.NotNil(locks[0].Renewed)
+	ts.Equal(storage.DefaultLeaseDuration, locks[0].LeaseDuration)
+	ts.False(locks[0].Expired)
+
+	ts.Require().NoError(dbs1.Unlock(ctx, key))
+	locks, err = dbs2.Locks(ctx)
+	ts.Require().NoError(err)
+	ts.Empty(locks, "released locks are not listed")
+
+	locked, err = dbs2.TryLock(ctx, key)
+	ts.Require().NoError(err)
+	ts.True(locked)
+	ts.Require().NoError(dbs2.Unlock(ctx, key))
+}
+
+func (ts *StorageTestSuite) TestStorage_TryLockExpired() {
+	ctx := ts.T().Context()
+	key := "issue_cert_example.org"
+
+	// The owner of this lock stopped renewing it a minute ago
+	renewed := time.Now().Add(-time.Minute)
+	_, err := ts.dbs.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(ts.dbs.Table),
+		Item: map[string]types.AttributeValue{
+			"Key":                 &types.AttributeValueMemberS{Value: "LOCK-" + key},
+			"ownerName":           &types.AttributeValueMemberS{Value: "stopped"},
+			"leaseDuration":       &types.AttributeValueMemberS{Value: storage.DefaultLeaseDuration.String()},
+			"recordVersionNumber": &types.AttributeValueMemberS{Value: fmt.Sprintf("%d:stopped", renewed.UnixNano())},
+			"Owner":               &types.AttributeValueMemberS{Value: "stopped:1"},
+		},
+	})
+	ts.Require().NoError(err)
+
+	locks, err := ts.dbs.Locks(ctx)
+	ts.Require().NoError(err)
+	ts.Require().Len(locks, 1)
+	ts.Equal("stopped:1", locks[0].Owner)
+	ts.True(locks[0].Expired)
+	ts.GreaterOrEqual(locks[0].LeaseAge, time.Minute)
+
+	dbs := ts.newStorage("instance-1")
+	locked, err := dbs.TryLock(ctx, key)
+	ts.Require().NoError(err)
+	ts.True(locked, "an expired lock is taken over")
+
+	locks, err = ts.dbs.Locks(ctx)
+	ts.Require().NoError(err)
+	ts.Require().Len(locks, 1)
+	ts.Equal("instance-1", locks[0].Owner)
+	ts.Require().NoError(dbs.Unlock(ctx, key))
+}
+
+func (ts *StorageTestSuite) TestStorage_AdminLocks() {
+	ctx := ts.T().Context()
+	endpoint, err := ts.ddbc.ConnectionString(ctx)
+	ts.Require().NoError(err)
+
+	a := new(storage.AdminAPI)
+	ts.Require().NoError(a.Provision(miragetest.NewMirageCaddyContext(ts.T(), miragetest.TestConfig{
+		Region:       "us-east-1",
+		Endpoint:     fmt.Sprintf("http://%s", endpoint),
+		Table:        "MirageServerConfigTest",
+		Key:          "Hostname",
+		StorageTable: ts.dbs.Table,
+	})))
+
+	ts.Require().NoError(ts.dbs.Lock(ctx, "admin"))
+	defer ts.dbs.Unlock(ctx, "admin") //nolint:errcheck // test cleanup
+
+	w := httptest.NewRecorder()
+	err = a.Routes()[0].Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, storage.AdminLocksEndpoint, nil))
+	ts.Require().NoError(err)
+
+	var body struct {
+		Locks []storage.LockInfo `json:"locks"`
+	}
+	ts.Require().NoError(json.Unmarshal(w.Body.Bytes(), &body))
+	ts.Require().Len(body.Locks, 1)
+	ts.Equal("admin", body.Locks[0].Name)
+	ts.Equal(ts.dbs.LockOwner, body.Locks[0].Owner)
+}
+
+func (ts *StorageTestSuite) TestStorage_LockExclusive() {
+	ctx := ts.T().Context()
+	key := "issue_cert_example.net"
+	instances := []*storage.DynamoDBStorage{ts.newStorage("instance-1"), ts.newStorage("instance-2")}
+
+	// Callers in the same instance are excluded as well as other instances
+	var holders, acquired atomic.Int32
+	var wg sync.WaitGroup
+	for i := range 8 {
+		dbs := instances[i%len(instances)]
+		wg.Go(func() {
+			for range 5 {
+				locked, err := dbs.TryLock(ctx, key)
+				if !ts.NoError(err) || !locked {
+					continue
+				}
+				acquired.Add(1)
+				ts.Equal(int32(1), holders.Add(1), "lock is held once")
+				_, ok := dbs.GetLock(key)
+				ts.True(ok)
+				time.Sleep(10 * time.Millisecond)
+				holders.Add(-1)
+				ts.NoError(dbs.Unlock(ctx, key))
+			}
+		})
+	}
+	wg.Wait()
+	ts.Positive(acquired.Load())
+
+	// A blocking lock waits for the caller holding it
+	dbs := instances[0]
+	ts.Require().NoError(dbs.Lock(ctx, key))
+	released := make(chan struct{})
+	go func() {
+		defer close(released)
+		time.Sleep(100 * time.Millisecond)
+		ts.NoError(dbs.Unlock(ctx, key))
+	}()
+	ts.Require().NoError(dbs.Lock(ctx, key))
+	select {
+	case <-released:
+	default:
+		ts.Fail("lock acquired while held")
+	}
+	ts.Require().NoError(dbs.Unlock(ctx, key))
+}
+
+func (ts *StorageTestSuite) TestStorage_LeaseLost() {
+	ctx := ts.T().Context()
+	key := "issue_cert_example.edu"
+
+	dbs := storage.NewDynamoDBStorage()
+	dbs.Table = ts.dbs.Table
+	dbs.LeaseDuration = caddy.Duration(3 * time.Second)
+	dbs.HeartbeatPeriod = caddy.Duration(time.Second)
+	ts.Require().NoError(ts.provision(dbs))
+
+	lockCtx, err := dbs.LockContext(ctx, key)
+	ts.Require().NoError(err)
+
+	// Another owner takes the lock over, so heartbeats stop renewing it
+	_, err = ts.dbs.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(ts.dbs.Table),
+		Item: map[string]types.AttributeValue{
+			"Key":                 &types.AttributeValueMemberS{Value: "LOCK-" + key},
+			"ownerName":           &types.AttributeValueMemberS{Value: "thief"},
+			"leaseDuration":       &types.AttributeValueMemberS{Value: storage.DefaultLeaseDuration.String()},
+			"recordVersionNumber": &types.AttributeValueMemberS{Value: fmt.Sprintf("%d:thief", time.Now().UnixNano())},
+		},
+	})
+	ts.Require().NoError(err)
+
+	select {
+	case <-lockCtx.Done():
+		ts.ErrorIs(context.Cause(lockCtx), storage.ErrLeaseLost)
+	case <-time.After(10 * time.Second):
+		ts.Fail("lease loss not detected")
+	}
+	_, ok := dbs.GetLock(key)
+	ts.False(ok, "a lost lock is not held")
+	ts.ErrorIs(dbs.Unlock(ctx, key), storage.ErrLeaseLost)
+}
+
+func (ts *StorageTestSuite) TestStorage_LeaseLostRelock() {
+	ctx := ts.T().Context()
+	key := "issue_cert_example.net"
+
+	dbs := storage.NewDynamoDBStorage()
+	dbs.Table = ts.dbs.Table
+	dbs.LeaseDuration = caddy.Duration(3 * time.Second)
+	dbs.HeartbeatPeriod = caddy.Duration(time.Second)
+	ts.Require().NoError(ts.provision(dbs))
+
+	lockCtx, err := dbs.LockContext(ctx, key)
+	ts.Require().NoError(err)
+
+	lockKey := map[string]types.AttributeValue{"Key": &types.AttributeValueMemberS{Value: "LOCK-" + key}}
+	thief := maps.Clone(lockKey)
+	thief["ownerName"] = &types.AttributeValueMemberS{Value: "thief"}
+	thief["leaseDuration"] = &types.AttributeValueMemberS{Value: storage.DefaultLeaseDuration.String()}
+	thief["recordVersionNumber"] = &types.AttributeValueMemberS{Value: fmt.Sprintf("%d:thief", time.Now().UnixNano())}
+	_, err = ts.dbs.Client.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(ts.dbs.Table), Item: thief})
+	ts.Require().NoError(err)
+	select {
+	case <-lockCtx.Done():
+	case <-time.After(10 * time.Second):
+		ts.FailNow("lease loss not detected")
+	}
+
+	// The thief lets go, and another caller in this instance locks the key
+	// while the lost lock is still held
+	_, err = ts.dbs.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{TableName: aws.String(ts.dbs.Table), Key: lockKey})
+	ts.Require().NoError(err)
+	type relock struct {
+		ctx context.Context
+		err error
+	}
+	relocked := make(chan relock, 1)
+	go func() {
+		relockCtx, relockErr := dbs.LockContext(ctx, key)
+		relocked <- relock{ctx: relockCtx, err: relockErr}
+	}()
+
+	select {
+	case <-relocked:
+		ts.FailNow("relocked while the lost lock is held")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// Unlocking the lost lock must not release the new one
+	ts.ErrorIs(dbs.Unlock(ctx, key), storage.ErrLeaseLost)
+	var result relock
+	select {
+	case result = <-relocked:
+	case <-time.After(10 * time.Second):
+		ts.FailNow("relock not acquired")
+	}
+	ts.Require().NoError(result.err)
+	ts.NoError(result.ctx.Err())
+	_, ok := dbs.GetLock(key)
+	ts.True(ok, "the new lock is held")
+	ts.Require().NoError(dbs.Unlock(ctx, key))
+}
@@ -3,14 +3,18 @@ package storage
 import (
 	"errors"
 	"fmt"
-	"sync"
+	"strconv"
+	"strings"
 	"time"
 
 	"cirello.io/dynamolock/v2"
 	"github.com/CruGlobal/mirage-server/internal/app"
+	"github.com/CruGlobal/mirage-server/internal/dynamo"
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
 )
 
 var (
@@ -23,8 +27,9 @@ var (
 )
 
 const (
-	DefaultTable  = "MirageServerCertificatesProd"
-	LeaseDuration = 15 * time.Second
+	DefaultTable           = "MirageServerCertificatesProd"
+	DefaultLeaseDuration   = 15 * time.Second
+	DefaultHeartbeatPeriod = 5 * time.Second
 )
 
 func init() {
@@ -34,9 +39,10 @@ func init() {
 // NewDynamoDBStorage creates a new DynamoDBStorage instance with default settings.
 func NewDynamoDBStorage() *DynamoDBStorage {
 	return &DynamoDBStorage{
-		Table: DefaultTable,
-		locks: make(map[string]*dynamolock.Lock),
-		mutex: &sync.RWMutex{},
+		Table:   DefaultTable,
+		logger:  zap.NewNop(),
+		locks:   newLockSet(),
+		bundles: newBundleSet(),
 	}
 }
 
@@ -71,18 +77,86 @@ func (dbs *DynamoDBStorage) Provision(ctx caddy.Context) error {
 		return errors.New("DynamoDB client has not been initialized")
 	}
 	dbs.Client = redir.Client
+	if dbs.Credentials != nil {
+		dbs.Client, err = redir.NewClient(ctx, dbs.Credentials)
+		if err != nil {
+			return err
+		}
+	}
 
 	repl := caddy.NewReplacer()
 	dbs.Table = repl.ReplaceAll(dbs.Table, DefaultTable)
+	dbs.Prefix = strings.Trim(repl.ReplaceAll(dbs.Prefix, ""), "/")
+	dbs.Index = repl.ReplaceAll(dbs.Index, "")
+	if dbs.Index == "" {
+		dbs.Index = DefaultIndex
+	}
+	dbs.LockOwner = repl.ReplaceAll(dbs.LockOwner, "")
+	if dbs.LockOwner == "" {
+		dbs.LockOwner = DefaultLockOwner()
+	}
+
+	if dbs.LeaseDuration == 0 {
+		dbs.LeaseDuration = caddy.Duration(DefaultLeaseDuration)
+	}
+	if dbs.HeartbeatPeriod == 0 {
+		dbs.HeartbeatPeriod = caddy.Duration(DefaultHeartbeatPeriod)
+	}
+	if dbs.TTLGracePeriod == 0 {
+		dbs.TTLGracePeriod = caddy.Duration(DefaultTTLGracePeriod)
+	}
+	if dbs.HeartbeatPeriod < 0 || dbs.LeaseDuration < 3*dbs.HeartbeatPeriod {
+		return fmt.Errorf("lease_duration %s must be at least three times heartbeat_period %s",
+			time.Duration(dbs.LeaseDuration), time.Duration(dbs.HeartbeatPeriod))
+	}
 
-	dbs.Locker, err = dynamolock.New(dbs.Client, dbs.Table,
+	if err = dbs.ensureTable(ctx); err != nil {
+		return err
+	}
+
+	if dbs.CacheCapacity < 0 {
+		return fmt.Errorf("cache_capacity %d must not be negative", dbs.CacheCapacity)
+	}
+	if dbs.CacheCapacity == 0 {
+		dbs.CacheCapacity = DefaultCacheCapacity
+	}
+	if dbs.CacheTTL > 0 {
+		dbs.cache = newReadCache(time.Duration(dbs.CacheTTL), uint64(dbs.CacheCapacity))
+	}
+
+	dbs.Locker, err = dynamolock.New(dynamo.Primary(dbs.Client), dbs.Table,
 		dynamolock.WithPartitionKeyName("Key"),
-		dynamolock.WithLeaseDuration(LeaseDuration),
+		dynamolock.WithLeaseDuration(time.Duration(dbs.LeaseDuration)),
+		dynamolock.WithHeartbeatPeriod(time.Duration(dbs.HeartbeatPeriod)),
 	)
 	if err != nil {
 		return fmt.Errorf("failed to create DynamoDB lock client: %w", err)
 	}
 
+	if dbs.KeysRaw != nil {
+		keysCtx := ctx.WithValue(credentialsKey{}, dbs.Credentials)
+		module, err := keysCtx.LoadModule(dbs, "KeysRaw")
+		if err != nil {
+			return fmt.Errorf("loading key provider: %w", err)
+		}
+		keys, ok := module.(KeyProvider)
+		if !ok {
+			return fmt.Errorf("unexpected module type: %T", module)
+		}
+		dbs.Keys = keys
+	}
+	if dbs.Reencrypt {
+		if _, err = dbs.ReencryptItems(ctx); err != nil {
+			return fmt.Errorf("failed to reencrypt certificate storage: %w", err)
+		}
+	}
+
+	if dbs.Backfill {
+		if _, err = dbs.BackfillIndex(ctx); err != nil {
+			return fmt.Errorf("failed to backfill certificate index: %w", err)
+		}
+	}
+
 	return nil
 }
 
@@ -97,7 +171,64 @@ func (dbs DynamoDBStorage) Cleanup() error {
 //
 //	storage dynamodb {
 //	    table <table_name>
+//	    prefix <prefix>
+//	    auto_create
+//	    index <index_name>
+//	    lock_owner <owner>
+//	    lease_duration <duration>
+//	    heartbeat_period <duration>
+//	    scan_list
+//	    backfill_index
+//	    encryption <provider> {
+//	        ...
+//	    }
+//	    reencrypt
+//	    disable_compression
+//	    ttl_grace_period <duration>
+//	    cache_ttl <duration>
+//	    cache_capacity <keys>
+//	    aws_profile <name>
+//	    role_arn <arn>
+//	    external_id <id>
+//	    session_name <name>
+//	    web_identity_token_file <path>
+//	    access_key_id <key>
+//	    secret_access_key <secret>
+//	    session_token <token>
 //	}
+//
+// The credential options override the mirage app's credentials.
+//
+// With a prefix, such as {env.STAGE}, keys and locks are stored under it, so
+// environments can share a table without seeing each other's certificates.
+//
+// An existing table must be keyed by Key; one without the index or time to
+// live below is logged. With auto_create, a missing table is created along
+// with them, and time to live is enabled on an existing table.
+//
+// List queries a global secondary index keyed by Root and Key. To add it to an
+// existing table, create the index, then provision once with backfill_index
+// so items stored before it are indexed. Until then scan_list keeps listing
+// with a Scan. The index is eventually consistent, so a key stored moments
+// ago may not be listed yet.
+//
+// With an encryption key provider, contents are encrypted with a data key
+// that the provider wraps, one per item or, with kms, one per cache_ttl. Items stored in plaintext are still read,
+// and reencrypt rewrites them, along with items wrapped by a rotated-out key.
+//
+// Contents are gzip compressed unless disable_compression is set. Values too
+// large for one item are split over several, written in one transaction.
+//
+// Certificate files record when their certificate expires, plus
+// ttl_grace_period, as the table's time to live attribute, so DynamoDB
+// deletes them along with their chunks. Caddy's storage cleaning then finds
+// little left to delete, and still cleans files stored before and OCSP
+// staples.
+//
+// With cache_ttl set, values, their size and whether keys exist are cached
+// for as long, so certificates checked repeatedly, as by on-demand TLS and
+// renewal checks, are not read each time. Writes by other instances are seen
+// once entries expire.
 func (dbs *DynamoDBStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for d.Next() {
 		if d.NextArg() {
@@ -106,6 +237,50 @@ func (dbs *DynamoDBStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 
 		for nesting := d.Nesting(); d.NextBlock(nesting); {
 			configKey := d.Val()
+			switch configKey {
+			case "auto_create":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				dbs.AutoCreate = true
+				continue
+			case "scan_list":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				dbs.ScanList = true
+				continue
+			case "backfill_index":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				dbs.Backfill = true
+				continue
+			case "reencrypt":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				dbs.Reencrypt = true
+				continue
+			case "disable_compression":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				dbs.DisableCompression = true
+				continue
+			case "encryption":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				name := d.Val()
+				unm, err := caddyfile.UnmarshalModule(d, KeyNamespace+"."+name)
+				if err != nil {
+					return err
+				}
+				dbs.KeysRaw = caddyconfig.JSONModuleObject(unm, "provider", name, nil)
+				continue
+			}
+
 			var configVal string
 
 			if !d.Args(&configVal) {
@@ -115,8 +290,51 @@ func (dbs *DynamoDBStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			switch configKey {
 			case "table":
 				dbs.Table = configVal
+			case "prefix":
+				dbs.Prefix = configVal
+			case "index":
+				dbs.Index = configVal
+			case "lock_owner":
+				dbs.LockOwner = configVal
+			case "lease_duration":
+				dur, err := caddy.ParseDuration(configVal)
+				if err != nil {
+					return d.Errf("invalid duration for 'lease_duration': %v", err)
+				}
+				dbs.LeaseDuration = caddy.Duration(dur)
+			case "heartbeat_period":
+				dur, err := caddy.ParseDuration(configVal)
+				if err != nil {
+					return d.Errf("invalid duration for 'heartbeat_period': %v", err)
+				}
+				dbs.HeartbeatPeriod = caddy.Duration(dur)
+			case "ttl_grace_period":
+				dur, err := caddy.ParseDuration(configVal)
+				if err != nil {
+					return d.Errf("invalid duration for 'ttl_grace_period': %v", err)
+				}
+				dbs.TTLGracePeriod = caddy.Duration(dur)
+			case "cache_ttl":
+				dur, err := caddy.ParseDuration(configVal)
+				if err != nil {
+					return d.Errf("invalid duration for 'cache_ttl': %v", err)
+				}
+				dbs.CacheTTL = caddy.Duration(dur)
+			case "cache_capacity":
+				capacity, err := strconv.Atoi(configVal)
+				if err != nil || capacity < 1 {
+					return d.Errf("invalid value for 'cache_capacity': %s", configVal)
+				}
+				dbs.CacheCapacity = capacity
 			default:
-				return d.Errf("unknown parameter '%s' for storage 'dynamodb'", configKey)
+				creds := dbs.Credentials
+				if creds == nil {
+					creds = new(dynamo.Credentials)
+				}
+				if !creds.Set(configKey, configVal) {
+					return d.Errf("unknown parameter '%s' for storage 'dynamodb'", configKey)
+				}
+				dbs.Credentials = creds
 			}
 		}
 	}
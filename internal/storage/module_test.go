@@ -1,12 +1,16 @@
 package storage_test
 
 import (
+	"encoding/json"
 	"testing"
+	"time"
 
 	"cirello.io/dynamolock/v2"
+	"github.com/CruGlobal/mirage-server/internal/app"
+	"github.com/CruGlobal/mirage-server/internal/dynamo"
 	storage2 "github.com/CruGlobal/mirage-server/internal/storage"
 	"github.com/CruGlobal/mirage-server/miragetest"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/stretchr/testify/assert"
@@ -30,7 +34,7 @@ func TestStorage_CaddyModule(t *testing.T) {
 func TestStorage_Provision(t *testing.T) {
 	ctx := miragetest.NewMirageCaddyContext(t, miragetest.TestConfig{
 		Region:   "us-east-1",
-		Endpoint: "http://example.com:8000",
+		Endpoint: miragetest.ClosedEndpoint,
 		Table:    "MirageServerConfigTest",
 		Key:      "Hostname",
 	})
@@ -41,14 +45,129 @@ func TestStorage_Provision(t *testing.T) {
 	require.NoError(t, err)
 	assert.NotNil(t, s.Client)
 	assert.Equal(t, "MirageServerCertificatesTest", s.Table)
+	assert.Equal(t, storage2.DefaultIndex, s.Index)
+	assert.Equal(t, storage2.DefaultLockOwner(), s.LockOwner)
+	assert.Equal(t, caddy.Duration(storage2.DefaultLeaseDuration), s.LeaseDuration)
+	assert.Equal(t, caddy.Duration(storage2.DefaultHeartbeatPeriod), s.HeartbeatPeriod)
+	assert.Equal(t, caddy.Duration(storage2.DefaultTTLGracePeriod), s.TTLGracePeriod)
+	assert.Equal(t, storage2.DefaultCacheCapacity, s.CacheCapacity)
+}
+
+func TestStorage_ProvisionPrefix(t *testing.T) {
+	t.Setenv("STAGE", "stage")
+	ctx := miragetest.NewMirageCaddyContext(t, miragetest.TestConfig{
+		Region:   "us-east-1",
+		Endpoint: miragetest.ClosedEndpoint,
+		Table:    "MirageServerConfigTest",
+		Key:      "Hostname",
+	})
+
+	s := storage2.NewDynamoDBStorage()
+	s.Prefix = "/{env.STAGE}/"
+	require.NoError(t, s.Provision(ctx))
+	assert.Equal(t, "stage", s.Prefix)
+}
+
+func TestStorage_ProvisionLease(t *testing.T) {
+	ctx := miragetest.NewMirageCaddyContext(t, miragetest.TestConfig{
+		Region:   "us-east-1",
+		Endpoint: miragetest.ClosedEndpoint,
+		Table:    "MirageServerConfigTest",
+		Key:      "Hostname",
+	})
+
+	s := storage2.NewDynamoDBStorage()
+	s.LeaseDuration = caddy.Duration(6 * time.Second)
+	s.HeartbeatPeriod = caddy.Duration(2 * time.Second)
+	require.NoError(t, s.Provision(ctx))
+	require.NoError(t, s.Cleanup())
+
+	s = storage2.NewDynamoDBStorage()
+	s.LeaseDuration = caddy.Duration(10 * time.Second)
+	require.ErrorContains(t, s.Provision(ctx), "at least three times heartbeat_period")
+}
+
+func TestStorage_ProvisionCredentials(t *testing.T) {
+	ctx := miragetest.NewMirageCaddyContext(t, miragetest.TestConfig{
+		Region:   "us-east-1",
+		Endpoint: miragetest.ClosedEndpoint,
+		Table:    "MirageServerConfigTest",
+		Key:      "Hostname",
+	})
+	module, err := ctx.App(app.AppName)
+	require.NoError(t, err)
+
+	s := storage2.NewDynamoDBStorage()
+	require.NoError(t, s.Provision(ctx))
+	assert.Same(t, module.(*app.App).Client, s.Client)
+
+	s = storage2.NewDynamoDBStorage()
+	s.Credentials = &dynamo.Credentials{AccessKeyID: "local", SecretAccessKey: "local"}
+	require.NoError(t, s.Provision(ctx))
+	assert.NotSame(t, module.(*app.App).Client, s.Client)
+
+	s = storage2.NewDynamoDBStorage()
+	s.Credentials = &dynamo.Credentials{AccessKeyID: "local"}
+	require.ErrorContains(t, s.Provision(ctx), "access_key_id and secret_access_key must be set together")
+}
+
+func TestStorage_ProvisionEncryption(t *testing.T) {
+	ctx := miragetest.NewMirageCaddyContext(t, miragetest.TestConfig{
+		Region:   "us-east-1",
+		Endpoint: miragetest.ClosedEndpoint,
+		Table:    "MirageServerConfigTest",
+		Key:      "Hostname",
+	})
+
+	s := storage2.NewDynamoDBStorage()
+	s.KeysRaw = json.RawMessage(`{"provider":"file","key_file":"` + writeKeyFile(t) + `"}`)
+	require.NoError(t, s.Provision(ctx))
+	assert.IsType(t, &storage2.FileKeys{}, s.Keys)
+	assert.NotEmpty(t, s.Keys.KeyID())
+
+	// KMS authenticates with the storage's credentials
+	s = storage2.NewDynamoDBStorage()
+	s.Credentials = &dynamo.Credentials{AccessKeyID: "storage", SecretAccessKey: "local"}
+	s.KeysRaw = json.RawMessage(`{"provider":"kms","key_id":"alias/mirage-storage"}`)
+	require.NoError(t, s.Provision(ctx))
+	require.IsType(t, &storage2.KMSKeys{}, s.Keys)
+	kmsKeys := s.Keys.(*storage2.KMSKeys)
+	assert.Equal(t, "us-east-1", kmsKeys.Region)
+	require.IsType(t, &kms.Client{}, kmsKeys.Client)
+	creds, err := kmsKeys.Client.(*kms.Client).Options().Credentials.Retrieve(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, "storage", creds.AccessKeyID)
+
+	s = storage2.NewDynamoDBStorage()
+	s.KeysRaw = json.RawMessage(`{"provider":"file"}`)
+	require.ErrorContains(t, s.Provision(ctx), "key_file is required")
+
+	s = storage2.NewDynamoDBStorage()
+	s.Reencrypt = true
+	require.ErrorIs(t, s.Provision(ctx), storage2.ErrNoKeyProvider)
 }
 
 func TestStorage_UnmarshalCaddyfile(t *testing.T) {
 	testcases := []struct {
-		name      string
-		caddyfile string
-		expected  string
-		expectErr bool
+		name        string
+		caddyfile   string
+		expected    string
+		credentials *dynamo.Credentials
+		prefix      string
+		autoCreate  bool
+		index       string
+		lockOwner   string
+		lease       caddy.Duration
+		heartbeat   caddy.Duration
+		gracePeriod caddy.Duration
+		cacheTTL    caddy.Duration
+		capacity    int
+		scanList    bool
+		backfill    bool
+		keys        []byte
+		reencrypt   bool
+		noCompress  bool
+		expectErr   bool
 	}{
 		{
 			name: "valid1",
@@ -78,6 +197,149 @@ func TestStorage_UnmarshalCaddyfile(t *testing.T) {
 			}`,
 			expectErr: true,
 		},
+		{
+			name: "credentials",
+			caddyfile: `dynamodb {
+				table TestTableName
+				role_arn arn:aws:iam::123456789012:role/certificates
+				external_id mirage
+			}`,
+			expected: "TestTableName",
+			credentials: &dynamo.Credentials{
+				RoleARN:    "arn:aws:iam::123456789012:role/certificates",
+				ExternalID: "mirage",
+			},
+		},
+		{
+			name: "prefix",
+			caddyfile: `dynamodb {
+				table MirageServerCertificates
+				prefix {env.STAGE}
+			}`,
+			expected: "MirageServerCertificates",
+			prefix:   "{env.STAGE}",
+		},
+		{
+			name: "auto_create",
+			caddyfile: `dynamodb {
+				table TestTableName
+				auto_create
+			}`,
+			expected:   "TestTableName",
+			autoCreate: true,
+		},
+		{
+			name: "index",
+			caddyfile: `dynamodb {
+				table TestTableName
+				index TestIndex
+				scan_list
+				backfill_index
+			}`,
+			expected: "TestTableName",
+			index:    "TestIndex",
+			scanList: true,
+			backfill: true,
+		},
+		{
+			name: "encryption",
+			caddyfile: `dynamodb {
+				table TestTableName
+				encryption file {
+					key_file /etc/mirage/storage.key
+				}
+				reencrypt
+			}`,
+			expected:  "TestTableName",
+			keys:      []byte(`{"key_file":"/etc/mirage/storage.key","provider":"file"}`),
+			reencrypt: true,
+		},
+		{
+			name: "disable_compression",
+			caddyfile: `dynamodb {
+				disable_compression
+			}`,
+			expected:   storage2.DefaultTable,
+			noCompress: true,
+		},
+		{
+			name: "unknown encryption provider",
+			caddyfile: `dynamodb {
+				encryption vault
+			}`,
+			expectErr: true,
+		},
+		{
+			name: "encryption without provider",
+			caddyfile: `dynamodb {
+				encryption
+			}`,
+			expectErr: true,
+		},
+		{
+			name: "lock_owner",
+			caddyfile: `dynamodb {
+				lock_owner {env.TASK_ID}
+			}`,
+			expected:  storage2.DefaultTable,
+			lockOwner: "{env.TASK_ID}",
+		},
+		{
+			name: "lease",
+			caddyfile: `dynamodb {
+				lease_duration 30s
+				heartbeat_period 5s
+			}`,
+			expected:  storage2.DefaultTable,
+			lease:     caddy.Duration(30 * time.Second),
+			heartbeat: caddy.Duration(5 * time.Second),
+		},
+		{
+			name: "invalid lease",
+			caddyfile: `dynamodb {
+				lease_duration soon
+			}`,
+			expectErr: true,
+		},
+		{
+			name: "ttl",
+			caddyfile: `dynamodb {
+				ttl_grace_period 7d
+			}`,
+			expected:    storage2.DefaultTable,
+			gracePeriod: caddy.Duration(7 * 24 * time.Hour),
+		},
+		{
+			name: "invalid ttl_grace_period",
+			caddyfile: `dynamodb {
+				ttl_grace_period weekly
+			}`,
+			expectErr: true,
+		},
+		{
+			name: "cache",
+			caddyfile: `dynamodb {
+				cache_ttl 1m
+				cache_capacity 500
+			}`,
+			expected: storage2.DefaultTable,
+			cacheTTL: caddy.Duration(time.Minute),
+			capacity: 500,
+		},
+		{
+			name: "invalid cache_capacity",
+			caddyfile: `dynamodb {
+				cache_capacity 0
+			}`,
+			expectErr: true,
+		},
+		{
+			name: "scan_list argument",
+			caddyfile: `dynamodb {
+				scan_list true
+			}`,
+			expectErr: true,
+		},
 		{
 			name: "invalid2",
 			caddyfile: `dynamodb {
@@ -101,9 +363,28 @@ func TestStorage_UnmarshalCaddyfile(t *testing.T) {
 				return
 			}
 			require.NoError(t, err)
-			require.IsType(t, &dynamodb.Client{}, s.Client)
+			require.Nil(t, s.Client, "the client is shared by the mirage app during Provision")
 			require.IsType(t, &dynamolock.Client{}, s.Locker)
 			require.Equal(t, tc.expected, s.Table)
+			require.Equal(t, tc.credentials, s.Credentials)
+			require.Equal(t, tc.prefix, s.Prefix)
+			require.Equal(t, tc.autoCreate, s.AutoCreate)
+			require.Equal(t, tc.index, s.Index)
+			require.Equal(t, tc.lockOwner, s.LockOwner)
+			require.Equal(t, tc.lease, s.LeaseDuration)
+			require.Equal(t, tc.heartbeat, s.HeartbeatPeriod)
+			require.Equal(t, tc.gracePeriod, s.TTLGracePeriod)
+			require.Equal(t, tc.cacheTTL, s.CacheTTL)
+			require.Equal(t, tc.capacity, s.CacheCapacity)
+			require.Equal(t, tc.scanList, s.ScanList)
+			require.Equal(t, tc.backfill, s.Backfill)
+			if tc.keys != nil {
+				require.JSONEq(t, string(tc.keys), string(s.KeysRaw))
+			} else {
+				require.Nil(t, s.KeysRaw)
+			}
+			require.Equal(t, tc.reencrypt, s.Reencrypt)
+			require.Equal(t, tc.noCompress, s.DisableCompression)
 		})
 	}
 }
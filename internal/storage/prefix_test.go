@@ -0,0 +1,84 @@
+package storage_test
+
+import (
+	"io/fs"
+	"path"
+
+	"github.com/CruGlobal/mirage-server/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newPrefixedStorage provisions a storage instance using the same table
+// under prefix.
+func (ts *StorageTestSuite) newPrefixedStorage(prefix string) *storage.DynamoDBStorage {
+	dbs := storage.NewDynamoDBStorage()
+	dbs.Table = ts.dbs.Table
+	dbs.Prefix = prefix
+	ts.Require().NoError(ts.provision(dbs))
+	return dbs
+}
+
+func (ts *StorageTestSuite) TestStorage_PrefixIsolation() {
+	t := ts.T()
+	ctx := t.Context()
+	stage, prod := ts.newPrefixedStorage("stage"), ts.newPrefixedStorage("prod")
+	dir := path.Join("certificates", "acme-v02.api.example.com", "example.com")
+	key := path.Join(dir, "example.com.crt")
+
+	require.NoError(t, stage.Store(ctx, key, []byte("stage")))
+	assert.False(t, prod.Exists(ctx, key))
+	_, err := prod.Load(ctx, key)
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = prod.Stat(ctx, key)
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = prod.List(ctx, "certificates", true)
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	require.NoError(t, prod.Store(ctx, key, []byte("prod")))
+	for dbs, value := range map[*storage.DynamoDBStorage]string{stage: "stage", prod: "prod"} {
+		content, err := dbs.Load(ctx, key)
+		require.NoError(t, err)
+		assert.Equal(t, []byte(value), content)
+
+		// Keys are listed and described without the prefix
+		keys, err := dbs.List(ctx, dir, false)
+		require.NoError(t, err)
+		assert.Equal(t, []string{key}, keys)
+		info, err := dbs.Stat(ctx, key)
+		require.NoError(t, err)
+		assert.Equal(t, key, info.Key)
+	}
+
+	require.NoError(t, stage.Delete(ctx, key))
+	assert.False(t, stage.Exists(ctx, key))
+	assert.True(t, prod.Exists(ctx, key))
+}
+
+func (ts *StorageTestSuite) TestStorage_PrefixLocks() {
+	t := ts.T()
+	ctx := t.Context()
+	stage, prod := ts.newPrefixedStorage("stage"), ts.newPrefixedStorage("prod")
+	key := "issue_cert_example.com"
+
+	// The same lock name is a different lock in each environment
+	locked, err := stage.TryLock(ctx, key)
+	require.NoError(t, err)
+	assert.True(t, locked)
+	locked, err = prod.TryLock(ctx, key)
+	require.NoError(t, err)
+	assert.True(t, locked)
+
+	for _, dbs := range []*storage.DynamoDBStorage{stage, prod} {
+		locks, err := dbs.Locks(ctx)
+		require.NoError(t, err)
+		require.Len(t, locks, 1)
+		assert.Equal(t, key, locks[0].Name)
+	}
+
+	require.NoError(t, stage.Unlock(ctx, key))
+	locks, err := prod.Locks(ctx)
+	require.NoError(t, err)
+	assert.Len(t, locks, 1)
+	require.NoError(t, prod.Unlock(ctx, key))
+}
@@ -1,12 +1,14 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"io/fs"
 	"strings"
 	"time"
 
+	"github.com/CruGlobal/mirage-server/internal/metrics"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
@@ -18,81 +20,217 @@ var (
 	_ certmagic.Storage = (*DynamoDBStorage)(nil)
 )
 
-// Store stores the value at key.
+// Store stores the value at key. The private key, certificate and metadata
+// of a certificate certmagic stores while holding its issuance lock are also
+// written together once the metadata is stored, see storeBundled.
 func (dbs DynamoDBStorage) Store(ctx context.Context, key string, value []byte) error {
 	if key == "" {
 		return errors.New("key cannot be empty")
 	}
+	if dbs.bundling(key) {
+		return dbs.storeBundled(ctx, key, value)
+	}
+	_, err := dbs.store(ctx, key, value)
+	return err
+}
+
+// store writes the value at key whatever its version, and returns the
+// version stored.
+func (dbs DynamoDBStorage) store(ctx context.Context, key string, value []byte) (int64, error) {
+	defer dbs.cache.invalidate(key)
+	item, err := dbs.newItem(ctx, key, value, 0)
+	if err != nil {
+		return 0, err
+	}
+	if err = dbs.put(ctx, item, dynamodb.PutItemInput{}); err != nil {
+		return 0, err
+	}
+	return item.Version, dbs.expireSite(ctx, item)
+}
+
+// newItem prepares value to be stored at key as a version following previous.
+// Certificate files expire with their certificate, see TTLAttribute.
+func (dbs DynamoDBStorage) newItem(ctx context.Context, key string, value []byte, previous int64) (*Item, error) {
+	now := time.Now()
 	item := &Item{
-		Key:      key,
+		Key:      dbs.storageKey(key),
+		Root:     rootOf(dbs.storageKey(key)),
 		Contents: value,
-		Modified: aws.Time(time.Now()),
+		Modified: aws.Time(now),
 		Size:     int64(len(value)),
+		Version:  max(now.UnixNano(), previous+1),
+		Expires:  dbs.certificateExpiry(key, value),
 	}
-	_, err := dbs.Client.PutItem(ctx, &dynamodb.PutItemInput{
-		TableName: aws.String(dbs.Table),
-		Item:      item.Item(),
-	})
-	return err
+	if item.Expires == 0 {
+		var err error
+		if item.Expires, err = dbs.siteExpiry(ctx, key); err != nil {
+			return nil, err
+		}
+	}
+	if err := dbs.compress(item); err != nil {
+		return nil, err
+	}
+	if err := dbs.seal(ctx, item); err != nil {
+		return nil, err
+	}
+	return item, nil
 }
 
 // Load retrieves the value at key.
 func (dbs DynamoDBStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	if entry, ok := dbs.cache.get(metrics.StorageLoad, key); ok {
+		if entry.missing {
+			return nil, fs.ErrNotExist
+		}
+		return bytes.Clone(entry.contents), nil
+	}
+	value, _, err := dbs.load(ctx, key)
+	return value, err
+}
+
+// LoadVersion retrieves the value at key along with its version. It is always
+// read from the primary table, as the version is meant for a write that
+// follows, see StoreVersion.
+func (dbs DynamoDBStorage) LoadVersion(ctx context.Context, key string) ([]byte, int64, error) {
+	return dbs.onPrimary().load(ctx, key)
+}
+
+// load reads the value at key and its version from the table.
+func (dbs DynamoDBStorage) load(ctx context.Context, key string) ([]byte, int64, error) {
+	generation := dbs.cache.start()
+	item, err := dbs.getItem(ctx, key, generation)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err = dbs.assemble(ctx, item); err != nil {
+		return nil, 0, err
+	}
+	if err = dbs.open(ctx, item); err != nil {
+		return nil, 0, err
+	}
+	if err = decompress(item); err != nil {
+		return nil, 0, err
+	}
+	dbs.cache.set(generation, key, cacheEntry{
+		info:     keyInfo(key, item),
+		contents: bytes.Clone(item.Contents),
+		loaded:   true,
+		reads:    max(item.Chunks, 1),
+	})
+	return item.Contents, item.Version, nil
+}
+
+// getItem reads the item at key, caching that it is missing if the read
+// started at generation.
+func (dbs DynamoDBStorage) getItem(ctx context.Context, key string, generation uint64) (*Item, error) {
 	output, err := dbs.Client.GetItem(ctx, &dynamodb.GetItemInput{
 		TableName:      &dbs.Table,
 		ConsistentRead: aws.Bool(true),
 		Key: map[string]types.AttributeValue{
-			"Key": &types.AttributeValueMemberS{Value: key},
+			"Key": &types.AttributeValueMemberS{Value: dbs.storageKey(key)},
 		},
 	})
 	if err != nil {
 		return nil, err
 	}
 	if len(output.Item) == 0 {
+		dbs.cache.set(generation, key, cacheEntry{missing: true})
 		return nil, fs.ErrNotExist
 	}
 	var item Item
 	if err = item.Load(output.Item); err != nil {
 		return nil, err
 	}
-	return item.Contents, nil
+	return &item, nil
 }
 
-// Delete deletes the named key.
+// Delete deletes the named key, along with its chunks.
 func (dbs DynamoDBStorage) Delete(ctx context.Context, key string) error {
-	_, err := dbs.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+	dbs.bundles.discard(key)
+	defer dbs.cache.invalidate(key)
+	output, err := dbs.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
 		TableName: &dbs.Table,
 		Key: map[string]types.AttributeValue{
-			"Key": &types.AttributeValueMemberS{Value: key},
+			"Key": &types.AttributeValueMemberS{Value: dbs.storageKey(key)},
 		},
-		ReturnValues: types.ReturnValueNone,
+		ReturnValues: types.ReturnValueAllOld,
 	})
 	if err != nil {
 		return err
 	}
+	dbs.deleteChunks(ctx, output.Attributes)
 	return nil
 }
 
 // Exists returns true if the key exists.
 func (dbs DynamoDBStorage) Exists(ctx context.Context, key string) bool {
-	output, err := dbs.Client.GetItem(ctx, &dynamodb.GetItemInput{
-		TableName:      &dbs.Table,
-		ConsistentRead: aws.Bool(true),
-		Key: map[string]types.AttributeValue{
-			"Key": &types.AttributeValueMemberS{Value: key},
+	if entry, ok := dbs.cache.get(metrics.StorageExists, key); ok {
+		return !entry.missing
+	}
+	_, err := dbs.stat(ctx, key)
+	return err == nil
+}
+
+// List returns all keys in the given path. Keys are queried from the index
+// by their root segment, so only the path's own subtree is read.
+//
+// The index is a global secondary index, which DynamoDB updates
+// asynchronously: a key stored or deleted moments ago may be missing from
+// or still in the list. Callers that need to see their own writes should use
+// ListConsistent, or check the keys returned with Exists or Load.
+func (dbs DynamoDBStorage) List(ctx context.Context, path string, recursive bool) ([]string, error) {
+	if dbs.ScanList {
+		return dbs.scanList(ctx, path, recursive)
+	}
+
+	if rootOf(path) == "" {
+		return nil, fs.ErrNotExist
+	}
+	root := rootOf(dbs.storageKey(path))
+	paginator := dynamodb.NewQueryPaginator(dbs.Client, &dynamodb.QueryInput{
+		TableName:                &dbs.Table,
+		IndexName:                &dbs.Index,
+		ExpressionAttributeNames: map[string]string{"#root": "Root", "#key": "Key"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":root": &types.AttributeValueMemberS{Value: root},
+			":key":  &types.AttributeValueMemberS{Value: dbs.storageKey(path) + "/"},
 		},
+		KeyConditionExpression: aws.String("#root = :root AND begins_with(#key, :key)"),
 	})
-	return err == nil && len(output.Item) > 0
+
+	var matchingKeys []string
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := dbs.listKeys(output.Items, path, recursive)
+		if err != nil {
+			return nil, err
+		}
+		matchingKeys = append(matchingKeys, keys...)
+	}
+
+	if len(matchingKeys) == 0 {
+		return nil, fs.ErrNotExist
+	}
+	return matchingKeys, nil
 }
 
-// List returns all keys in the given path.
-func (dbs DynamoDBStorage) List(ctx context.Context, path string, recursive bool) ([]string, error) {
+// ListConsistent returns all keys in the given path like List, but reflects
+// every write that succeeded before it, reading the whole table to do so.
+func (dbs DynamoDBStorage) ListConsistent(ctx context.Context, path string, recursive bool) ([]string, error) {
+	return dbs.scanList(ctx, path, recursive)
+}
+
+// scanList lists keys with a Scan over the whole table.
+func (dbs DynamoDBStorage) scanList(ctx context.Context, path string, recursive bool) ([]string, error) {
 	input := &dynamodb.ScanInput{
 		TableName:                &dbs.Table,
 		ConsistentRead:           aws.Bool(true),
 		ExpressionAttributeNames: map[string]string{"#key": "Key"},
 		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":key": &types.AttributeValueMemberS{Value: path + "/"},
+			":key": &types.AttributeValueMemberS{Value: dbs.storageKey(path) + "/"},
 		},
 		FilterExpression: aws.String("begins_with(#key, :key)"),
 	}
@@ -105,25 +243,11 @@ func (dbs DynamoDBStorage) List(ctx context.Context, path string, recursive bool
 		if err != nil {
 			return nil, err
 		}
-		for _, i := range output.Items {
-			var item Item
-			if err = item.Load(i); err != nil {
-				return nil, err
-			}
-			if !recursive {
-				// these two paths go through foo:
-				// foo/cert/key
-				// foo/cert/chain
-				//
-				// So List(prefix: "foo", recursive: false) would return:
-				// foo/cert
-				name := strings.TrimPrefix(item.Key, path+"/")
-				if strings.Contains(name, "/") {
-					continue
-				}
-			}
-			matchingKeys = append(matchingKeys, item.Key)
+		keys, err := dbs.listKeys(output.Items, path, recursive)
+		if err != nil {
+			return nil, err
 		}
+		matchingKeys = append(matchingKeys, keys...)
 	}
 
 	if len(matchingKeys) == 0 {
@@ -132,29 +256,90 @@ func (dbs DynamoDBStorage) List(ctx context.Context, path string, recursive bool
 	return matchingKeys, nil
 }
 
-// Stat returns information about key.
-func (dbs DynamoDBStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
-	output, err := dbs.Client.GetItem(ctx, &dynamodb.GetItemInput{
-		TableName:      &dbs.Table,
-		ConsistentRead: aws.Bool(true),
-		Key: map[string]types.AttributeValue{
-			"Key": &types.AttributeValueMemberS{Value: key},
-		},
-	})
-	if err != nil {
-		return certmagic.KeyInfo{}, err
+// listKeys returns the keys of items under path, leaving out those in
+// subdirectories unless recursive.
+func (dbs DynamoDBStorage) listKeys(items []map[string]types.AttributeValue, path string, recursive bool) ([]string, error) {
+	var keys []string
+	for _, i := range items {
+		var item Item
+		if err := item.Load(i); err != nil {
+			return nil, err
+		}
+		item.Key = dbs.certmagicKey(item.Key)
+		if !recursive {
+			// these two paths go through foo:
+			// foo/cert/key
+			// foo/cert/chain
+			//
+			// So List(prefix: "foo", recursive: false) would return:
+			// foo/cert
+			name := strings.TrimPrefix(item.Key, path+"/")
+			if strings.Contains(name, "/") {
+				continue
+			}
+		}
+		keys = append(keys, item.Key)
 	}
-	if len(output.Item) == 0 {
-		return certmagic.KeyInfo{}, fs.ErrNotExist
+	return keys, nil
+}
+
+// Stat returns information about key. Its size is that of the value as
+// stored by the caller, before compression or encryption.
+func (dbs DynamoDBStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	if entry, ok := dbs.cache.get(metrics.StorageStat, key); ok {
+		if entry.missing {
+			return certmagic.KeyInfo{}, fs.ErrNotExist
+		}
+		return entry.info, nil
 	}
-	var item Item
-	if err = item.Load(output.Item); err != nil {
+	return dbs.stat(ctx, key)
+}
+
+// stat reads the information Stat returns about key.
+func (dbs DynamoDBStorage) stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	generation := dbs.cache.start()
+	item, err := dbs.getItem(ctx, key, generation)
+	if err != nil {
 		return certmagic.KeyInfo{}, err
 	}
+	info := keyInfo(key, item)
+	dbs.cache.set(generation, key, cacheEntry{info: info})
+	return info, nil
+}
+
+// keyInfo describes the item stored at key.
+func keyInfo(key string, item *Item) certmagic.KeyInfo {
 	return certmagic.KeyInfo{
-		Key:        item.Key,
+		Key:        key,
 		Modified:   *item.Modified,
 		Size:       item.Size,
 		IsTerminal: true,
-	}, nil
+	}
+}
+
+// storageKey returns the item key of a certmagic key, within Prefix.
+func (dbs DynamoDBStorage) storageKey(key string) string {
+	if dbs.Prefix == "" {
+		return key
+	}
+	return dbs.Prefix + "/" + key
+}
+
+// certmagicKey returns the certmagic key of an item key within Prefix.
+func (dbs DynamoDBStorage) certmagicKey(key string) string {
+	return strings.TrimPrefix(key, dbs.storageKey(""))
+}
+
+// scanFilter returns the filter of scans for the items of certmagic keys
+// within Prefix, leaving out locks and chunks, adding the names and values
+// it uses.
+func (dbs DynamoDBStorage) scanFilter(names map[string]string, values map[string]types.AttributeValue) string {
+	names["#key"] = "Key"
+	if dbs.Prefix != "" {
+		values[":prefix"] = &types.AttributeValueMemberS{Value: dbs.storageKey("")}
+		return "begins_with(#key, :prefix)"
+	}
+	values[":lock"] = &types.AttributeValueMemberS{Value: lockPrefix}
+	values[":chunk"] = &types.AttributeValueMemberS{Value: chunkPrefix}
+	return "NOT begins_with(#key, :lock) AND NOT begins_with(#key, :chunk)"
 }
@@ -2,6 +2,7 @@ package storage_test
 
 import (
 	"bytes"
+	"fmt"
 	"path"
 	"testing"
 
@@ -48,7 +49,8 @@ func (ts *StorageTestSuite) TearDownSuite() {
 
 // SetupTest creates the table before each test.
 func (ts *StorageTestSuite) SetupTest() {
-	miragetest.CreateDynamoDBTable(ts.T(), ts.dbs.Client, ts.dbs.Table, "Key")
+	_, err := ts.dbs.Client.CreateTable(ts.T().Context(), storage.CreateTableInput(ts.dbs.Table, ts.dbs.Index))
+	ts.Require().NoError(err)
 }
 
 // TearDownTest deletes the table after each test.
@@ -56,6 +58,19 @@ func (ts *StorageTestSuite) TearDownTest() {
 	miragetest.DeleteDynamoDBTable(ts.T(), ts.dbs.Client, ts.dbs.Table)
 }
 
+// provision provisions another storage instance against the suite's
+// DynamoDB container.
+func (ts *StorageTestSuite) provision(dbs *storage.DynamoDBStorage) error {
+	endpoint, err := ts.ddbc.ConnectionString(ts.T().Context())
+	ts.Require().NoError(err)
+	return dbs.Provision(miragetest.NewMirageCaddyContext(ts.T(), miragetest.TestConfig{
+		Region:   "us-east-1",
+		Endpoint: fmt.Sprintf("http://%s", endpoint),
+		Table:    "MirageServerConfigTest",
+		Key:      "Hostname",
+	}))
+}
+
 func TestStorageTestSuite(t *testing.T) {
 	suite.Run(t, new(StorageTestSuite))
 }
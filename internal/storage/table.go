@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/CruGlobal/mirage-server/internal/dynamo"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"go.uber.org/zap"
+)
+
+// DefaultIndex is the global secondary index List queries. It is keyed by
+// Root and Key and only needs to project the keys.
+const DefaultIndex = "RootKeyIndex"
+
+// CreateTableInput describes a certificate table with the index List uses.
+func CreateTableInput(table string, index string) *dynamodb.CreateTableInput {
+	return &dynamodb.CreateTableInput{
+		TableName:   aws.String(table),
+		BillingMode: types.BillingModePayPerRequest,
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("Key"), KeyType: types.KeyTypeHash},
+		},
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("Key"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("Root"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String(index),
+				KeySchema: []types.KeySchemaElement{
+					{AttributeName: aws.String("Root"), KeyType: types.KeyTypeHash},
+					{AttributeName: aws.String("Key"), KeyType: types.KeyTypeRange},
+				},
+				Projection: &types.Projection{ProjectionType: types.ProjectionTypeKeysOnly},
+			},
+		},
+	}
+}
+
+// ensureTable checks that the table is keyed by Key, creating it first with
+// CreateTableInput and TimeToLiveInput if AutoCreate is set. Only a table
+// keyed otherwise fails provisioning. A missing or unreachable table, or one
+// without the index List queries or time to live, is logged; AutoCreate
+// enables time to live on an existing table.
+func (dbs DynamoDBStorage) ensureTable(ctx context.Context) error {
+	input := CreateTableInput(dbs.Table, dbs.Index)
+	table, err := dynamo.CheckTable(ctx, dbs.Client, input)
+	switch {
+	case err == nil:
+	case errors.Is(err, dynamo.ErrKeySchema):
+		return err
+	case dynamo.IsTableNotFound(err) && dbs.AutoCreate:
+		return dbs.createTable(ctx, input)
+	case dynamo.IsTableNotFound(err):
+		dbs.logger.Warn("certificate table does not exist, set auto_create to create it", zap.String("table", dbs.Table))
+		return nil
+	default:
+		dbs.logger.Warn("unable to check certificate table", zap.String("table", dbs.Table), zap.Error(err))
+		return nil
+	}
+
+	if !dbs.ScanList && !slices.ContainsFunc(table.GlobalSecondaryIndexes, func(index types.GlobalSecondaryIndexDescription) bool {
+		return aws.ToString(index.IndexName) == dbs.Index
+	}) {
+		dbs.logger.Warn("certificate table has no index for List, create it or set scan_list",
+			zap.String("table", dbs.Table),
+			zap.String("index", dbs.Index),
+		)
+	}
+	return dbs.checkTimeToLive(ctx)
+}
+
+// createTable creates the table with input and enables time to live on it.
+func (dbs DynamoDBStorage) createTable(ctx context.Context, input *dynamodb.CreateTableInput) error {
+	created, err := dynamo.EnsureTable(ctx, dbs.Client, input)
+	if err != nil || !created {
+		return err
+	}
+	if _, err = dbs.Client.UpdateTimeToLive(ctx, TimeToLiveInput(dbs.Table)); err != nil {
+		return fmt.Errorf("enabling time to live on %s: %w", dbs.Table, err)
+	}
+	dbs.logger.Info("created certificate table", zap.String("table", dbs.Table), zap.String("index", dbs.Index))
+	return nil
+}
+
+// checkTimeToLive warns unless time to live is enabled on TTLAttribute,
+// enabling it if AutoCreate is set.
+func (dbs DynamoDBStorage) checkTimeToLive(ctx context.Context) error {
+	output, err := dbs.Client.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{TableName: &dbs.Table})
+	if err != nil {
+		dbs.logger.Warn("unable to check time to live of certificate table", zap.String("table", dbs.Table), zap.Error(err))
+		return nil
+	}
+	if ttl := output.TimeToLiveDescription; ttl != nil && aws.ToString(ttl.AttributeName) == TTLAttribute &&
+		(ttl.TimeToLiveStatus == types.TimeToLiveStatusEnabled || ttl.TimeToLiveStatus == types.TimeToLiveStatusEnabling) {
+		return nil
+	}
+	if !dbs.AutoCreate {
+		dbs.logger.Warn("time to live is not enabled on certificate table, so DynamoDB keeps expired certificates",
+			zap.String("table", dbs.Table),
+			zap.String("attribute", TTLAttribute),
+		)
+		return nil
+	}
+	if _, err = dbs.Client.UpdateTimeToLive(ctx, TimeToLiveInput(dbs.Table)); err != nil {
+		return fmt.Errorf("enabling time to live on %s: %w", dbs.Table, err)
+	}
+	dbs.logger.Info("enabled time to live on certificate table", zap.String("table", dbs.Table))
+	return nil
+}
+
+// BackfillIndex sets Root on items stored before List used the index, so they
+// are listed again. Only items within Prefix are updated; lock and chunk
+// items are skipped. It returns the number of items updated.
+func (dbs DynamoDBStorage) BackfillIndex(ctx context.Context) (int, error) {
+	dbs = dbs.onPrimary()
+	names := map[string]string{"#root": "Root"}
+	values := map[string]types.AttributeValue{}
+	filter := dbs.scanFilter(names, values)
+	paginator := dynamodb.NewScanPaginator(dbs.Client, &dynamodb.ScanInput{
+		TableName:                 &dbs.Table,
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		FilterExpression:          aws.String("attribute_not_exists(#root) AND " + filter),
+		ProjectionExpression:      aws.String("#key"),
+	})
+
+	updated := 0
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return updated, err
+		}
+		for _, i := range output.Items {
+			var item Item
+			if err = item.Load(i); err != nil {
+				return updated, err
+			}
+			_, err = dbs.Client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+				TableName: &dbs.Table,
+				Key: map[string]types.AttributeValue{
+					"Key": &types.AttributeValueMemberS{Value: item.Key},
+				},
+				ExpressionAttributeNames: map[string]string{"#key": "Key", "#root": "Root"},
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":root": &types.AttributeValueMemberS{Value: rootOf(item.Key)},
+				},
+				// Skip items deleted since the scan
+				ConditionExpression: aws.String("attribute_exists(#key)"),
+				UpdateExpression:    aws.String("SET #root = :root"),
+			})
+			var conditionErr *types.ConditionalCheckFailedException
+			if errors.As(err, &conditionErr) {
+				continue
+			}
+			if err != nil {
+				return updated, fmt.Errorf("backfilling %s: %w", item.Key, err)
+			}
+			updated++
+		}
+	}
+	dbs.logger.Info("backfilled certificate index", zap.String("table", dbs.Table), zap.Int("items", updated))
+	return updated, nil
+}
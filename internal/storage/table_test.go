@@ -0,0 +1,150 @@
+package storage_test
+
+import (
+	"bytes"
+	"path"
+	"testing"
+
+	"github.com/CruGlobal/mirage-server/internal/dynamo"
+	"github.com/CruGlobal/mirage-server/internal/storage"
+	"github.com/CruGlobal/mirage-server/miragetest"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateTableInput(t *testing.T) {
+	input := storage.CreateTableInput("Certificates", storage.DefaultIndex)
+	assert.Equal(t, "Certificates", aws.ToString(input.TableName))
+	require.Len(t, input.GlobalSecondaryIndexes, 1)
+
+	index := input.GlobalSecondaryIndexes[0]
+	assert.Equal(t, storage.DefaultIndex, aws.ToString(index.IndexName))
+	assert.Equal(t, []types.KeySchemaElement{
+		{AttributeName: aws.String("Root"), KeyType: types.KeyTypeHash},
+		{AttributeName: aws.String("Key"), KeyType: types.KeyTypeRange},
+	}, index.KeySchema)
+}
+
+func (ts *StorageTestSuite) TestStorage_BackfillIndex() {
+	t := ts.T()
+	legacy := path.Join("certificates", "acme-v02.api.example.com", "example.com", "example.com.crt")
+	current := path.Join("certificates", "acme-v02.api.example.com", "example.org", "example.org.crt")
+	dir := path.Join("certificates", "acme-v02.api.example.com")
+
+	// Items stored before the index have no Root and are not listed
+	_, err := ts.dbs.Client.PutItem(t.Context(), &dynamodb.PutItemInput{
+		TableName: aws.String(ts.dbs.Table),
+		Item:      (&storage.Item{Key: legacy, Contents: []byte("legacy")}).Item(),
+	})
+	require.NoError(t, err)
+	require.NoError(t, ts.dbs.Store(t.Context(), current, bytes.Repeat([]byte("a"), 16)))
+	require.NoError(t, ts.dbs.Lock(t.Context(), "backfill"))
+	defer ts.dbs.Unlock(t.Context(), "backfill") //nolint:errcheck // test cleanup
+
+	keys, err := ts.dbs.List(t.Context(), dir, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{current}, keys)
+
+	updated, err := ts.dbs.BackfillIndex(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, 1, updated, "only the legacy item is updated, not locks")
+
+	keys, err = ts.dbs.List(t.Context(), dir, true)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{legacy, current}, keys)
+
+	updated, err = ts.dbs.BackfillIndex(t.Context())
+	require.NoError(t, err)
+	assert.Zero(t, updated)
+}
+
+func (ts *StorageTestSuite) TestStorage_ScanList() {
+	t := ts.T()
+	key := path.Join("acme", "acme-v02.api.example.com", "sites", "example.com", "example.com.crt")
+	_, err := ts.dbs.Client.PutItem(t.Context(), &dynamodb.PutItemInput{
+		TableName: aws.String(ts.dbs.Table),
+		Item:      (&storage.Item{Key: key, Contents: []byte("legacy")}).Item(),
+	})
+	require.NoError(t, err)
+
+	dbs := *ts.dbs
+	dbs.ScanList = true
+	keys, err := dbs.List(t.Context(), path.Join("acme", "acme-v02.api.example.com", "sites"), true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{key}, keys)
+
+	// ListConsistent reads the table rather than the index too
+	keys, err = ts.dbs.ListConsistent(t.Context(), path.Join("acme", "acme-v02.api.example.com", "sites"), true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{key}, keys)
+}
+
+func (ts *StorageTestSuite) TestStorage_AutoCreate() {
+	t := ts.T()
+	ctx := t.Context()
+	dbs := storage.NewDynamoDBStorage()
+	dbs.Table = "MirageServerCertificatesCreated"
+	dbs.AutoCreate = true
+	require.NoError(t, ts.provision(dbs))
+	defer miragetest.DeleteDynamoDBTable(t, ts.dbs.Client, dbs.Table)
+
+	output, err := ts.dbs.Client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: &dbs.Table})
+	require.NoError(t, err)
+	require.Len(t, output.Table.GlobalSecondaryIndexes, 1)
+	assert.Equal(t, storage.DefaultIndex, aws.ToString(output.Table.GlobalSecondaryIndexes[0].IndexName))
+	key := path.Join("certificates", "acme-v02.api.example.com", "example.com", "example.com.json")
+	require.NoError(t, dbs.Store(ctx, key, []byte("{}")))
+
+	// Provisioning again finds the table
+	again := storage.NewDynamoDBStorage()
+	again.Table = dbs.Table
+	again.AutoCreate = true
+	require.NoError(t, ts.provision(again))
+	assert.True(t, again.Exists(ctx, key))
+}
+
+func (ts *StorageTestSuite) TestStorage_AutoCreateKeySchema() {
+	t := ts.T()
+	table := "MirageServerCertificatesMisnamed"
+	miragetest.CreateDynamoDBTable(t, ts.dbs.Client, table, "Hostname")
+	defer miragetest.DeleteDynamoDBTable(t, ts.dbs.Client, table)
+
+	dbs := storage.NewDynamoDBStorage()
+	dbs.Table = table
+	dbs.AutoCreate = true
+	require.ErrorIs(t, ts.provision(dbs), dynamo.ErrKeySchema)
+
+	// The key schema is checked without auto_create too
+	dbs = storage.NewDynamoDBStorage()
+	dbs.Table = table
+	require.ErrorIs(t, ts.provision(dbs), dynamo.ErrKeySchema)
+}
+
+func (ts *StorageTestSuite) TestStorage_AutoCreateTimeToLive() {
+	t := ts.T()
+	ctx := t.Context()
+	table := "MirageServerCertificatesWithoutTTL"
+	_, err := ts.dbs.Client.CreateTable(ctx, storage.CreateTableInput(table, storage.DefaultIndex))
+	require.NoError(t, err)
+	defer miragetest.DeleteDynamoDBTable(t, ts.dbs.Client, table)
+
+	// Without auto_create an existing table is left as it is
+	dbs := storage.NewDynamoDBStorage()
+	dbs.Table = table
+	require.NoError(t, ts.provision(dbs))
+	output, err := ts.dbs.Client.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{TableName: &table})
+	require.NoError(t, err)
+	assert.Equal(t, types.TimeToLiveStatusDisabled, output.TimeToLiveDescription.TimeToLiveStatus)
+
+	// With it, time to live is enabled
+	dbs = storage.NewDynamoDBStorage()
+	dbs.Table = table
+	dbs.AutoCreate = true
+	require.NoError(t, ts.provision(dbs))
+	output, err = ts.dbs.Client.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{TableName: &table})
+	require.NoError(t, err)
+	assert.Equal(t, storage.TTLAttribute, aws.ToString(output.TimeToLiveDescription.AttributeName))
+}
@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// maxTransactItems is the most items DynamoDB writes in one transaction.
+const maxTransactItems = 100
+
+// ErrConflict is matched by the errors of writes rejected because the key was
+// written since the version they expected, see ConflictError.
+var ErrConflict = errors.New("version conflict")
+
+// ConflictError reports a write rejected because Key is no longer at Version.
+type ConflictError struct {
+	Key     string
+	Version int64
+}
+
+func (e *ConflictError) Error() string {
+	if e.Version == 0 {
+		return fmt.Sprintf("%s: %s, the key exists", e.Key, ErrConflict)
+	}
+	return fmt.Sprintf("%s: %s, the key is no longer at version %d", e.Key, ErrConflict, e.Version)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// Write is a value for StoreAll to store.
+type Write struct {
+	Key   string
+	Value []byte
+	// IfVersion, if set, only stores the value while the key is at that
+	// version, see StoreVersion.
+	IfVersion *int64
+}
+
+// StoreVersion stores the value at key if the key is still at version, as
+// returned by LoadVersion, and returns the version stored. Like StoreAll, it
+// writes to the primary table, where the condition is checked. Version 0 stores
+// the value only if the key does not exist, or was stored before items were
+// versioned. Otherwise a *ConflictError is returned.
+func (dbs DynamoDBStorage) StoreVersion(ctx context.Context, key string, value []byte, version int64) (int64, error) {
+	if key == "" {
+		return 0, errors.New("key cannot be empty")
+	}
+	dbs = dbs.onPrimary()
+	defer dbs.cache.invalidate(key)
+	item, err := dbs.newItem(ctx, key, value, version)
+	if err != nil {
+		return 0, err
+	}
+	err = dbs.put(ctx, item, versionCondition(version))
+	if conditionFailed(err) {
+		return 0, &ConflictError{Key: key, Version: version}
+	}
+	if err != nil {
+		return 0, err
+	}
+	return item.Version, dbs.expireSite(ctx, item)
+}
+
+// StoreAll stores the values in a single transaction, so either all of them
+// are stored or none are. It returns the versions stored, in the order of
+// writes. Should a write's IfVersion not match, nothing is stored and the
+// *ConflictError of each such write is returned.
+func (dbs DynamoDBStorage) StoreAll(ctx context.Context, writes []Write) ([]int64, error) {
+	dbs = dbs.onPrimary()
+	items := make([]*Item, 0, len(writes))
+	keys := make([]string, 0, len(writes))
+	for _, write := range writes {
+		if write.Key == "" {
+			return nil, errors.New("key cannot be empty")
+		}
+		keys = append(keys, write.Key)
+		var previous int64
+		if write.IfVersion != nil {
+			previous = *write.IfVersion
+		}
+		item, err := dbs.newItem(ctx, write.Key, write.Value, previous)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	dbs.expireWith(items)
+
+	var (
+		transact []types.TransactWriteItem
+		// heads maps the items of the transaction to the writes they put
+		heads    = make(map[int]int, len(writes))
+		versions = make([]int64, 0, len(writes))
+		olds     = make([]map[string]types.AttributeValue, 0, len(writes))
+	)
+	for i, write := range writes {
+		var input dynamodb.PutItemInput
+		if write.IfVersion != nil {
+			input = versionCondition(*write.IfVersion)
+		}
+		puts, err := dbs.putWrites(items[i], input)
+		if err != nil {
+			return nil, err
+		}
+		// A transaction does not return the items it replaced
+		old, err := dbs.chunksOf(ctx, items[i].Key)
+		if err != nil {
+			return nil, err
+		}
+		heads[len(transact)] = i
+		transact = append(transact, puts...)
+		versions = append(versions, items[i].Version)
+		olds = append(olds, old)
+	}
+	if len(transact) > maxTransactItems {
+		return nil, fmt.Errorf("%d items are too many to store together", len(transact))
+	}
+
+	defer dbs.cache.invalidate(keys...)
+	_, err := dbs.Client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: transact,
+	})
+	var canceledErr *types.TransactionCanceledException
+	if errors.As(err, &canceledErr) {
+		var conflicts []error
+		for index, reason := range canceledErr.CancellationReasons {
+			write, ok := heads[index]
+			if ok && aws.ToString(reason.Code) == "ConditionalCheckFailed" {
+				conflicts = append(conflicts, &ConflictError{Key: writes[write].Key, Version: *writes[write].IfVersion})
+			}
+		}
+		if len(conflicts) > 0 {
+			return nil, errors.Join(conflicts...)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, old := range olds {
+		dbs.deleteChunks(ctx, old)
+	}
+	for _, item := range items {
+		if err = dbs.expireSite(ctx, item); err != nil {
+			return versions, err
+		}
+	}
+	return versions, nil
+}
+
+// versionCondition returns the condition of writes expecting the key at
+// version.
+func versionCondition(version int64) dynamodb.PutItemInput {
+	if version == 0 {
+		return dynamodb.PutItemInput{
+			ExpressionAttributeNames: map[string]string{"#version": "Version"},
+			ConditionExpression:      aws.String("attribute_not_exists(#version)"),
+		}
+	}
+	return dynamodb.PutItemInput{
+		ExpressionAttributeNames: map[string]string{"#version": "Version"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":version": &types.AttributeValueMemberN{Value: fmt.Sprint(version)},
+		},
+		ConditionExpression: aws.String("#version = :version"),
+	}
+}
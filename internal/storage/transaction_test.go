@@ -0,0 +1,166 @@
+package storage_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"path"
+	"testing"
+
+	"github.com/CruGlobal/mirage-server/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConflictError(t *testing.T) {
+	testcases := []struct {
+		name   string
+		err    error
+		expect string
+	}{
+		{
+			name:   "exists",
+			err:    &storage.ConflictError{Key: "a"},
+			expect: "a: version conflict, the key exists",
+		},
+		{
+			name:   "version",
+			err:    &storage.ConflictError{Key: "a", Version: 2},
+			expect: "a: version conflict, the key is no longer at version 2",
+		},
+		{
+			name:   "joined",
+			err:    errors.Join(&storage.ConflictError{Key: "a", Version: 2}),
+			expect: "a: version conflict, the key is no longer at version 2",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.ErrorIs(t, tc.err, storage.ErrConflict)
+			var conflictErr *storage.ConflictError
+			require.ErrorAs(t, tc.err, &conflictErr)
+			assert.Equal(t, "a", conflictErr.Key)
+			assert.EqualError(t, tc.err, tc.expect)
+		})
+	}
+}
+
+func (ts *StorageTestSuite) TestStorage_StoreVersion() {
+	t := ts.T()
+	ctx := t.Context()
+	key := path.Join("acme", "acme-v02.api.example.com", "users", "hello@example.com", "hello.json")
+
+	version, err := ts.dbs.StoreVersion(ctx, key, []byte("1"), 0)
+	require.NoError(t, err)
+	assert.Positive(t, version)
+
+	_, err = ts.dbs.StoreVersion(ctx, key, []byte("2"), 0)
+	require.ErrorIs(t, err, storage.ErrConflict, "the key exists")
+
+	content, loaded, err := ts.dbs.LoadVersion(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("1"), content)
+	assert.Equal(t, version, loaded)
+
+	// Any write moves the key to a new version
+	require.NoError(t, ts.dbs.Store(ctx, key, []byte("3")))
+	_, err = ts.dbs.StoreVersion(ctx, key, []byte("4"), version)
+	var conflictErr *storage.ConflictError
+	require.ErrorAs(t, err, &conflictErr)
+	assert.Equal(t, key, conflictErr.Key)
+	assert.Equal(t, version, conflictErr.Version)
+
+	_, version, err = ts.dbs.LoadVersion(ctx, key)
+	require.NoError(t, err)
+	next, err := ts.dbs.StoreVersion(ctx, key, []byte("5"), version)
+	require.NoError(t, err)
+	assert.Greater(t, next, version)
+}
+
+func (ts *StorageTestSuite) TestStorage_StoreAll() {
+	t := ts.T()
+	ctx := t.Context()
+	dir := path.Join("certificates", "acme-v02.api.example.com", "example.com")
+	large := make([]byte, 800*1024)
+	_, err := rand.Read(large)
+	require.NoError(t, err)
+
+	versions, err := ts.dbs.StoreAll(ctx, []storage.Write{
+		{Key: path.Join(dir, "example.com.key"), Value: []byte("key")},
+		{Key: path.Join(dir, "example.com.crt"), Value: large},
+		{Key: path.Join(dir, "example.com.json"), Value: []byte("{}")},
+	})
+	require.NoError(t, err)
+	require.Len(t, versions, 3)
+	assert.Equal(t, 5, ts.countItems(), "the large value is chunked")
+
+	content, err := ts.dbs.Load(ctx, path.Join(dir, "example.com.crt"))
+	require.NoError(t, err)
+	assert.Equal(t, large, content)
+
+	// A conflicting write stores none of the values
+	stale := int64(1)
+	_, err = ts.dbs.StoreAll(ctx, []storage.Write{
+		{Key: path.Join(dir, "example.com.key"), Value: []byte("new key"), IfVersion: &versions[0]},
+		{Key: path.Join(dir, "example.com.crt"), Value: []byte("new crt"), IfVersion: &stale},
+	})
+	var conflictErr *storage.ConflictError
+	require.ErrorAs(t, err, &conflictErr)
+	assert.Equal(t, path.Join(dir, "example.com.crt"), conflictErr.Key)
+
+	content, err = ts.dbs.Load(ctx, path.Join(dir, "example.com.key"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("key"), content)
+
+	_, err = ts.dbs.StoreAll(ctx, []storage.Write{
+		{Key: path.Join(dir, "example.com.key"), Value: []byte("new key"), IfVersion: &versions[0]},
+		{Key: path.Join(dir, "example.com.crt"), Value: []byte("new crt"), IfVersion: &versions[1]},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, ts.countItems(), "the replaced chunks are deleted")
+}
+
+func (ts *StorageTestSuite) TestStorage_StoreBundle() {
+	t := ts.T()
+	ctx := t.Context()
+	dir := path.Join("certificates", "acme-v02.api.example.com", "example.net")
+	keys := []string{
+		path.Join(dir, "example.net.key"),
+		path.Join(dir, "example.net.crt"),
+		path.Join(dir, "example.net.json"),
+	}
+
+	// Files stored under the issuance lock are written straight away, and
+	// again with the metadata
+	require.NoError(t, ts.dbs.Lock(ctx, "issue_cert_example.net"))
+	require.NoError(t, ts.dbs.Store(ctx, keys[0], []byte("key")))
+	require.NoError(t, ts.dbs.Store(ctx, keys[1], []byte("crt")))
+	content, err := ts.dbs.Load(ctx, keys[0])
+	require.NoError(t, err)
+	assert.Equal(t, []byte("key"), content)
+	version := ts.getItem(keys[0]).Version
+	require.NoError(t, ts.dbs.Store(ctx, keys[2], []byte("{}")))
+	for _, key := range keys {
+		assert.True(t, ts.dbs.Exists(ctx, key), key)
+	}
+	assert.Greater(t, ts.getItem(keys[0]).Version, version)
+
+	// Files changed by another instance in between fail the bundle
+	require.NoError(t, ts.dbs.Store(ctx, keys[0], []byte("new key")))
+	_, err = ts.dbs.StoreVersion(ctx, keys[0], []byte("other key"), ts.getItem(keys[0]).Version)
+	require.NoError(t, err)
+	require.ErrorIs(t, ts.dbs.Store(ctx, keys[2], []byte("{}")), storage.ErrConflict)
+
+	// Files left staged stay stored when the lock is released
+	require.NoError(t, ts.dbs.Store(ctx, keys[1], []byte("new crt")))
+	require.NoError(t, ts.dbs.Unlock(ctx, "issue_cert_example.net"))
+	content, err = ts.dbs.Load(ctx, keys[1])
+	require.NoError(t, err)
+	assert.Equal(t, []byte("new crt"), content)
+
+	// Without the lock files are stored straight away
+	require.NoError(t, ts.dbs.Store(ctx, keys[1], bytes.Repeat([]byte("c"), 16)))
+	content, err = ts.dbs.Load(ctx, keys[1])
+	require.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte("c"), 16), content)
+}
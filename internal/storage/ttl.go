@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"go.uber.org/zap"
+)
+
+const (
+	// TTLAttribute is the attribute holding when an item expires, in Unix
+	// seconds. Enable time to live on the table with this attribute for
+	// DynamoDB to delete expired certificates.
+	TTLAttribute = "Expires"
+	// DefaultTTLGracePeriod is how long certificates are kept once expired,
+	// as long as Caddy keeps them.
+	DefaultTTLGracePeriod = 14 * 24 * time.Hour
+)
+
+// ExpiredItem is an item past its TTL that DynamoDB has not deleted yet,
+// which it does within a few days.
+type ExpiredItem struct {
+	Key     string    `json:"key"`
+	Expires time.Time `json:"expires"`
+}
+
+// TimeToLiveInput enables time to live on a certificate table.
+func TimeToLiveInput(table string) *dynamodb.UpdateTimeToLiveInput {
+	return &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(table),
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String(TTLAttribute),
+			Enabled:       aws.Bool(true),
+		},
+	}
+}
+
+// certificateExpiry returns when the certificate file at key expires, plus
+// the grace period, or zero for other keys.
+func (dbs DynamoDBStorage) certificateExpiry(key string, value []byte) int64 {
+	dir, name, ok := bundleFile(key)
+	if !ok || key != path.Join(dir, name+".crt") {
+		return 0
+	}
+	block, _ := pem.Decode(value)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return 0
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		dbs.logger.Warn("unable to parse certificate", zap.String("key", key), zap.Error(err))
+		return 0
+	}
+	return cert.NotAfter.Add(time.Duration(dbs.TTLGracePeriod)).Unix()
+}
+
+// expireWith sets the expiry of the private key and metadata of certificates
+// to that of the certificate stored with them.
+func (dbs DynamoDBStorage) expireWith(items []*Item) {
+	for _, crt := range items {
+		if crt.Expires == 0 {
+			continue
+		}
+		dir, _, _ := bundleFile(dbs.certmagicKey(crt.Key))
+		for _, item := range items {
+			if itemDir, _, ok := bundleFile(dbs.certmagicKey(item.Key)); ok && itemDir == dir {
+				item.Expires = crt.Expires
+			}
+		}
+	}
+}
+
+// siteExpiry returns the expiry of the certificate the private key or
+// metadata at key belongs to, as stored.
+func (dbs DynamoDBStorage) siteExpiry(ctx context.Context, key string) (int64, error) {
+	dir, name, ok := bundleFile(key)
+	if !ok || key == path.Join(dir, name+".crt") {
+		return 0, nil
+	}
+	output, err := dbs.Client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      &dbs.Table,
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]types.AttributeValue{
+			"Key": &types.AttributeValueMemberS{Value: dbs.storageKey(path.Join(dir, name+".crt"))},
+		},
+		ExpressionAttributeNames: map[string]string{"#key": "Key", "#expires": TTLAttribute},
+		ProjectionExpression:     aws.String("#key, #expires"),
+	})
+	if err != nil {
+		return 0, err
+	}
+	var item Item
+	if err = item.Load(output.Item); err != nil {
+		return 0, err
+	}
+	return item.Expires, nil
+}
+
+// expireSite sets the expiry of the private key and metadata stored for the
+// certificate item, which certmagic stores before and after it. Other items
+// are left alone.
+func (dbs DynamoDBStorage) expireSite(ctx context.Context, item *Item) error {
+	key := dbs.certmagicKey(item.Key)
+	dir, name, ok := bundleFile(key)
+	if !ok || key != path.Join(dir, name+".crt") || item.Expires == 0 {
+		return nil
+	}
+	for _, key := range []string{path.Join(dir, name+".key"), path.Join(dir, name+".json")} {
+		output, err := dbs.Client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName: &dbs.Table,
+			Key: map[string]types.AttributeValue{
+				"Key": &types.AttributeValueMemberS{Value: dbs.storageKey(key)},
+			},
+			ExpressionAttributeNames: map[string]string{"#key": "Key", "#expires": TTLAttribute},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":expires": &types.AttributeValueMemberN{Value: strconv.FormatInt(item.Expires, 10)},
+			},
+			ConditionExpression: aws.String("attribute_exists(#key)"),
+			UpdateExpression:    aws.String("SET #expires = :expires"),
+			ReturnValues:        types.ReturnValueAllNew,
+		})
+		if conditionFailed(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("setting expiry of %s: %w", key, err)
+		}
+		if err = dbs.expireChunks(ctx, output.Attributes); err != nil {
+			return fmt.Errorf("setting expiry of %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// expireChunks sets the expiry of the chunks of an item to its own, so they
+// are deleted along with it.
+func (dbs DynamoDBStorage) expireChunks(ctx context.Context, attributes map[string]types.AttributeValue) error {
+	var item Item
+	if err := item.Load(attributes); err != nil {
+		return err
+	}
+	for i := 1; i < item.Chunks; i++ {
+		_, err := dbs.Client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName: &dbs.Table,
+			Key: map[string]types.AttributeValue{
+				"Key": &types.AttributeValueMemberS{Value: chunkKey(item.Key, item.ChunkID, i)},
+			},
+			ExpressionAttributeNames: map[string]string{"#key": "Key", "#expires": TTLAttribute},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":expires": &types.AttributeValueMemberN{Value: strconv.FormatInt(item.Expires, 10)},
+			},
+			ConditionExpression: aws.String("attribute_exists(#key)"),
+			UpdateExpression:    aws.String("SET #expires = :expires"),
+		})
+		if err != nil && !conditionFailed(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Expired lists the items past their TTL within Prefix, sorted by key. It
+// scans the whole table, so it is meant for reports rather than routine use:
+// DynamoDB deletes the items itself.
+func (dbs DynamoDBStorage) Expired(ctx context.Context) ([]ExpiredItem, error) {
+	names := map[string]string{"#expires": TTLAttribute}
+	values := map[string]types.AttributeValue{
+		":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+	}
+	filter := dbs.scanFilter(names, values)
+	paginator := dynamodb.NewScanPaginator(dbs.Client, &dynamodb.ScanInput{
+		TableName:                 &dbs.Table,
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		FilterExpression:          aws.String("#expires < :now AND " + filter),
+		ProjectionExpression:      aws.String("#key, #expires"),
+	})
+
+	var expired []ExpiredItem
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range output.Items {
+			var item Item
+			if err = item.Load(i); err != nil {
+				return nil, err
+			}
+			expired = append(expired, ExpiredItem{Key: dbs.certmagicKey(item.Key), Expires: time.Unix(item.Expires, 0).UTC()})
+		}
+	}
+	slices.SortFunc(expired, func(a, b ExpiredItem) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	return expired, nil
+}
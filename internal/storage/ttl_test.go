@@ -0,0 +1,124 @@
+package storage_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"path"
+	"time"
+
+	"github.com/CruGlobal/mirage-server/internal/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// certificatePEM returns a self-signed certificate for name expiring at notAfter.
+func (ts *StorageTestSuite) certificatePEM(name string, notAfter time.Time) []byte {
+	t := ts.T()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// storeSite stores the files certmagic stores for the certificate of name.
+func (ts *StorageTestSuite) storeSite(name string, notAfter time.Time) []string {
+	t := ts.T()
+	dir := path.Join("certificates", "acme-v02.api.example.com", name)
+	keys := []string{
+		path.Join(dir, name+".key"),
+		path.Join(dir, name+".crt"),
+		path.Join(dir, name+".json"),
+	}
+	require.NoError(t, ts.dbs.Store(t.Context(), keys[0], []byte("key")))
+	require.NoError(t, ts.dbs.Store(t.Context(), keys[1], ts.certificatePEM(name, notAfter)))
+	require.NoError(t, ts.dbs.Store(t.Context(), keys[2], []byte("{}")))
+	return keys
+}
+
+func (ts *StorageTestSuite) TestStorage_TTL() {
+	t := ts.T()
+	notAfter := time.Now().Add(60 * 24 * time.Hour).Truncate(time.Second)
+	expires := notAfter.Add(storage.DefaultTTLGracePeriod).Unix()
+
+	// The private key, stored first, expires with the certificate too
+	for _, key := range ts.storeSite("example.com", notAfter) {
+		assert.Equal(t, expires, ts.getItem(key).Expires, key)
+	}
+
+	// So do files stored together
+	dir := path.Join("certificates", "acme-v02.api.example.com", "example.org")
+	_, err := ts.dbs.StoreAll(t.Context(), []storage.Write{
+		{Key: path.Join(dir, "example.org.key"), Value: []byte("key")},
+		{Key: path.Join(dir, "example.org.crt"), Value: ts.certificatePEM("example.org", notAfter)},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, expires, ts.getItem(path.Join(dir, "example.org.key")).Expires)
+
+	// Other keys do not expire
+	key := path.Join("acme", "acme-v02.api.example.com", "users", "hello@example.com", "hello.key")
+	require.NoError(t, ts.dbs.Store(t.Context(), key, []byte("key")))
+	assert.Zero(t, ts.getItem(key).Expires)
+}
+
+func (ts *StorageTestSuite) TestStorage_TTLChunks() {
+	t := ts.T()
+	notAfter := time.Now().Add(60 * 24 * time.Hour).Truncate(time.Second)
+	expires := notAfter.Add(storage.DefaultTTLGracePeriod).Unix()
+
+	// Chunks expire with their item, so none are left behind once DynamoDB
+	// deletes it. Random bytes do not compress, so 1 MB needs three items.
+	dir := path.Join("certificates", "acme-v02.api.example.com", "example.com")
+	large := make([]byte, 1024*1024)
+	_, err := rand.Read(large)
+	require.NoError(t, err)
+	require.NoError(t, ts.dbs.Store(t.Context(), path.Join(dir, "example.com.key"), large))
+	require.NoError(t, ts.dbs.Store(t.Context(), path.Join(dir, "example.com.crt"), append(ts.certificatePEM("example.com", notAfter), large...)))
+	require.NoError(t, ts.dbs.Store(t.Context(), path.Join(dir, "example.com.json"), large))
+
+	output, err := ts.dbs.Client.Scan(t.Context(), &dynamodb.ScanInput{
+		TableName:      aws.String(ts.dbs.Table),
+		ConsistentRead: aws.Bool(true),
+	})
+	require.NoError(t, err)
+	require.Len(t, output.Items, 9)
+	for _, i := range output.Items {
+		var item storage.Item
+		require.NoError(t, item.Load(i))
+		assert.Equal(t, expires, item.Expires, item.Key)
+	}
+}
+
+func (ts *StorageTestSuite) TestStorage_Expired() {
+	t := ts.T()
+	expired := ts.storeSite("example.com", time.Now().Add(-30*24*time.Hour))
+	ts.storeSite("example.org", time.Now().Add(30*24*time.Hour))
+
+	// The scan is eventually consistent
+	var items []storage.ExpiredItem
+	require.Eventually(t, func() bool {
+		var err error
+		items, err = ts.dbs.Expired(t.Context())
+		return err == nil && len(items) == len(expired)
+	}, 5*time.Second, 100*time.Millisecond)
+	var keys []string
+	for _, item := range items {
+		keys = append(keys, item.Key)
+		assert.True(t, item.Expires.Before(time.Now()), item.Key)
+	}
+	assert.ElementsMatch(t, expired, keys)
+}
@@ -2,11 +2,15 @@ package miragetest
 
 import (
 	"fmt"
+	"maps"
+	"slices"
+	"strings"
 	"testing"
 
+	"github.com/CruGlobal/mirage-server/internal/dynamo"
+	"github.com/CruGlobal/mirage-server/internal/source"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
@@ -14,24 +18,50 @@ import (
 	tcddb "github.com/testcontainers/testcontainers-go/modules/dynamodb"
 )
 
+// ClosedEndpoint refuses connections straight away, for tests that provision
+// without DynamoDB. Provisioning checks the tables, and an endpoint that
+// drops connections would hold each test up until the check times out.
+const ClosedEndpoint = "http://127.0.0.1:1"
+
 type TestConfig struct {
 	Region   string
 	Endpoint string
 	Table    string
 	Key      string
+	Profiles map[string]TestProfile
+	// StorageTable configures dynamodb certificate storage with this table.
+	// The storage module must be imported by the test.
+	StorageTable string
+}
+
+// TestProfile configures a named mirage profile.
+type TestProfile struct {
+	Table string
+	Key   string
 }
 
 func NewMirageCaddyContext(t *testing.T, config TestConfig) caddy.Context {
 	t.Helper()
 
+	var profiles strings.Builder
+	for _, name := range slices.Sorted(maps.Keys(config.Profiles)) {
+		profile := config.Profiles[name]
+		fmt.Fprintf(&profiles, "\t\tprofile %s {\n\t\t\ttable %s\n\t\t\tkey %s\n\t\t}\n", name, profile.Table, profile.Key)
+	}
+
+	var storage string
+	if config.StorageTable != "" {
+		storage = fmt.Sprintf("\tstorage dynamodb {\n\t\ttable %s\n\t}\n", config.StorageTable)
+	}
+
 	caddyfileInput := fmt.Sprintf(`{
 	mirage {
 		region %s
 		endpoint %s
 		table %s
 		key %s
-	}
-	log {
+%s	}
+%s	log {
 		level ERROR
 	}
 }
@@ -40,6 +70,8 @@ func NewMirageCaddyContext(t *testing.T, config TestConfig) caddy.Context {
 		config.Endpoint,
 		config.Table,
 		config.Key,
+		profiles.String(),
+		storage,
 	)
 	adapter := caddyfile.Adapter{ServerType: &httpcaddyfile.ServerType{}}
 	adaptedJSON, warnings, err := adapter.Adapt([]byte(caddyfileInput), nil)
@@ -67,29 +99,14 @@ func CreateDynamoDBContainer(t *testing.T) (string, *tcddb.DynamoDBContainer) {
 	return fmt.Sprintf("http://%s", endpoint), ddbc
 }
 
-func CreateDynamoDBTable(t *testing.T, client *dynamodb.Client, table string, key string) {
+func CreateDynamoDBTable(t *testing.T, client dynamo.Client, table string, key string) {
 	t.Helper()
 	t.Logf("create dynamodb table %s with key %s", table, key)
-	_, err := client.CreateTable(t.Context(), &dynamodb.CreateTableInput{
-		TableName:   aws.String(table),
-		BillingMode: types.BillingModePayPerRequest,
-		KeySchema: []types.KeySchemaElement{
-			{
-				AttributeName: aws.String(key),
-				KeyType:       types.KeyTypeHash,
-			},
-		},
-		AttributeDefinitions: []types.AttributeDefinition{
-			{
-				AttributeName: aws.String(key),
-				AttributeType: types.ScalarAttributeTypeS,
-			},
-		},
-	})
+	_, err := client.CreateTable(t.Context(), source.CreateTableInput(table, key))
 	require.NoError(t, err)
 }
 
-func DeleteDynamoDBTable(t *testing.T, client *dynamodb.Client, table string) {
+func DeleteDynamoDBTable(t *testing.T, client dynamo.Client, table string) {
 	t.Helper()
 	t.Logf("delete dynamodb table %s", table)
 	_, err := client.DeleteTable(t.Context(), &dynamodb.DeleteTableInput{
@@ -97,3 +114,15 @@ func DeleteDynamoDBTable(t *testing.T, client *dynamodb.Client, table string) {
 	})
 	require.NoError(t, err)
 }
+
+// DynamoDBSource returns the DynamoDB source the mirage app provisions by
+// default.
+func DynamoDBSource(t *testing.T, src source.RedirectSource) *source.DynamoDB {
+	t.Helper()
+	layered, ok := src.(*source.Layered)
+	require.True(t, ok, "unexpected source type: %T", src)
+	require.NotEmpty(t, layered.Layers())
+	ddb, ok := layered.Layers()[0].Source.(*source.DynamoDB)
+	require.True(t, ok, "unexpected source type: %T", layered.Layers()[0].Source)
+	return ddb
+}